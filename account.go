@@ -0,0 +1,280 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+// confirmPassword checks the signed-in user's password before a sensitive
+// change. Wrong guesses count against the same lockout as logins. On
+// failure it writes the response and returns false.
+func confirmPassword(w http.ResponseWriter, r *http.Request, user database.User, password string) bool {
+	if retryAfter := loginRetryAfter(r, user.Email); retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter)
+		return false
+	}
+	if err := auth.CheckPasswordHash(password, user.HashedPassword); err != nil {
+		recordLoginFailure(r, user.Email)
+		respondWithError(w, 403, "Incorrect password")
+		return false
+	}
+	apiCfg.loginAccountThrottle.Reset(loginAccountKey(user.Email))
+	return true
+}
+
+// handlerDeleteAccount deletes the caller's account once they confirm their
+// password. With a grace period configured the account is only scheduled
+// for deletion: it is signed out everywhere, and logging in again before
+// the period ends cancels the deletion.
+func handlerDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+	type response struct {
+		DeleteAfter time.Time `json:"delete_after"`
+	}
+
+	userID := currentPrincipal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if !confirmPassword(w, r, user, params.Password) {
+		return
+	}
+
+	if apiCfg.accountDeletionGrace <= 0 {
+		// Chirps, tokens and credentials go with the user through
+		// ON DELETE CASCADE.
+		if _, err := apiCfg.dbQueries.DeleteUser(r.Context(), userID); err != nil {
+			log.Printf("Unable to delete user: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
+		respondWithJSON(w, 204, nil)
+		return
+	}
+
+	deleteAfter, err := apiCfg.dbQueries.ScheduleUserDeletion(r.Context(), database.ScheduleUserDeletionParams{
+		GraceSeconds: apiCfg.accountDeletionGrace.Seconds(),
+		ID:           userID,
+	})
+	if err != nil {
+		log.Printf("Unable to schedule user deletion: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if err := apiCfg.dbQueries.RevokeAllRefreshTokensForUser(r.Context(), userID); err != nil {
+		log.Printf("Unable to revoke refresh tokens: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 202, response{DeleteAfter: deleteAfter.Time})
+}
+
+// purgeDeletedUsers deletes accounts whose grace period has ended, every
+// interval until ctx is done.
+func purgeDeletedUsers(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := apiCfg.dbQueries.PurgeDeletedUsers(ctx)
+		if err != nil {
+			log.Printf("Unable to purge deleted users: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted users", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// accountExport is the profile section of a data export.
+type accountExport struct {
+	ID              string     `json:"id"`
+	Email           string     `json:"email"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	IsChirpyRed     bool       `json:"is_chirpy_red"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Role            string     `json:"role"`
+	TOTPEnabled     bool       `json:"totp_enabled"`
+	Handle          string     `json:"handle"`
+	DisplayName     string     `json:"display_name"`
+	Bio             string     `json:"bio"`
+	AvatarURL       string     `json:"avatar_url"`
+}
+
+// handlerExportAccount sends the caller a ZIP of JSON files holding
+// everything stored about them. Secrets and their hashes are left out.
+func handlerExportAccount(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+	ctx := r.Context()
+
+	files, err := collectAccountExport(ctx, userID)
+	if err != nil {
+		log.Printf("Unable to collect account export: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%s.zip"`, time.Now().UTC().Format("2006-01-02")))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+
+	archive := zip.NewWriter(w)
+	for _, f := range files {
+		entry, err := archive.Create(f.name)
+		if err != nil {
+			log.Printf("Unable to write account export: %v", err)
+			return
+		}
+		encoder := json.NewEncoder(entry)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(f.data); err != nil {
+			log.Printf("Unable to write account export: %v", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Unable to write account export: %v", err)
+	}
+}
+
+type exportFile struct {
+	name string
+	data any
+}
+
+// collectAccountExport reads everything up front, so a database error can
+// still be reported before the archive starts streaming.
+func collectAccountExport(ctx context.Context, userID uuid.UUID) ([]exportFile, error) {
+	user, err := apiCfg.dbQueries.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	profile := accountExport{
+		ID:          user.ID.String(),
+		Email:       user.Email,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+		IsChirpyRed: user.IsChirpyRed,
+		Role:        user.Role,
+		Handle:      user.Handle.String,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarUrl,
+	}
+	if user.EmailVerifiedAt.Valid {
+		profile.EmailVerifiedAt = &user.EmailVerifiedAt.Time
+	}
+	totp, err := apiCfg.dbQueries.GetTOTPCredential(ctx, user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	profile.TOTPEnabled = err == nil && totp.ConfirmedAt.Valid
+
+	dbChirps, err := apiCfg.dbQueries.GetChirpsByUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	chirps := []Chirp{}
+	for _, c := range dbChirps {
+		chirps = append(chirps, convertChirp(c))
+	}
+	if err := loadAttachments(ctx, chirps); err != nil {
+		return nil, err
+	}
+
+	dbSessions, err := apiCfg.dbQueries.GetSessionsForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for _, s := range dbSessions {
+		sessions = append(sessions, Session{
+			ID:         s.FamilyID,
+			UserAgent:  s.UserAgent,
+			IPAddress:  s.IpAddress,
+			SignedInAt: s.SignedInAt,
+			LastUsedAt: s.LastUsedAt,
+			ExpiresAt:  s.ExpiresAt,
+		})
+	}
+
+	dbPasskeys, err := apiCfg.dbQueries.GetWebAuthnCredentialsForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys := []Passkey{}
+	for _, c := range dbPasskeys {
+		passkeys = append(passkeys, convertPasskey(c))
+	}
+
+	dbTokens, err := apiCfg.dbQueries.GetPersonalAccessTokensForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []PersonalAccessToken{}
+	for _, t := range dbTokens {
+		tokens = append(tokens, convertPersonalAccessToken(t))
+	}
+
+	dbClients, err := apiCfg.dbQueries.GetOAuthClientsForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	clients := []OAuthClient{}
+	for _, c := range dbClients {
+		clients = append(clients, convertOAuthClient(c))
+	}
+
+	dbGrants, err := apiCfg.dbQueries.GetOAuthGrantsForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	grants := []OAuthGrant{}
+	for _, g := range dbGrants {
+		grants = append(grants, OAuthGrant{
+			ClientID:   g.ClientID,
+			ClientName: g.ClientName,
+			Scopes:     g.Scopes,
+			CreatedAt:  g.CreatedAt,
+			UpdatedAt:  g.UpdatedAt,
+		})
+	}
+
+	return []exportFile{
+		{"profile.json", profile},
+		{"chirps.json", chirps},
+		{"sessions.json", sessions},
+		{"passkeys.json", passkeys},
+		{"personal_access_tokens.json", tokens},
+		{"oauth_clients.json", clients},
+		{"oauth_grants.json", grants},
+	}, nil
+}
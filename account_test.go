@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+func deleteAccount(token, body string) int {
+	return callWithToken(handlerDeleteAccount, "DELETE", "/api/users/me", token, body).Code
+}
+
+func TestDeleteAccount(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	other := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+	db.CreateChirp(context.Background(), database.CreateChirpParams{Body: "goodbye", UserID: user.ID})
+	db.CreateChirp(context.Background(), database.CreateChirpParams{Body: "still here", UserID: other.ID})
+	pat := newPersonalAccessToken(t, user.ID, `{"name":"bot","scopes":["read:chirps"],"current_password":"correct horse battery staple"}`)
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+
+	if code := deleteAccount(session.Token, `{"password":"wrong password"}`); code != 403 {
+		t.Fatalf("Expected a wrong password to be refused, got %d", code)
+	}
+	if code := deleteAccount(pat.Token, `{"password":"correct horse battery staple"}`); code != 403 {
+		t.Errorf("Expected a personal access token to be unable to delete the account, got %d", code)
+	}
+	if code := deleteAccount(session.Token, `{"password":"correct horse battery staple"}`); code != 204 {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+
+	if _, ok := db.users[user.ID]; ok {
+		t.Error("Expected the user to be deleted")
+	}
+	if len(db.chirps) != 1 || len(db.patTokens) != 0 {
+		t.Errorf("Expected the user's chirps and tokens to go with them, have %d chirps and %d tokens", len(db.chirps), len(db.patTokens))
+	}
+	if rec := refresh(session.RefreshToken); rec.Code != 401 {
+		t.Errorf("Expected the refresh token to be gone, got %d", rec.Code)
+	}
+	if _, ok := db.users[other.ID]; !ok {
+		t.Error("Expected other users to be untouched")
+	}
+}
+
+func TestDeleteAccountGracePeriod(t *testing.T) {
+	db := setupTestAPI(t)
+	apiCfg.accountDeletionGrace = 30 * 24 * time.Hour
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	pat := newPersonalAccessToken(t, user.ID, `{"name":"bot","scopes":["read:chirps"],"current_password":"correct horse battery staple"}`)
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+
+	rec := callWithToken(handlerDeleteAccount, "DELETE", "/api/users/me", session.Token, `{"password":"correct horse battery staple"}`)
+	if rec.Code != 202 {
+		t.Fatalf("Expected status 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var scheduled struct {
+		DeleteAfter time.Time `json:"delete_after"`
+	}
+	json.NewDecoder(rec.Body).Decode(&scheduled)
+	if !db.users[user.ID].DeleteAfter.Valid || !scheduled.DeleteAfter.Equal(db.users[user.ID].DeleteAfter.Time) {
+		t.Fatalf("Expected deletion to be scheduled, got %+v", scheduled)
+	}
+
+	// The account is signed out everywhere while it waits.
+	if code := callWithToken(handlerGetSessions, "GET", "/api/users/me/sessions", session.Token, "").Code; code != 401 {
+		t.Errorf("Expected the access token to be revoked, got %d", code)
+	}
+	if rec := refresh(session.RefreshToken); rec.Code != 401 {
+		t.Errorf("Expected the refresh token to be revoked, got %d", rec.Code)
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", pat.Token, ""); rec.Code != 401 {
+		t.Errorf("Expected the personal access token to be refused, got %d", rec.Code)
+	}
+
+	// Logging in again restores it.
+	if rec := login("user@example.com", "correct horse battery staple"); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if db.users[user.ID].DeleteAfter.Valid {
+		t.Fatal("Expected logging in to cancel the deletion")
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", pat.Token, ""); rec.Code != 200 {
+		t.Errorf("Expected the personal access token to work again, got %d", rec.Code)
+	}
+
+	// Once the grace period ends the purge removes it for good.
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+	deleteAccount(session.Token, `{"password":"correct horse battery staple"}`)
+	if purged, _ := db.PurgeDeletedUsers(context.Background()); purged != 0 {
+		t.Fatalf("Expected nothing to purge during the grace period, purged %d", purged)
+	}
+	stored := db.users[user.ID]
+	stored.DeleteAfter.Time = time.Now().Add(-time.Second)
+	db.users[user.ID] = stored
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	purgeDeletedUsers(ctx, time.Hour)
+	if _, ok := db.users[user.ID]; ok {
+		t.Error("Expected the user to be purged")
+	}
+}
+
+func TestExportAccount(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	db.CreateChirp(context.Background(), database.CreateChirpParams{Body: "first chirp", UserID: user.ID})
+	pat := newPersonalAccessToken(t, user.ID, `{"name":"bot","scopes":["read:chirps"],"current_password":"correct horse battery staple"}`)
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+
+	rec := callWithToken(handlerExportAccount, "GET", "/api/users/me/export", session.Token, "")
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a ZIP, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment;") {
+		t.Errorf("Expected an attachment, got %q", rec.Header().Get("Content-Disposition"))
+	}
+
+	body := rec.Body.Bytes()
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Unable to read export: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("Unable to open %s: %v", f.Name, err)
+		}
+		files[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+	for _, name := range []string{"profile.json", "chirps.json", "sessions.json", "passkeys.json", "personal_access_tokens.json", "oauth_clients.json", "oauth_grants.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %s in the export", name)
+		}
+	}
+
+	var profile accountExport
+	json.Unmarshal(files["profile.json"], &profile)
+	if profile.Email != "user@example.com" || profile.ID != user.ID.String() {
+		t.Errorf("Unexpected profile %+v", profile)
+	}
+	var chirps []Chirp
+	json.Unmarshal(files["chirps.json"], &chirps)
+	if len(chirps) != 1 || chirps[0].Body != "first chirp" {
+		t.Errorf("Unexpected chirps %+v", chirps)
+	}
+	var sessions []Session
+	json.Unmarshal(files["sessions.json"], &sessions)
+	if len(sessions) != 1 {
+		t.Errorf("Expected one session, got %d", len(sessions))
+	}
+
+	for name, data := range files {
+		for _, secret := range []string{db.users[user.ID].HashedPassword, pat.Token, db.patTokens[pat.ID].TokenHash, session.RefreshToken} {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("Expected %s to leave out secrets", name)
+			}
+		}
+	}
+
+	if rec := callWithToken(handlerExportAccount, "GET", "/api/users/me/export", pat.Token, ""); rec.Code != 403 {
+		t.Errorf("Expected a personal access token to be unable to export, got %d", rec.Code)
+	}
+}
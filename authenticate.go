@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID      uuid.UUID
+	IsChirpyRed bool
+	Role        string
+	// SessionID is the refresh token family the access token was issued
+	// from.
+	SessionID uuid.UUID
+	// ClientID is the OAuth client acting for the user, or uuid.Nil when the
+	// user is calling directly.
+	ClientID uuid.UUID
+	// TokenID is the personal access token used, if any.
+	TokenID uuid.UUID
+	// Scopes limits what a delegated token, issued to an OAuth client or
+	// created as a personal access token, may do. Nil means a first-party
+	// token with full access.
+	Scopes []string
+}
+
+// HasScope reports whether the principal may act with scope.
+func (p Principal) HasScope(scope string) bool {
+	return p.Scopes == nil || slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the principal stored by requireAuth or optionalAuth.
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// currentPrincipal returns the caller of a handler registered behind
+// requireAuth. It panics if the route was registered without it.
+func currentPrincipal(r *http.Request) Principal {
+	p, ok := principalFrom(r.Context())
+	if !ok {
+		panic("currentPrincipal called on a route without requireAuth")
+	}
+	return p
+}
+
+// requireAuth rejects requests without a valid access token and passes the
+// caller on to next in the request context. Delegated tokens are refused;
+// routes open to them use requireScope instead.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return requireScope("", next)
+}
+
+// requireScope is requireAuth for routes a delegated token may call if it
+// carries scope. An empty scope admits first-party tokens only.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		if principal.Scopes != nil && (scope == "" || !principal.HasScope(scope)) {
+			respondInsufficientScope(w, scope)
+			return
+		}
+		next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// optionalAuth lets anonymous requests through but authenticates any that
+// carry an Authorization header. A bad token is still rejected rather than
+// silently treated as anonymous.
+func optionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return optionalScope("", next)
+}
+
+// optionalScope is optionalAuth for routes delegated tokens may call with
+// scope.
+func optionalScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+		requireScope(scope, next)(w, r)
+	}
+}
+
+// authenticate validates the request's bearer access token and checks it
+// has not been revoked, either by a bump of the user's token version or by
+// revoking the session it was issued for. On failure it writes the error
+// response and returns false.
+func authenticate(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondUnauthorized(w, "Bearer", err)
+		return Principal{}, false
+	}
+	if auth.IsPersonalAccessToken(token) {
+		return authenticatePersonalAccessToken(w, r, token)
+	}
+
+	claims, err := auth.ValidateJWT(token, apiCfg.jwtConfig, auth.TokenTypeAccess)
+	if err != nil {
+		respondUnauthorized(w, "Bearer", err)
+		return Principal{}, false
+	}
+
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondUnauthorized(w, "Bearer", errInvalidToken)
+		return Principal{}, false
+	}
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return Principal{}, false
+	}
+	if claims.TokenVersion != user.TokenVersion {
+		respondUnauthorized(w, "Bearer", errTokenRevoked)
+		return Principal{}, false
+	}
+	if claims.SessionID != uuid.Nil {
+		active, err := apiCfg.dbQueries.IsSessionActive(r.Context(), claims.SessionID)
+		if err != nil {
+			log.Printf("Unable to check session: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return Principal{}, false
+		}
+		if !active {
+			respondUnauthorized(w, "Bearer", errTokenRevoked)
+			return Principal{}, false
+		}
+	}
+	principal := Principal{
+		UserID:      user.ID,
+		IsChirpyRed: user.IsChirpyRed,
+		Role:        user.Role,
+		SessionID:   claims.SessionID,
+	}
+	if claims.ClientID == uuid.Nil {
+		return principal, true
+	}
+
+	// Revoking a grant revokes every token issued under it, and a token
+	// never carries more than the user still allows.
+	grant, err := apiCfg.dbQueries.GetOAuthGrant(r.Context(), database.GetOAuthGrantParams{
+		UserID:   user.ID,
+		ClientID: claims.ClientID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondUnauthorized(w, "Bearer", errTokenRevoked)
+		return Principal{}, false
+	}
+	if err != nil {
+		log.Printf("Unable to get OAuth grant: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return Principal{}, false
+	}
+	principal.ClientID = claims.ClientID
+	principal.Scopes = []string{}
+	for _, scope := range claims.Scopes {
+		if slices.Contains(grant.Scopes, scope) {
+			principal.Scopes = append(principal.Scopes, scope)
+		}
+	}
+	return principal, true
+}
+
+// authenticatePersonalAccessToken looks up a personal access token by its
+// hash. These last until they expire, are deleted, or the user's password is
+// changed or reset.
+func authenticatePersonalAccessToken(w http.ResponseWriter, r *http.Request, token string) (Principal, bool) {
+	pat, err := apiCfg.dbQueries.GetPersonalAccessToken(r.Context(), auth.HashRefreshToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		respondUnauthorized(w, "Bearer", errInvalidToken)
+		return Principal{}, false
+	}
+	if err != nil {
+		log.Printf("Unable to get personal access token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return Principal{}, false
+	}
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), pat.UserID)
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return Principal{}, false
+	}
+	if user.DeleteAfter.Valid {
+		// Access tokens are revoked by the token version bump when an
+		// account is scheduled for deletion; these have to be checked.
+		respondUnauthorized(w, "Bearer", errTokenRevoked)
+		return Principal{}, false
+	}
+	if err := apiCfg.dbQueries.TouchPersonalAccessToken(r.Context(), pat.ID); err != nil {
+		log.Printf("Unable to record personal access token use: %v", err)
+	}
+	return Principal{
+		UserID:      user.ID,
+		IsChirpyRed: user.IsChirpyRed,
+		Role:        user.Role,
+		TokenID:     pat.ID,
+		Scopes:      append([]string{}, pat.Scopes...),
+	}, true
+}
+
+// authRealm is the realm named in WWW-Authenticate challenges.
+const authRealm = "chirpy"
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenRevoked = errors.New("token has been revoked")
+)
+
+// respondUnauthorized sends a 401 with a WWW-Authenticate challenge for
+// scheme. A missing header gets a bare challenge, a malformed one is an
+// invalid_request, and anything else means the credential was rejected.
+func respondUnauthorized(w http.ResponseWriter, scheme string, err error) {
+	errorCode, description := "invalid_token", ""
+	switch {
+	case errors.Is(err, auth.ErrMissingAuthorization):
+		errorCode = ""
+	case errors.Is(err, auth.ErrInvalidAuthorization):
+		errorCode = "invalid_request"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		description = "the access token expired"
+	case errors.Is(err, errTokenRevoked):
+		description = "the access token has been revoked"
+	}
+	w.Header().Set("WWW-Authenticate", auth.Challenge(scheme,
+		"realm", authRealm,
+		"error", errorCode,
+		"error_description", description,
+	))
+	respondWithError(w, 401, "Unauthorized")
+}
+
+// respondInsufficientScope sends a 403 for a token that is valid but may not
+// be used for this request, naming the scope it would need.
+func respondInsufficientScope(w http.ResponseWriter, scope string) {
+	w.Header().Set("WWW-Authenticate", auth.Challenge("Bearer",
+		"realm", authRealm,
+		"error", "insufficient_scope",
+		"scope", scope,
+	))
+	respondWithError(w, 403, "Insufficient scope")
+}
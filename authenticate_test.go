@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// capturePrincipal records the principal a handler sees, if any.
+func capturePrincipal(got *Principal, found *bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*got, *found = principalFrom(r.Context())
+		w.WriteHeader(200)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	db.SetUserToRed(context.Background(), user.ID)
+
+	cases := []struct {
+		name          string
+		authHeader    string
+		middleware    func(http.HandlerFunc) http.HandlerFunc
+		wantStatus    int
+		wantPrincipal bool
+	}{
+		{name: "required without token", middleware: requireAuth, wantStatus: 401},
+		{name: "required with bad token", authHeader: "Bearer nope", middleware: requireAuth, wantStatus: 401},
+		{name: "required for unknown user", authHeader: bearer(t, uuid.New()), middleware: requireAuth, wantStatus: 401},
+		{name: "required", authHeader: bearer(t, user.ID), middleware: requireAuth, wantStatus: 200, wantPrincipal: true},
+		{name: "optional without token", middleware: optionalAuth, wantStatus: 200},
+		{name: "optional with bad token", authHeader: "Bearer nope", middleware: optionalAuth, wantStatus: 401},
+		{name: "optional", authHeader: bearer(t, user.ID), middleware: optionalAuth, wantStatus: 200, wantPrincipal: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var principal Principal
+			var found bool
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.authHeader != "" {
+				req.Header.Set("Authorization", tc.authHeader)
+			}
+			rec := httptest.NewRecorder()
+			tc.middleware(capturePrincipal(&principal, &found))(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d", tc.wantStatus, rec.Code)
+			}
+			if found != tc.wantPrincipal {
+				t.Fatalf("Expected principal %v, got %v", tc.wantPrincipal, found)
+			}
+			if found && (principal.UserID != user.ID || !principal.IsChirpyRed || principal.Scopes != nil) {
+				t.Errorf("Unexpected principal %+v", principal)
+			}
+		})
+	}
+}
+
+func TestPrincipalHasScope(t *testing.T) {
+	if !(Principal{}).HasScope("write:chirps") {
+		t.Error("Expected first-party principal to have every scope")
+	}
+	delegated := Principal{Scopes: []string{"read:chirps"}}
+	if !delegated.HasScope("read:chirps") || delegated.HasScope("write:chirps") {
+		t.Errorf("Expected delegated principal to have only its scopes")
+	}
+}
+
+func TestUnauthorizedChallenges(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	cases := []struct {
+		name       string
+		authHeader string
+		handler    http.HandlerFunc
+		want       string
+	}{
+		{name: "missing", handler: requireAuth(handlerChirps), want: `Bearer realm="chirpy"`},
+		{name: "malformed", authHeader: "Bearer a b", handler: requireAuth(handlerChirps), want: `Bearer realm="chirpy", error="invalid_request"`},
+		{name: "wrong scheme", authHeader: "Basic dXNlcjpwYXNz", handler: requireAuth(handlerChirps), want: `Bearer realm="chirpy", error="invalid_request"`},
+		{name: "invalid token", authHeader: "Bearer nope", handler: requireAuth(handlerChirps), want: `Bearer realm="chirpy", error="invalid_token"`},
+		{name: "unknown refresh token", authHeader: "Bearer nope", handler: handlerRefresh, want: `Bearer realm="chirpy", error="invalid_token"`},
+		{name: "missing api key", handler: handlerSetRed, want: `ApiKey realm="chirpy"`},
+		{name: "wrong api key", authHeader: "ApiKey nope", handler: handlerSetRed, want: `ApiKey realm="chirpy", error="invalid_token"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", nil)
+			if tc.authHeader != "" {
+				req.Header.Set("Authorization", tc.authHeader)
+			}
+			rec := httptest.NewRecorder()
+			tc.handler(rec, req)
+			if rec.Code != 401 {
+				t.Fatalf("Expected status 401, got %d", rec.Code)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tc.want {
+				t.Errorf("Expected challenge %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	// Schemes are case-insensitive.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "bearer "+bearer(t, user.ID)[len("Bearer "):])
+	var found bool
+	var principal Principal
+	rec := httptest.NewRecorder()
+	requireAuth(capturePrincipal(&principal, &found))(rec, req)
+	if rec.Code != 200 || !found {
+		t.Errorf("Expected lowercase bearer scheme to be accepted, got %d", rec.Code)
+	}
+}
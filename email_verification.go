@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+	"github.com/thmastin/Chirpy/internal/mail"
+	"github.com/thmastin/Chirpy/internal/throttle"
+)
+
+// emailVerificationTTL is how long a verification link stays valid.
+const emailVerificationTTL = 24 * time.Hour
+
+// verificationResendPolicy limits how often verification emails can be
+// requested for one address or from one client.
+var verificationResendPolicy = throttle.Policy{
+	FreeAttempts:     2,
+	BaseDelay:        time.Minute,
+	MaxDelay:         time.Hour,
+	LockoutThreshold: 10,
+	LockoutDuration:  24 * time.Hour,
+	Window:           24 * time.Hour,
+}
+
+// mailerFromEnv sends through SMTP_ADDR when it is set and otherwise writes
+// messages to MAIL_OUTBOX_DIR (default "outbox") for local development.
+func mailerFromEnv() mail.Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@chirpy.local>"
+	}
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "outbox"
+		}
+		log.Printf("SMTP_ADDR not set, writing outgoing mail to %s", dir)
+		return mail.FileOutbox{Dir: dir, From: from}
+	}
+	var smtpAuth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		smtpAuth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return mail.SMTPMailer{Addr: addr, From: from, Auth: smtpAuth}
+}
+
+// sendVerificationEmail mails user a link that confirms their current email
+// address. The link is a signed token bound to the address, and is spent
+// once the address is verified or changed.
+func sendVerificationEmail(ctx context.Context, user database.User) error {
+	token, err := auth.MakeJWT(auth.Claims{
+		Type:   auth.TokenTypeEmailVerification,
+		UserID: user.ID,
+		Email:  user.Email,
+	}, apiCfg.jwtConfig, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	link := apiCfg.publicURL + "/api/users/verify?token=" + url.QueryEscape(token)
+	return apiCfg.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf("Welcome to Chirpy!\n\nConfirm your email address by opening this link within %d hours:\n\n%s\n\nIf you did not sign up, you can ignore this email.\n",
+			int(emailVerificationTTL.Hours()), link),
+	})
+}
+
+// reserveVerificationEmail counts an email about to be sent to email at this
+// client's request against verificationResendPolicy. It returns how long to
+// wait when the address or client is over the limit, and 0 otherwise.
+func reserveVerificationEmail(r *http.Request, email string) time.Duration {
+	emailKey := loginAccountKey(email)
+	ipKey := "ip:" + clientIP(r)
+	retryAfter := max(apiCfg.verificationThrottle.Check(emailKey), apiCfg.verificationThrottle.Check(ipKey))
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	apiCfg.verificationThrottle.Fail(emailKey)
+	apiCfg.verificationThrottle.Fail(ipKey)
+	return 0
+}
+
+// sendAccountExistsEmail tells the owner of an address that someone tried
+// to sign up with it again. Signup sends it in place of a verification
+// email so both cases take a similar amount of work.
+func sendAccountExistsEmail(ctx context.Context, email string) error {
+	return apiCfg.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Your Chirpy account",
+		Body:    "Someone tried to create a Chirpy account with this email address, but you already have one. Log in instead, or ignore this email if it was not you.\n",
+	})
+}
+
+// sendEmailChangedEmail tells the previous address on an account that the
+// email was changed.
+func sendEmailChangedEmail(ctx context.Context, oldEmail, newEmail string) error {
+	return apiCfg.mailer.Send(ctx, mail.Message{
+		To:      oldEmail,
+		Subject: "Your Chirpy email address was changed",
+		Body:    fmt.Sprintf("The email address on your Chirpy account was changed to %s. If you did not make this change, reset your password and contact support.\n", newEmail),
+	})
+}
+
+// handlerVerifyEmail accepts the token as a query parameter, so the emailed
+// link works with GET, or as a JSON body via POST.
+func handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var params struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, 400, "Invalid request body")
+			return
+		}
+		token = params.Token
+	}
+
+	claims, err := auth.ValidateJWT(token, apiCfg.jwtConfig, auth.TokenTypeEmailVerification)
+	if err != nil {
+		respondWithError(w, 400, "Invalid or expired verification token")
+		return
+	}
+
+	verified, err := apiCfg.dbQueries.VerifyUserEmail(r.Context(), database.VerifyUserEmailParams{
+		ID:    claims.UserID,
+		Email: claims.Email,
+	})
+	if err != nil {
+		log.Printf("Unable to verify email: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if verified == 0 {
+		respondWithError(w, 400, "Invalid or expired verification token")
+		return
+	}
+	respondWithJSON(w, 200, signupResponse{Message: "Your email address has been verified."})
+}
+
+func handlerResendVerification(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	params.Email = normalizeEmail(params.Email)
+	if retryAfter := reserveVerificationEmail(r, params.Email); retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter)
+		return
+	}
+
+	// Respond the same way whether or not the address is registered or
+	// already verified.
+	user, err := apiCfg.dbQueries.GetUserByEmail(r.Context(), params.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if err == nil && !user.EmailVerifiedAt.Valid {
+		if err := sendVerificationEmail(r.Context(), user); err != nil {
+			log.Printf("Unable to send verification email: %v", err)
+		}
+	}
+	respondWithJSON(w, 202, signupResponse{
+		Message: "If this email is registered and not yet verified, a new verification link is on its way.",
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thmastin/Chirpy/internal/auth"
+)
+
+var verificationLink = regexp.MustCompile(`http://chirpy\.test/api/users/verify\?token=\S+`)
+
+// verificationToken pulls the token out of the most recent email to address.
+func verificationToken(t *testing.T, address string) string {
+	t.Helper()
+	messages := sentMail()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != address {
+			continue
+		}
+		link := verificationLink.FindString(messages[i].Body)
+		if link == "" {
+			break
+		}
+		u, _ := url.Parse(link)
+		return u.Query().Get("token")
+	}
+	t.Fatalf("No verification email sent to %s", address)
+	return ""
+}
+
+func verifyEmail(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/users/verify?token="+url.QueryEscape(token), nil)
+	rec := httptest.NewRecorder()
+	handlerVerifyEmail(rec, req)
+	return rec
+}
+
+func signup(email, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+	rec := httptest.NewRecorder()
+	handlerAddUser(rec, req)
+	return rec
+}
+
+func resendVerification(email string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/users/verify/resend", strings.NewReader(`{"email":"`+email+`"}`))
+	rec := httptest.NewRecorder()
+	handlerResendVerification(rec, req)
+	return rec
+}
+
+func TestEmailVerification(t *testing.T) {
+	db := setupTestAPI(t)
+	signup("new@example.com", "correct horse battery staple")
+	token := verificationToken(t, "new@example.com")
+
+	var session User
+	json.NewDecoder(login("new@example.com", "correct horse battery staple").Body).Decode(&session)
+	if session.IsEmailVerified {
+		t.Fatal("Expected new account to be unverified")
+	}
+
+	if rec := verifyEmail(token); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := verifyEmail(token); rec.Code != 400 {
+		t.Errorf("Expected a used token to be rejected, got %d", rec.Code)
+	}
+	user, _ := db.GetUserByEmail(t.Context(), "new@example.com")
+	if !user.EmailVerifiedAt.Valid {
+		t.Error("Expected email to be marked verified")
+	}
+
+	// POST with a JSON body works too.
+	signup("other@example.com", "correct horse battery staple")
+	req := httptest.NewRequest("POST", "/api/users/verify", strings.NewReader(`{"token":"`+verificationToken(t, "other@example.com")+`"}`))
+	rec := httptest.NewRecorder()
+	handlerVerifyEmail(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("Expected POST verification to succeed, got %d", rec.Code)
+	}
+}
+
+func TestEmailVerificationRejectsOtherTokens(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	access := bearer(t, user.ID)[len("Bearer "):]
+	if rec := verifyEmail(access); rec.Code != 400 {
+		t.Errorf("Expected access token to be rejected for verification, got %d", rec.Code)
+	}
+	if rec := verifyEmail("nope"); rec.Code != 400 {
+		t.Errorf("Expected garbage token to be rejected, got %d", rec.Code)
+	}
+
+	verification, _ := auth.MakeJWT(auth.Claims{Type: auth.TokenTypeEmailVerification, UserID: user.ID, Email: user.Email}, apiCfg.jwtConfig, time.Hour)
+	if rec := updateLogin(verification, `{"email":"user@example.com","password":"correct horse battery staple"}`); rec.Code != 401 {
+		t.Errorf("Expected verification token to be rejected as an access token, got %d", rec.Code)
+	}
+
+	// Changing the address spends links sent to the old one.
+	updateLogin(access, `{"email":"renamed@example.com","current_password":"correct horse battery staple"}`)
+	if rec := verifyEmail(verification); rec.Code != 400 {
+		t.Errorf("Expected token for old address to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestSignupForExistingEmailSendsNotice(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "taken@example.com", "correct horse battery staple")
+
+	signup("taken@example.com", "correct horse battery staple")
+	messages := sentMail()
+	if len(messages) != 1 || messages[0].To != "taken@example.com" || verificationLink.MatchString(messages[0].Body) {
+		t.Errorf("Expected an account-exists notice without a link, got %+v", messages)
+	}
+
+	// Repeated signups cannot flood the owner's inbox, and the response
+	// does not reveal that the notice was dropped.
+	for i := 0; i < 10; i++ {
+		if rec := signup("taken@example.com", "correct horse battery staple"); rec.Code != 202 {
+			t.Fatalf("Expected status 202, got %d", rec.Code)
+		}
+	}
+	// The free attempts, then the first penalised one, get through.
+	if n := len(sentMail()); n != verificationResendPolicy.FreeAttempts+1 {
+		t.Errorf("Expected account-exists notices to be throttled, got %d", n)
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	unknown := resendVerification("nobody@example.com")
+	known := resendVerification("user@example.com")
+	if unknown.Code != 202 || known.Code != 202 || unknown.Body.String() != known.Body.String() {
+		t.Errorf("Expected identical 202 responses, got %d %q and %d %q", unknown.Code, unknown.Body.String(), known.Code, known.Body.String())
+	}
+	if messages := sentMail(); len(messages) != 1 || messages[0].To != "user@example.com" {
+		t.Fatalf("Expected one verification email, got %+v", messages)
+	}
+
+	verifyEmail(verificationToken(t, "user@example.com"))
+	resendVerification("user@example.com")
+	if n := len(sentMail()); n != 1 {
+		t.Errorf("Expected no email for a verified address, got %d messages", n)
+	}
+
+	rec := resendVerification("user@example.com")
+	if rec.Code != 429 || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected repeated resends to be throttled, got %d", rec.Code)
+	}
+}
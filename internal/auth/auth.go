@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"net/http"
@@ -10,41 +11,126 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func HashPassword(password string) (string, error) {
-	hashedpassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
-	if err != nil {
-		return "", err
+	if password == "" {
+		return "", errors.New("password must not be empty")
 	}
-	return string(hashedpassword), nil
+	return DefaultHasher.Hash(password)
 }
 
 func CheckPasswordHash(password string, hash string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	hasher, err := hasherFor(hash)
 	if err != nil {
 		return err
 	}
-	return nil
+	return hasher.Verify(password, hash)
+}
+
+// NeedsRehash reports whether a stored hash should be replaced with one
+// from DefaultHasher the next time the plaintext password is available.
+func NeedsRehash(hash string) bool {
+	return DefaultHasher.NeedsRehash(hash)
 }
 
-func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+// Token types, carried in the token_type claim so a token minted for one
+// purpose is never accepted for another.
+const (
+	TokenTypeAccess            = "access"
+	TokenTypeEmailVerification = "email_verification"
+	// TokenTypeMFAChallenge is issued after a correct password for an account
+	// with two-factor authentication, and exchanged for a session once the
+	// second factor is checked.
+	TokenTypeMFAChallenge = "mfa_challenge"
+)
+
+// JWTConfig is how tokens are signed and what a valid token must say.
+type JWTConfig struct {
+	Keys *KeySet
+	// Issuer is set as iss and required on every token.
+	Issuer string
+	// Audience, when set, is sent as aud and required on every token.
+	Audience string
+	// Leeway tolerates clock skew when checking exp, nbf and iat.
+	Leeway time.Duration
+}
+
+// Claims are what a token says about its bearer.
+type Claims struct {
+	// Type is the purpose the token was issued for, e.g. TokenTypeAccess.
+	Type   string
+	UserID uuid.UUID
+	// TokenVersion must match the user's current token version for the
+	// token to be accepted; bumping the stored version revokes every access
+	// token issued before.
+	TokenVersion int32
+	// SessionID is the refresh token family the token was issued from.
+	SessionID uuid.UUID
+	// Email is the address an email verification token confirms.
+	Email string
+	// ClientID is the OAuth client an access token was issued to, or
+	// uuid.Nil for Chirpy's own clients.
+	ClientID uuid.UUID
+	// Scopes limits what an OAuth access token may do. It is nil for
+	// tokens without a ClientID.
+	Scopes []string
+}
+
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	TokenType    string `json:"token_type"`
+	TokenVersion int32  `json:"ver"`
+	SessionID    string `json:"sid,omitempty"`
+	Email        string `json:"email,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// MakeJWT signs a token with the config's signing key.
+func MakeJWT(claims Claims, cfg JWTConfig, expiresIn time.Duration) (string, error) {
+	if claims.Type == "" {
+		return "", errors.New("token type is required")
+	}
 
 	now := time.Now().UTC()
 
 	expiredTime := now.Add(expiresIn)
 
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy",
+	registeredClaims := jwt.RegisteredClaims{
+		Issuer:    cfg.Issuer,
 		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
 		ExpiresAt: jwt.NewNumericDate(expiredTime),
-		Subject:   userID.String(),
+		Subject:   claims.UserID.String(),
+	}
+	if cfg.Audience != "" {
+		registeredClaims.Audience = jwt.ClaimStrings{cfg.Audience}
+	}
+
+	sessionID := ""
+	if claims.SessionID != uuid.Nil {
+		sessionID = claims.SessionID.String()
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	clientID := ""
+	if claims.ClientID != uuid.Nil {
+		clientID = claims.ClientID.String()
+	}
+
+	signingKey := cfg.Keys.SigningKey()
+	token := jwt.NewWithClaims(signingKey.method(), jwtClaims{
+		RegisteredClaims: registeredClaims,
+		TokenType:        claims.Type,
+		TokenVersion:     claims.TokenVersion,
+		SessionID:        sessionID,
+		Email:            claims.Email,
+		ClientID:         clientID,
+		Scope:            strings.Join(claims.Scopes, " "),
+	})
+	token.Header["kid"] = signingKey.ID
 
-	signedToken, err := token.SignedString([]byte(tokenSecret))
+	signedToken, err := token.SignedString(signingKey.signKey)
 	if err != nil {
 		return "", err
 	}
@@ -52,38 +138,68 @@ func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (str
 	return signedToken, nil
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claims := &jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
-		return []byte(tokenSecret), nil
-	})
+// ErrWrongTokenType is returned when a valid token was issued for another
+// purpose than the one it is presented for.
+var ErrWrongTokenType = errors.New("wrong token type")
+
+// ValidateJWT verifies a token against the key named by its kid header,
+// using only the algorithm that key was made for, and checks its issuer,
+// audience, validity window and type.
+func ValidateJWT(tokenString string, cfg JWTConfig, tokenType string) (Claims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(cfg.Keys.algorithms()),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	parsed := &jwtClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, parsed, cfg.Keys.keyFunc, opts...)
 	if err != nil {
-		return uuid.Nil, err
+		return Claims{}, err
+	}
+	if parsed.TokenType != tokenType {
+		return Claims{}, ErrWrongTokenType
 	}
 	id, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return Claims{}, err
 	}
 	parsedUUID, err := uuid.Parse(id)
 	if err != nil {
-		return uuid.Nil, err
+		return Claims{}, err
+	}
+	claims := Claims{
+		Type:         parsed.TokenType,
+		UserID:       parsedUUID,
+		TokenVersion: parsed.TokenVersion,
+		Email:        parsed.Email,
+	}
+	if parsed.SessionID != "" {
+		claims.SessionID, err = uuid.Parse(parsed.SessionID)
+		if err != nil {
+			return Claims{}, err
+		}
+	}
+	if parsed.ClientID != "" {
+		claims.ClientID, err = uuid.Parse(parsed.ClientID)
+		if err != nil {
+			return Claims{}, err
+		}
+		// Never nil, so a client token without scopes is not mistaken
+		// for a first-party one.
+		claims.Scopes = append([]string{}, strings.Fields(parsed.Scope)...)
 	}
-	return parsedUUID, nil
+	return claims, nil
 }
 
+// GetBearerToken returns the credential of a "Bearer" Authorization header.
 func GetBearerToken(headers http.Header) (string, error) {
-	authHeader := headers.Get("Authorization")
-	if authHeader == "" {
-		return "", errors.New("authorization header missing")
-	}
-
-	splitToken := strings.Split(authHeader, "Bearer ")
-
-	if len(splitToken) < 2 {
-		return "", errors.New("invalid authorization header format")
-	}
-	token := strings.TrimSpace(splitToken[1])
-	return token, nil
+	return getCredentials(headers, "Bearer")
 }
 
 func MakeRefreshToken() (string, error) {
@@ -93,17 +209,35 @@ func MakeRefreshToken() (string, error) {
 	return token, nil
 }
 
-func GetAPIKey(headers http.Header) (string, error) {
-	authHeader := headers.Get("Authorization")
-	if authHeader == "" {
-		return "", errors.New("authorization header missing")
-	}
+// PersonalAccessTokenPrefix starts every personal access token, so they can
+// be told apart from JWTs and found by secret scanners.
+const PersonalAccessTokenPrefix = "chirpy_pat_"
 
-	strippedHeader := strings.Split(authHeader, "ApiKey ")
-	if len(strippedHeader) < 2 {
-		return "", errors.New("invalid authorization header format")
+// MakePersonalAccessToken returns a new random personal access token. Like
+// refresh tokens, it is stored as HashRefreshToken of its value.
+func MakePersonalAccessToken() (string, error) {
+	token, err := MakeRefreshToken()
+	if err != nil {
+		return "", err
 	}
+	return PersonalAccessTokenPrefix + token, nil
+}
 
-	apiKey := strings.TrimSpace(strippedHeader[1])
-	return apiKey, nil
+// IsPersonalAccessToken reports whether a bearer token is a personal access
+// token rather than a JWT.
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// HashRefreshToken returns the hex SHA-256 digest stored in place of a
+// refresh token. Tokens are random, so a fast unsalted hash is enough to
+// keep a leaked database from yielding usable sessions.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetAPIKey returns the credential of an "ApiKey" Authorization header.
+func GetAPIKey(headers http.Header) (string, error) {
+	return getCredentials(headers, "ApiKey")
 }
@@ -1,11 +1,21 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -17,7 +27,10 @@ func TestHashPassword(t *testing.T) {
 	if err != nil {
 		t.Errorf("Test failed: Hashing password failed: %v", err)
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	if !strings.HasPrefix(hashedPassword, "$argon2id$v=19$") {
+		t.Errorf("Expected PHC formatted argon2id hash, got: %s", hashedPassword)
+	}
+	err = CheckPasswordHash(password, hashedPassword)
 	if err != nil {
 		t.Errorf("Expected password to match, but got error: %v", err)
 	}
@@ -45,35 +58,86 @@ func TestComparePasswordHash(t *testing.T) {
 	}
 }
 
+func hmacKeySet(t *testing.T, secret string) *KeySet {
+	t.Helper()
+	key, err := NewHMACKey([]byte(secret))
+	if err != nil {
+		t.Fatalf("Failed to create HMAC key: %v", err)
+	}
+	keys, err := NewKeySet(key)
+	if err != nil {
+		t.Fatalf("Failed to create key set: %v", err)
+	}
+	return keys
+}
+
 func TestJWTRoundTrip(t *testing.T) {
 	userID := uuid.New()
-	secret := "test-secret"
+	keys := hmacKeySet(t, "test-secret")
 	expiresIn := time.Hour
 
+	sessionID := uuid.New()
+
 	// Create the JWT
-	tokenString, err := MakeJWT(userID, secret, expiresIn)
+	tokenString, err := MakeJWT(Claims{Type: TokenTypeAccess, UserID: userID, TokenVersion: 3, SessionID: sessionID}, JWTConfig{Keys: keys}, expiresIn)
 	if err != nil {
 		t.Fatalf("Failed to create JWT: %v", err)
 	}
 
 	// Validate the JWT
-	parsedUserID, err := ValidateJWT(tokenString, secret)
+	claims, err := ValidateJWT(tokenString, JWTConfig{Keys: keys}, TokenTypeAccess)
 	if err != nil {
 		t.Fatalf("Failed to validate JWT: %v", err)
 	}
 
 	// Check that we got back the same user ID
-	if parsedUserID != userID {
-		t.Errorf("Expected user ID %v, got %v", userID, parsedUserID)
+	if claims.UserID != userID {
+		t.Errorf("Expected user ID %v, got %v", userID, claims.UserID)
+	}
+	if claims.TokenVersion != 3 {
+		t.Errorf("Expected token version 3, got %d", claims.TokenVersion)
+	}
+	if claims.SessionID != sessionID {
+		t.Errorf("Expected session ID %v, got %v", sessionID, claims.SessionID)
+	}
+}
+
+func TestDelegatedJWT(t *testing.T) {
+	keys := hmacKeySet(t, "test-secret")
+	clientID := uuid.New()
+
+	tokenString, err := MakeJWT(Claims{Type: TokenTypeAccess, UserID: uuid.New(), ClientID: clientID, Scopes: []string{"read:chirps", "write:chirps"}}, JWTConfig{Keys: keys}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create JWT: %v", err)
+	}
+	claims, err := ValidateJWT(tokenString, JWTConfig{Keys: keys}, TokenTypeAccess)
+	if err != nil {
+		t.Fatalf("Failed to validate JWT: %v", err)
+	}
+	if claims.ClientID != clientID || !reflect.DeepEqual(claims.Scopes, []string{"read:chirps", "write:chirps"}) {
+		t.Errorf("Unexpected delegated claims %+v", claims)
+	}
+
+	// A client token with no scopes may do nothing, not everything.
+	tokenString, _ = MakeJWT(Claims{Type: TokenTypeAccess, UserID: uuid.New(), ClientID: clientID}, JWTConfig{Keys: keys}, time.Hour)
+	claims, _ = ValidateJWT(tokenString, JWTConfig{Keys: keys}, TokenTypeAccess)
+	if claims.Scopes == nil || len(claims.Scopes) != 0 {
+		t.Errorf("Expected empty non-nil scopes, got %#v", claims.Scopes)
+	}
+
+	tokenString, _ = MakeJWT(Claims{Type: TokenTypeAccess, UserID: uuid.New()}, JWTConfig{Keys: keys}, time.Hour)
+	claims, _ = ValidateJWT(tokenString, JWTConfig{Keys: keys}, TokenTypeAccess)
+	if claims.ClientID != uuid.Nil || claims.Scopes != nil {
+		t.Errorf("Expected a first-party token, got %+v", claims)
 	}
 }
 
 func TestExpiredJWT(t *testing.T) {
 	userID := uuid.New()
-	secret := "test-secret"
+	keys := hmacKeySet(t, "test-secret")
 	expiresIn := time.Millisecond * 1 // Very short expiration
 
-	tokenString, err := MakeJWT(userID, secret, expiresIn)
+	tokenString, err := MakeJWT(Claims{Type: TokenTypeAccess, UserID: userID}, JWTConfig{Keys: keys}, expiresIn)
 	if err != nil {
 		t.Fatalf("Failed to create JWT: %v", err)
 	}
@@ -82,7 +146,7 @@ func TestExpiredJWT(t *testing.T) {
 	time.Sleep(time.Millisecond * 10)
 
 	// Try to validate expired token
-	_, err = ValidateJWT(tokenString, secret)
+	_, err = ValidateJWT(tokenString, JWTConfig{Keys: keys}, TokenTypeAccess)
 	if err == nil {
 		t.Error("Expected error for expired token, but got none")
 	}
@@ -90,17 +154,17 @@ func TestExpiredJWT(t *testing.T) {
 
 func TestWrongSecret(t *testing.T) {
 	userID := uuid.New()
-	correctSecret := "correct-secret"
-	wrongSecret := "wrong-secret"
+	correctSecret := hmacKeySet(t, "correct-secret")
+	wrongSecret := hmacKeySet(t, "wrong-secret")
 	expiresIn := time.Hour
 
-	tokenString, err := MakeJWT(userID, correctSecret, expiresIn)
+	tokenString, err := MakeJWT(Claims{Type: TokenTypeAccess, UserID: userID}, JWTConfig{Keys: correctSecret}, expiresIn)
 	if err != nil {
 		t.Fatalf("Failed to create JWT: %v", err)
 	}
 
 	// Try to validate with wrong secret
-	_, err = ValidateJWT(tokenString, wrongSecret)
+	_, err = ValidateJWT(tokenString, JWTConfig{Keys: wrongSecret}, TokenTypeAccess)
 	if err == nil {
 		t.Error("Expected error for wrong secret, but got none")
 	}
@@ -150,3 +214,626 @@ func TestGetBearerToken_InvalidHeaderFormat(t *testing.T) {
 	}
 
 }
+
+func TestHashPassword_Empty(t *testing.T) {
+	_, err := HashPassword("")
+	if err == nil {
+		t.Error("Expected error for empty password, got nil")
+	}
+}
+
+func TestPasswordStrength(t *testing.T) {
+	cases := []struct {
+		password string
+		inputs   []string
+		maxScore int
+		minScore int
+	}{
+		{password: "password", maxScore: 0},
+		{password: "P@ssw0rd", maxScore: 0},
+		{password: "12345678", maxScore: 0},
+		{password: "aaaaaaaaaa", maxScore: 0},
+		{password: "qwertyuiop", maxScore: 0},
+		{password: "abcdefgh", maxScore: 0},
+		{password: "monkey1987", maxScore: 1},
+		{password: "janedoe2024", inputs: []string{"jane.doe@example.com"}, maxScore: 1},
+		{password: "correct horse battery staple", minScore: 4, maxScore: 4},
+		{password: "vT7#qL9!mZ2x", minScore: 4, maxScore: 4},
+	}
+	for _, tc := range cases {
+		score := PasswordStrength(tc.password, tc.inputs...)
+		if score < tc.minScore || score > tc.maxScore {
+			t.Errorf("PasswordStrength(%q) = %d, expected between %d and %d", tc.password, score, tc.minScore, tc.maxScore)
+		}
+	}
+}
+
+func TestPasswordStrengthLongInput(t *testing.T) {
+	// The estimate is capped, so even a huge password is scored quickly.
+	start := time.Now()
+	PasswordStrength(strings.Repeat("vT7#qL9!mZ2x", 1000))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a long password to be scored quickly, took %v", elapsed)
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	cases := []struct {
+		name     string
+		password string
+		email    string
+		problems int
+	}{
+		{name: "strong", password: "correct horse battery staple", email: "jane@example.com", problems: 0},
+		{name: "too short", password: "vT7#q", email: "jane@example.com", problems: 1},
+		{name: "too long", password: strings.Repeat("vT7#qL9!", 40), email: "jane@example.com", problems: 1},
+		{name: "too long and weak", password: strings.Repeat("a", 100000), email: "jane@example.com", problems: 1},
+		{name: "contains email", password: "my-jane@example.com-pw", email: "jane@example.com", problems: 1},
+		{name: "weak and breached", password: "password123", email: "jane@example.com", problems: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := policy.Validate(tc.password, tc.email)
+			if tc.problems == 0 {
+				if err != nil {
+					t.Errorf("Expected password to be accepted, got: %v", err)
+				}
+				return
+			}
+			var policyErr *PasswordPolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Expected PasswordPolicyError, got: %v", err)
+			}
+			if len(policyErr.Problems) != tc.problems {
+				t.Errorf("Expected %d problems, got %v", tc.problems, policyErr.Problems)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyMaxBytes(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+	policy.MaxBytes = BcryptMaxPasswordBytes
+	hasher := BcryptHasher{Cost: bcrypt.MinCost}
+
+	// 64 characters, but 72 bytes.
+	fits := "correct horse battery staple, crème brûlée à la façade naïve été"
+	if err := policy.Validate(fits); err != nil {
+		t.Fatalf("Expected %d bytes to be accepted, got: %v", len(fits), err)
+	}
+	if _, err := hasher.Hash(fits); err != nil {
+		t.Errorf("Expected bcrypt to hash an accepted password, got: %v", err)
+	}
+
+	var policyErr *PasswordPolicyError
+	if err := policy.Validate(fits + "é"); !errors.As(err, &policyErr) {
+		t.Errorf("Expected a password over %d bytes to be rejected, got: %v", BcryptMaxPasswordBytes, err)
+	}
+}
+
+func TestBundledBreachedList(t *testing.T) {
+	list := BundledBreachedList()
+
+	breached, err := list.IsBreached("letmein")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !breached {
+		t.Error("Expected \"letmein\" to be reported as breached")
+	}
+
+	breached, err = list.IsBreached("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if breached {
+		t.Error("Expected passphrase not to be reported as breached")
+	}
+}
+
+func TestLocalBreachedList_HashCountFormat(t *testing.T) {
+	// SHA-1 of "hunter2" with a trailing breach count.
+	list, err := NewLocalBreachedList(strings.NewReader("F3BBBD66A63D4BF1747940578EC3D0103530E21D:17\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	suffixes, _ := list.Range("f3bbb")
+	if len(suffixes) != 1 {
+		t.Errorf("Expected one suffix in range, got %v", suffixes)
+	}
+	breached, _ := list.IsBreached("hunter2")
+	if !breached {
+		t.Error("Expected \"hunter2\" to be reported as breached")
+	}
+}
+
+func TestHashPassword_LongPassword(t *testing.T) {
+	// bcrypt silently ignored everything past 72 bytes.
+	password := strings.Repeat("a", 72) + "tail"
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		t.Fatalf("Hashing password failed: %v", err)
+	}
+	err = CheckPasswordHash(strings.Repeat("a", 72)+"other", hashedPassword)
+	if !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Expected ErrPasswordMismatch, got: %v", err)
+	}
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := Argon2idHasher{Params: Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}}
+	hash, err := hasher.Hash("testpassword")
+	if err != nil {
+		t.Fatalf("Hashing password failed: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Unexpected hash format: %s", hash)
+	}
+	if err := hasher.Verify("testpassword", hash); err != nil {
+		t.Errorf("Expected password to match, got: %v", err)
+	}
+	if err := hasher.Verify("wrongpassword", hash); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Expected ErrPasswordMismatch, got: %v", err)
+	}
+	if hasher.NeedsRehash(hash) {
+		t.Error("Expected hash with current parameters not to need rehash")
+	}
+
+	stronger := Argon2idHasher{Params: hasher.Params}
+	stronger.Params.Iterations = 2
+	if !stronger.NeedsRehash(hash) {
+		t.Error("Expected hash with outdated parameters to need rehash")
+	}
+	// Verification uses the parameters recorded in the hash.
+	if err := stronger.Verify("testpassword", hash); err != nil {
+		t.Errorf("Expected old hash to still verify, got: %v", err)
+	}
+
+	if err := hasher.Verify("testpassword", "$argon2id$v=19$garbage"); err == nil {
+		t.Error("Expected error for malformed hash, got nil")
+	}
+}
+
+func TestLegacyBcryptHash(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("testpassword"), 10)
+	if err != nil {
+		t.Fatalf("Hashing password failed: %v", err)
+	}
+	if err := CheckPasswordHash("testpassword", string(hashedPassword)); err != nil {
+		t.Errorf("Expected legacy bcrypt hash to verify, got: %v", err)
+	}
+	if !NeedsRehash(string(hashedPassword)) {
+		t.Error("Expected legacy bcrypt hash to need rehash")
+	}
+
+	current, _ := HashPassword("testpassword")
+	if NeedsRehash(current) {
+		t.Error("Expected freshly made hash not to need rehash")
+	}
+
+	if err := CheckPasswordHash("testpassword", "unset"); err == nil {
+		t.Error("Expected error for unrecognized hash, got nil")
+	}
+}
+
+func TestSimulatePasswordCheck(t *testing.T) {
+	// Must not panic before or after the dummy hash is created.
+	SimulatePasswordCheck("testpassword")
+	SimulatePasswordCheck("")
+	if dummyHash.hash == "" {
+		t.Error("Expected dummy hash to be created")
+	}
+}
+
+func TestMakePersonalAccessToken(t *testing.T) {
+	token, err := MakePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("MakePersonalAccessToken: %v", err)
+	}
+	if !IsPersonalAccessToken(token) || len(token) != len(PersonalAccessTokenPrefix)+64 {
+		t.Errorf("Unexpected token %q", token)
+	}
+	if _, _, err := ParseAuthorization("Bearer " + token); err != nil {
+		t.Errorf("Expected token to be a valid bearer credential, got %v", err)
+	}
+	jwt, _ := MakeJWT(Claims{Type: TokenTypeAccess}, JWTConfig{Keys: hmacKeySet(t, "test-secret")}, time.Hour)
+	if IsPersonalAccessToken(jwt) {
+		t.Error("Expected a JWT not to look like a personal access token")
+	}
+}
+
+func TestHashRefreshToken(t *testing.T) {
+	token, _ := MakeRefreshToken()
+	hash := HashRefreshToken(token)
+	if len(hash) != 64 {
+		t.Errorf("Expected 64 hex characters, got %d", len(hash))
+	}
+	if hash == token {
+		t.Error("Expected digest to differ from token")
+	}
+	if HashRefreshToken(token) != hash {
+		t.Error("Expected digest to be deterministic")
+	}
+	// Matches encode(sha256(convert_to('abc', 'UTF8')), 'hex') used by the migration.
+	if HashRefreshToken("abc") != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Error("Unexpected digest for known input")
+	}
+}
+
+func newEd25519Key(t *testing.T) *Key {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	key, err := NewEd25519Key(priv)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	return key
+}
+
+func newES256Key(t *testing.T) *Key {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	key, err := NewECDSAKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	return key
+}
+
+func TestAsymmetricJWT(t *testing.T) {
+	for name, key := range map[string]*Key{"EdDSA": newEd25519Key(t), "ES256": newES256Key(t)} {
+		t.Run(name, func(t *testing.T) {
+			keys, err := NewKeySet(key)
+			if err != nil {
+				t.Fatalf("Failed to create key set: %v", err)
+			}
+			userID := uuid.New()
+			token, err := MakeJWT(Claims{Type: TokenTypeAccess, UserID: userID}, JWTConfig{Keys: keys}, time.Hour)
+			if err != nil {
+				t.Fatalf("Failed to create JWT: %v", err)
+			}
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatalf("Failed to parse JWT: %v", err)
+			}
+			if parsed.Header["alg"] != name || parsed.Header["kid"] != key.ID {
+				t.Errorf("Expected alg %s and kid %s, got %v", name, key.ID, parsed.Header)
+			}
+			claims, err := ValidateJWT(token, JWTConfig{Keys: keys}, TokenTypeAccess)
+			if err != nil {
+				t.Fatalf("Failed to validate JWT: %v", err)
+			}
+			if claims.UserID != userID {
+				t.Errorf("Expected user ID %v, got %v", userID, claims.UserID)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := newEd25519Key(t)
+	oldKeys, _ := NewKeySet(oldKey)
+	oldToken, _ := MakeJWT(Claims{Type: TokenTypeAccess, UserID: uuid.New()}, JWTConfig{Keys: oldKeys}, time.Hour)
+
+	retired, err := NewPublicKey(oldKey.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to create verify-only key: %v", err)
+	}
+	if retired.CanSign() {
+		t.Fatal("Expected public key not to be able to sign")
+	}
+	if _, err := NewKeySet(retired); err == nil {
+		t.Error("Expected a verify-only signing key to be rejected")
+	}
+
+	rotated, err := NewKeySet(newES256Key(t), retired)
+	if err != nil {
+		t.Fatalf("Failed to create key set: %v", err)
+	}
+	if _, err := ValidateJWT(oldToken, JWTConfig{Keys: rotated}, TokenTypeAccess); err != nil {
+		t.Errorf("Expected token signed by retired key to verify: %v", err)
+	}
+	newToken, _ := MakeJWT(Claims{Type: TokenTypeAccess, UserID: uuid.New()}, JWTConfig{Keys: rotated}, time.Hour)
+	if _, err := ValidateJWT(newToken, JWTConfig{Keys: rotated}, TokenTypeAccess); err != nil {
+		t.Errorf("Expected token signed by new key to verify: %v", err)
+	}
+
+	// Dropping the retired key stops its tokens from verifying.
+	current, _ := NewKeySet(rotated.SigningKey())
+	if _, err := ValidateJWT(oldToken, JWTConfig{Keys: current}, TokenTypeAccess); err == nil {
+		t.Error("Expected token signed by dropped key to be rejected")
+	}
+
+	jwks := rotated.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != rotated.SigningKey().ID || jwks.Keys[1].Kid != oldKey.ID {
+		t.Errorf("Expected JWKS with signing key then retired key, got %+v", jwks)
+	}
+}
+
+func TestJWTAlgorithmPinning(t *testing.T) {
+	edKey := newEd25519Key(t)
+	hmacKey, _ := NewHMACKey([]byte("shared-secret"))
+	keys, _ := NewKeySet(edKey, hmacKey)
+	claims := jwt.MapClaims{"sub": uuid.New().String(), "exp": time.Now().Add(time.Hour).Unix(), "token_type": TokenTypeAccess}
+
+	// HS256 signed with the published Ed25519 public key but claiming the
+	// Ed25519 key's kid: the classic algorithm confusion attack.
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	confused.Header["kid"] = edKey.ID
+	confusedToken, _ := confused.SignedString([]byte(edKey.PublicKey().(ed25519.PublicKey)))
+	if _, err := ValidateJWT(confusedToken, JWTConfig{Keys: keys}, TokenTypeAccess); err == nil {
+		t.Error("Expected HS256 token with an EdDSA kid to be rejected")
+	}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	none.Header["kid"] = edKey.ID
+	noneToken, _ := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := ValidateJWT(noneToken, JWTConfig{Keys: keys}, TokenTypeAccess); err == nil {
+		t.Error("Expected unsigned token to be rejected")
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	unknown.Header["kid"] = "no-such-key"
+	unknownToken, _ := unknown.SignedString([]byte("shared-secret"))
+	if _, err := ValidateJWT(unknownToken, JWTConfig{Keys: keys}, TokenTypeAccess); err == nil {
+		t.Error("Expected token with unknown kid to be rejected")
+	}
+
+	// Tokens from before key IDs existed were HS256 with the shared secret.
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	legacyToken, _ := legacy.SignedString([]byte("shared-secret"))
+	if _, err := ValidateJWT(legacyToken, JWTConfig{Keys: keys}, TokenTypeAccess); err != nil {
+		t.Errorf("Expected kid-less HS256 token to verify with the shared secret: %v", err)
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// Example from RFC 8037, appendix A.3.
+	x, _ := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	key, err := NewPublicKey(ed25519.PublicKey(x))
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if key.ID != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Errorf("Unexpected thumbprint %s", key.ID)
+	}
+}
+
+func TestParseKeyPEM(t *testing.T) {
+	_, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ecPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecPriv)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(edPriv)
+	pkix, _ := x509.MarshalPKIXPublicKey(edPriv.Public())
+
+	cases := []struct {
+		name    string
+		block   *pem.Block
+		alg     string
+		canSign bool
+	}{
+		{name: "pkcs8 ed25519", block: &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, alg: AlgEdDSA, canSign: true},
+		{name: "sec1 p-256", block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}, alg: AlgES256, canSign: true},
+		{name: "public ed25519", block: &pem.Block{Type: "PUBLIC KEY", Bytes: pkix}, alg: AlgEdDSA, canSign: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := ParseKeyPEM(pem.EncodeToMemory(tc.block))
+			if err != nil {
+				t.Fatalf("Failed to parse key: %v", err)
+			}
+			if key.Algorithm != tc.alg || key.CanSign() != tc.canSign {
+				t.Errorf("Expected %s (can sign %v), got %s (can sign %v)", tc.alg, tc.canSign, key.Algorithm, key.CanSign())
+			}
+		})
+	}
+
+	if _, err := ParseKeyPEM([]byte("not a key")); err == nil {
+		t.Error("Expected error for non-PEM input")
+	}
+}
+
+// errAnyError marks a case that must fail without a specific sentinel.
+var errAnyError = errors.New("any error")
+
+func TestValidateJWTRejections(t *testing.T) {
+	cfg := JWTConfig{
+		Keys:     hmacKeySet(t, "test-secret"),
+		Issuer:   "chirpy",
+		Audience: "chirpy-api",
+		Leeway:   30 * time.Second,
+	}
+	now := time.Now()
+	sign := func(claims jwt.MapClaims) string {
+		key := cfg.Keys.SigningKey()
+		token := jwt.NewWithClaims(key.method(), claims)
+		token.Header["kid"] = key.ID
+		signed, err := token.SignedString(key.signKey)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return signed
+	}
+	// valid returns a claim set ValidateJWT accepts, with overrides applied;
+	// a nil override removes the claim.
+	valid := func(overrides jwt.MapClaims) string {
+		claims := jwt.MapClaims{
+			"iss":        "chirpy",
+			"aud":        "chirpy-api",
+			"sub":        uuid.New().String(),
+			"iat":        now.Unix(),
+			"nbf":        now.Unix(),
+			"exp":        now.Add(time.Hour).Unix(),
+			"token_type": TokenTypeAccess,
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return sign(claims)
+	}
+	otherKeys := hmacKeySet(t, "other-secret")
+	otherToken, _ := MakeJWT(Claims{Type: TokenTypeAccess, UserID: uuid.New()}, JWTConfig{Keys: otherKeys, Issuer: "chirpy", Audience: "chirpy-api"}, time.Hour)
+	forgedJWT := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "chirpy", "aud": "chirpy-api", "sub": uuid.New().String(),
+		"exp": now.Add(time.Hour).Unix(), "token_type": TokenTypeAccess,
+	})
+	forgedJWT.Header["kid"] = cfg.Keys.SigningKey().ID
+	forged, _ := forgedJWT.SignedString([]byte("guessed-secret"))
+	noneToken, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"iss": "chirpy", "aud": "chirpy-api", "sub": uuid.New().String(),
+		"exp": now.Add(time.Hour).Unix(), "token_type": TokenTypeAccess,
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	cases := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "valid", token: valid(nil)},
+		{name: "expired within leeway", token: valid(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()})},
+		{name: "not before within leeway", token: valid(jwt.MapClaims{"nbf": now.Add(10 * time.Second).Unix()})},
+		{name: "audience in list", token: valid(jwt.MapClaims{"aud": []string{"other", "chirpy-api"}})},
+		{name: "wrong issuer", token: valid(jwt.MapClaims{"iss": "evil"}), wantErr: jwt.ErrTokenInvalidIssuer},
+		{name: "missing issuer", token: valid(jwt.MapClaims{"iss": nil}), wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "wrong audience", token: valid(jwt.MapClaims{"aud": "other-service"}), wantErr: jwt.ErrTokenInvalidAudience},
+		{name: "missing audience", token: valid(jwt.MapClaims{"aud": nil}), wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "expired beyond leeway", token: valid(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}), wantErr: jwt.ErrTokenExpired},
+		{name: "missing expiry", token: valid(jwt.MapClaims{"exp": nil}), wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "not yet valid", token: valid(jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()}), wantErr: jwt.ErrTokenNotValidYet},
+		{name: "issued in the future", token: valid(jwt.MapClaims{"iat": now.Add(time.Minute).Unix()}), wantErr: jwt.ErrTokenUsedBeforeIssued},
+		{name: "wrong token type", token: valid(jwt.MapClaims{"token_type": "refresh"}), wantErr: ErrWrongTokenType},
+		{name: "missing token type", token: valid(jwt.MapClaims{"token_type": nil}), wantErr: ErrWrongTokenType},
+		{name: "invalid subject", token: valid(jwt.MapClaims{"sub": "not-a-uuid"}), wantErr: errAnyError},
+		{name: "unknown key", token: otherToken, wantErr: jwt.ErrTokenUnverifiable},
+		{name: "forged signature", token: forged, wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "unsigned", token: noneToken, wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "malformed", token: "not.a.jwt", wantErr: jwt.ErrTokenMalformed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ValidateJWT(tc.token, cfg, TokenTypeAccess)
+			switch {
+			case tc.wantErr == nil && err != nil:
+				t.Errorf("Expected token to be accepted, got %v", err)
+			case tc.wantErr == errAnyError && err == nil:
+				t.Error("Expected token to be rejected")
+			case tc.wantErr != nil && tc.wantErr != errAnyError && !errors.Is(err, tc.wantErr):
+				t.Errorf("Expected %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestGetCredentials(t *testing.T) {
+	cases := []struct {
+		name    string
+		values  []string
+		scheme  string
+		want    string
+		wantErr error
+	}{
+		{name: "bearer", values: []string{"Bearer abc.def-ghi_jkl"}, scheme: "Bearer", want: "abc.def-ghi_jkl"},
+		{name: "lowercase scheme", values: []string{"bearer xyz"}, scheme: "Bearer", want: "xyz"},
+		{name: "uppercase scheme", values: []string{"BEARER xyz"}, scheme: "Bearer", want: "xyz"},
+		{name: "padded credential", values: []string{"Bearer YWJj=="}, scheme: "Bearer", want: "YWJj=="},
+		{name: "extra spaces", values: []string{"  Bearer   xyz  "}, scheme: "Bearer", want: "xyz"},
+		{name: "api key", values: []string{"apikey f271c81ff7084ee5b99a5091b42d486e"}, scheme: "ApiKey", want: "f271c81ff7084ee5b99a5091b42d486e"},
+		{name: "missing", scheme: "Bearer", wantErr: ErrMissingAuthorization},
+		{name: "empty", values: []string{""}, scheme: "Bearer", wantErr: ErrMissingAuthorization},
+		{name: "no credential", values: []string{"Bearer"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "blank credential", values: []string{"Bearer    "}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "wrong scheme", values: []string{"Basic dXNlcjpwYXNz"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "scheme prefix only", values: []string{"Bearerx xyz"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "two credentials", values: []string{"Bearer a Bearer b"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "trailing segment", values: []string{"Bearer a b"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "auth params", values: []string{`Bearer realm="x"`}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "padding inside", values: []string{"Bearer a=b"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "tab separator", values: []string{"Bearer\txyz"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+		{name: "two headers", values: []string{"Bearer a", "Bearer b"}, scheme: "Bearer", wantErr: ErrInvalidAuthorization},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := http.Header{}
+			for _, v := range tc.values {
+				headers.Add("Authorization", v)
+			}
+			got, err := getCredentials(headers, tc.scheme)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("Expected credential %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	got := Challenge("Bearer", "realm", "chirpy", "error", "invalid_token", "error_description", `token "expired"`, "scope", "")
+	want := `Bearer realm="chirpy", error="invalid_token", error_description="token \"expired\""`
+	if got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if got := Challenge("ApiKey"); got != "ApiKey" {
+		t.Errorf("Expected bare scheme, got %s", got)
+	}
+}
+
+func FuzzParseAuthorization(f *testing.F) {
+	for _, seed := range []string{
+		"Bearer abc", "bearer abc", "Bearer a Bearer b", "ApiKey k==", "Bearer", " ", "Basic =", "Bearer a=b", "Digest x=\"y\"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		scheme, credential, err := ParseAuthorization(value)
+		if err != nil {
+			if scheme != "" || credential != "" {
+				t.Fatalf("Expected empty results with error, got %q %q", scheme, credential)
+			}
+			return
+		}
+		if !isToken(scheme) || !isToken68(credential) {
+			t.Fatalf("Accepted invalid scheme %q or credential %q", scheme, credential)
+		}
+		if strings.ContainsAny(scheme+credential, " \t\r\n\"") {
+			t.Fatalf("Accepted whitespace or quotes in %q", value)
+		}
+		again, credentialAgain, err := ParseAuthorization(scheme + " " + credential)
+		if err != nil || again != scheme || credentialAgain != credential {
+			t.Fatalf("Round trip of %q failed: %q %q %v", value, again, credentialAgain, err)
+		}
+	})
+}
+
+func FuzzGetBearerToken(f *testing.F) {
+	for _, seed := range []string{"Bearer abc", "BEARER abc", "Bearer a b", "ApiKey abc", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		headers := http.Header{"Authorization": {value}}
+		token, err := GetBearerToken(headers)
+		if err != nil {
+			if !errors.Is(err, ErrMissingAuthorization) && !errors.Is(err, ErrInvalidAuthorization) {
+				t.Fatalf("Unexpected error type %v", err)
+			}
+			return
+		}
+		scheme, credential, _ := ParseAuthorization(value)
+		if !strings.EqualFold(scheme, "Bearer") || credential != token {
+			t.Fatalf("Accepted %q as a bearer token from %q", token, value)
+		}
+	})
+}
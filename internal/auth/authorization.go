@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrMissingAuthorization is returned when a request has no
+	// Authorization header.
+	ErrMissingAuthorization = errors.New("authorization header missing")
+	// ErrInvalidAuthorization is returned when the Authorization header is
+	// malformed or uses another scheme than the one expected.
+	ErrInvalidAuthorization = errors.New("invalid authorization header format")
+)
+
+// ParseAuthorization splits an Authorization header value into its scheme
+// and credential following RFC 7235: a token, one or more spaces, then a
+// single token68 credential. Anything else, including a second credential
+// or auth-params, is rejected.
+func ParseAuthorization(value string) (scheme, credential string, err error) {
+	value = strings.Trim(value, " \t")
+	scheme, rest, ok := strings.Cut(value, " ")
+	if !ok || !isToken(scheme) {
+		return "", "", ErrInvalidAuthorization
+	}
+	credential = strings.TrimLeft(rest, " ")
+	if !isToken68(credential) {
+		return "", "", ErrInvalidAuthorization
+	}
+	return scheme, credential, nil
+}
+
+// getCredentials returns the credential of the request's only Authorization
+// header if it uses scheme. Schemes are compared case-insensitively.
+func getCredentials(headers http.Header, scheme string) (string, error) {
+	values := headers.Values("Authorization")
+	if len(values) == 0 || values[0] == "" {
+		return "", ErrMissingAuthorization
+	}
+	if len(values) > 1 {
+		return "", ErrInvalidAuthorization
+	}
+	got, credential, err := ParseAuthorization(values[0])
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(got, scheme) {
+		return "", ErrInvalidAuthorization
+	}
+	return credential, nil
+}
+
+// Challenge formats a WWW-Authenticate challenge such as
+// Bearer realm="chirpy", error="invalid_token". params are name, value
+// pairs; empty values are skipped.
+func Challenge(scheme string, params ...string) string {
+	var b strings.Builder
+	b.WriteString(scheme)
+	sep := " "
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i+1] == "" {
+			continue
+		}
+		b.WriteString(sep)
+		b.WriteString(params[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(params[i+1]))
+		b.WriteString(`"`)
+		sep = ", "
+	}
+	return b.String()
+}
+
+// isToken reports whether s is an RFC 7230 token.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAlphaNum(c) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0 {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// isToken68 reports whether s is an RFC 7235 token68: the base64 and
+// base64url alphabets plus "-._~", optionally padded with trailing "=".
+func isToken68(s string) bool {
+	body := strings.TrimRight(s, "=")
+	if body == "" {
+		return false
+	}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if isAlphaNum(c) || strings.IndexByte("-._~+/", c) >= 0 {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func isAlphaNum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// BreachedPasswordChecker reports whether a password is known to have
+// appeared in a data breach.
+type BreachedPasswordChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// PasswordRangeSource returns the SHA-1 suffixes of breached passwords whose
+// hash starts with the given five hex character prefix. It mirrors the
+// Have I Been Pwned range API, so a remote source only ever learns the prefix
+// and never the password or its full hash.
+type PasswordRangeSource interface {
+	Range(prefix string) ([]string, error)
+}
+
+// KAnonymityChecker checks passwords against a PasswordRangeSource.
+type KAnonymityChecker struct {
+	Source PasswordRangeSource
+}
+
+func (c KAnonymityChecker) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	suffixes, err := c.Source.Range(prefix)
+	if err != nil {
+		return false, fmt.Errorf("unable to check breached passwords: %w", err)
+	}
+	for _, s := range suffixes {
+		if s == suffix {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LocalBreachedList is an offline PasswordRangeSource built from a list of
+// SHA-1 digests, one per line.
+type LocalBreachedList struct {
+	ranges map[string][]string
+}
+
+// NewLocalBreachedList reads uppercase or lowercase SHA-1 digests from r.
+// Blank lines and lines starting with # are ignored, as is anything after a
+// colon so files in the "HASH:COUNT" format can be used directly.
+func NewLocalBreachedList(r io.Reader) (*LocalBreachedList, error) {
+	list := &LocalBreachedList{ranges: map[string][]string{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, _, _ := strings.Cut(line, ":")
+		digest = strings.ToUpper(digest)
+		if len(digest) != 40 {
+			return nil, fmt.Errorf("invalid SHA-1 digest %q", digest)
+		}
+		list.ranges[digest[:5]] = append(list.ranges[digest[:5]], digest[5:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (l *LocalBreachedList) Range(prefix string) ([]string, error) {
+	return l.ranges[strings.ToUpper(prefix)], nil
+}
+
+func (l *LocalBreachedList) IsBreached(password string) (bool, error) {
+	return KAnonymityChecker{Source: l}.IsBreached(password)
+}
+
+//go:embed data/breached_sha1.txt
+var bundledBreachedFile []byte
+
+var bundledBreachedList = sync.OnceValue(func() *LocalBreachedList {
+	list, err := NewLocalBreachedList(bytes.NewReader(bundledBreachedFile))
+	if err != nil {
+		panic(fmt.Sprintf("auth: invalid bundled breached password list: %v", err))
+	}
+	return list
+})
+
+// BundledBreachedList returns the breached password list shipped with Chirpy.
+func BundledBreachedList() *LocalBreachedList {
+	return bundledBreachedList()
+}
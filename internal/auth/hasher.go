@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords and checks them against stored hashes.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, hash string) error
+	// NeedsRehash reports whether a hash that verified successfully should be
+	// replaced because it uses another algorithm or outdated parameters.
+	NeedsRehash(hash string) bool
+}
+
+// ErrPasswordMismatch is returned when a password does not match its hash.
+var ErrPasswordMismatch = errors.New("password does not match")
+
+// DefaultHasher is used by HashPassword and NeedsRehash.
+var DefaultHasher PasswordHasher = Argon2idHasher{Params: DefaultArgon2idParams}
+
+var dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// SimulatePasswordCheck spends the same effort as CheckPasswordHash against
+// a DefaultHasher hash. Call it when there is no stored hash to compare, such
+// as a login for an unknown email, so response time does not reveal whether
+// an account exists.
+func SimulatePasswordCheck(password string) {
+	dummyHash.once.Do(func() {
+		hash, err := DefaultHasher.Hash("chirpy-dummy-password")
+		if err != nil {
+			// Without a hash the check would return at once and give
+			// unknown emails away by timing.
+			panic(fmt.Sprintf("auth: unable to create dummy password hash: %v", err))
+		}
+		dummyHash.hash = hash
+	})
+	CheckPasswordHash(password, dummyHash.hash)
+}
+
+// hasherFor picks the hasher able to verify a stored hash from its prefix,
+// so legacy bcrypt hashes keep working after the default changes.
+func hasherFor(hash string) (PasswordHasher, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2idHasher{}, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return BcryptHasher{}, nil
+	default:
+		return nil, errors.New("unrecognized password hash format")
+	}
+}
+
+// Argon2idParams are the tuning parameters for argon2id. Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams follow the OWASP password storage recommendation.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2idHasher produces PHC formatted argon2id hashes, e.g.
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>.
+type Argon2idHasher struct {
+	Params Argon2idParams
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Params.Iterations, h.Params.Memory, h.Params.Parallelism, h.Params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Params.Memory,
+		h.Params.Iterations,
+		h.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks password using the parameters recorded in the hash, not the
+// hasher's own, so hashes made with older parameters still verify.
+func (h Argon2idHasher) Verify(password, hash string) error {
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+	return params != h.Params
+}
+
+func decodeArgon2idHash(hash string) (Argon2idParams, []byte, []byte, error) {
+	var params Argon2idParams
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errors.New("invalid argon2id hash version")
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errors.New("invalid argon2id hash parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errors.New("invalid argon2id hash salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errors.New("invalid argon2id hash key")
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// BcryptMaxPasswordBytes is the longest password bcrypt accepts.
+const BcryptMaxPasswordBytes = 72
+
+// BcryptHasher is kept so existing bcrypt hashes can be verified. Note that
+// bcrypt refuses passwords longer than BcryptMaxPasswordBytes, so a policy
+// used with it needs MaxBytes set.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+func (h BcryptHasher) Verify(password, hash string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost != h.Cost
+}
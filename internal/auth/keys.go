@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Algorithms access tokens can be signed with.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgES256 = "ES256"
+	AlgHS256 = "HS256"
+)
+
+// Key is a key access tokens are signed or verified with. Keys built from a
+// public key alone can only verify, which is how retired keys are kept
+// around until the tokens they signed have expired.
+type Key struct {
+	// ID is sent as the kid header. For asymmetric keys it is the RFC 7638
+	// thumbprint of the public key.
+	ID        string
+	Algorithm string
+
+	signKey   any
+	verifyKey any
+	public    crypto.PublicKey
+}
+
+// NewEd25519Key returns an EdDSA signing key.
+func NewEd25519Key(priv ed25519.PrivateKey) (*Key, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+	key, err := NewPublicKey(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.signKey = priv
+	return key, nil
+}
+
+// NewECDSAKey returns an ES256 signing key. Only P-256 is supported.
+func NewECDSAKey(priv *ecdsa.PrivateKey) (*Key, error) {
+	key, err := NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key.signKey = priv
+	return key, nil
+}
+
+// NewPublicKey returns a verify-only key for an ed25519.PublicKey or a P-256
+// *ecdsa.PublicKey.
+func NewPublicKey(pub crypto.PublicKey) (*Key, error) {
+	key := &Key{public: pub, verifyKey: pub}
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 public key")
+		}
+		key.Algorithm = AlgEdDSA
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		key.Algorithm = AlgES256
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	key.ID = thumbprint(key.JWK())
+	return key, nil
+}
+
+// NewHMACKey returns an HS256 key for a shared secret. Its ID is derived
+// from the secret with HMAC so the kid header reveals nothing about it.
+func NewHMACKey(secret []byte) (*Key, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("HMAC secret must not be empty")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("chirpy key id"))
+	return &Key{
+		ID:        "hs256-" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:12]),
+		Algorithm: AlgHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}, nil
+}
+
+// ParseKeyPEM reads a PEM encoded Ed25519 or P-256 key. Private keys may be
+// PKCS #8 ("PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY"); a "PUBLIC KEY" block
+// gives a verify-only key.
+func ParseKeyPEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch priv := priv.(type) {
+		case ed25519.PrivateKey:
+			return NewEd25519Key(priv)
+		case *ecdsa.PrivateKey:
+			return NewECDSAKey(priv)
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T", priv)
+		}
+	case "EC PRIVATE KEY":
+		priv, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewECDSAKey(priv)
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewPublicKey(pub)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// CanSign reports whether the key holds private key material.
+func (k *Key) CanSign() bool {
+	return k.signKey != nil
+}
+
+// PublicKey returns the public key, or nil for HMAC keys.
+func (k *Key) PublicKey() crypto.PublicKey {
+	return k.public
+}
+
+func (k *Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set document.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of the key. HMAC keys have no public half and
+// return the zero JWK.
+func (k *Key) JWK() JWK {
+	switch pub := k.public.(type) {
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+			Kid: k.ID,
+			Alg: k.Algorithm,
+			Use: "sig",
+		}
+	case *ecdsa.PublicKey:
+		// Uncompressed point: 0x04 || X || Y, each coordinate 32 bytes.
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return JWK{}
+		}
+		point := ecdhKey.Bytes()
+		return JWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+			Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+			Kid: k.ID,
+			Alg: k.Algorithm,
+			Use: "sig",
+		}
+	default:
+		return JWK{}
+	}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint: the SHA-256 of the
+// required members in lexicographic order with no whitespace.
+func thumbprint(jwk JWK) string {
+	var canonical string
+	switch jwk.Kty {
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Crv, jwk.Kty, jwk.X)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// KeySet signs access tokens with one key and accepts tokens signed by it
+// or by any retired key still in the set.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	// legacy verifies tokens without a kid header, which were all signed
+	// with the shared HS256 secret.
+	legacy *Key
+}
+
+// NewKeySet returns a KeySet that signs with signing. Retired keys are only
+// used to verify.
+func NewKeySet(signing *Key, retired ...*Key) (*KeySet, error) {
+	if signing == nil || !signing.CanSign() {
+		return nil, errors.New("signing key must include the private key")
+	}
+	set := &KeySet{signing: signing, keys: map[string]*Key{}}
+	for _, key := range append([]*Key{signing}, retired...) {
+		if _, ok := set.keys[key.ID]; ok {
+			continue
+		}
+		set.keys[key.ID] = key
+		if key.Algorithm == AlgHS256 && set.legacy == nil {
+			set.legacy = key
+		}
+	}
+	return set, nil
+}
+
+// SigningKey returns the key new tokens are signed with.
+func (s *KeySet) SigningKey() *Key {
+	return s.signing
+}
+
+// JWKS returns the public keys other services need to verify tokens. HMAC
+// keys are never published.
+func (s *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range append([]*Key{s.signing}, s.sortedRetired()...) {
+		if key.public != nil {
+			jwks.Keys = append(jwks.Keys, key.JWK())
+		}
+	}
+	return jwks
+}
+
+func (s *KeySet) sortedRetired() []*Key {
+	retired := []*Key{}
+	for id, key := range s.keys {
+		if id != s.signing.ID {
+			retired = append(retired, key)
+		}
+	}
+	sort.Slice(retired, func(i, j int) bool { return retired[i].ID < retired[j].ID })
+	return retired
+}
+
+// keyFunc looks the verification key up by kid and pins the algorithm to
+// the one the key was made for, so a token cannot pick its own algorithm.
+func (s *KeySet) keyFunc(token *jwt.Token) (any, error) {
+	var key *Key
+	if kid, ok := token.Header["kid"]; ok {
+		id, isString := kid.(string)
+		if !isString {
+			return nil, errors.New("invalid kid header")
+		}
+		key = s.keys[id]
+	} else {
+		key = s.legacy
+	}
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing algorithm %q", token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+func (s *KeySet) algorithms() []string {
+	seen := map[string]bool{}
+	algs := []string{}
+	for _, key := range s.keys {
+		if !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			algs = append(algs, key.Algorithm)
+		}
+	}
+	return algs
+}
@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes what a new password has to satisfy before it is
+// hashed and stored.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MaxBytes, when positive, also limits the UTF-8 encoded length, for
+	// hashers such as bcrypt that cannot take longer input.
+	MaxBytes int
+	// MinScore is the lowest acceptable PasswordStrength score, 0 through 4.
+	MinScore int
+	// Breached, when set, rejects passwords known to have been leaked.
+	Breached BreachedPasswordChecker
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing is configured.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength: 8,
+		MaxLength: 256,
+		MinScore:  2,
+		Breached:  BundledBreachedList(),
+	}
+}
+
+// PasswordPolicyError lists every requirement a password failed.
+type PasswordPolicyError struct {
+	Problems []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password does not meet requirements: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks password against the policy. userInputs are values the
+// user has already told us, such as their email, which make a password
+// easier to guess when reused inside it.
+func (p PasswordPolicy) Validate(password string, userInputs ...string) error {
+	length := utf8.RuneCountInString(password)
+	// Reject overlong passwords before doing any work proportional to their
+	// length.
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return &PasswordPolicyError{Problems: []string{fmt.Sprintf("must be at most %d characters", p.MaxLength)}}
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		return &PasswordPolicyError{Problems: []string{fmt.Sprintf("must be at most %d bytes", p.MaxBytes)}}
+	}
+
+	problems := []string{}
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if containsUserInput(password, userInputs) {
+		problems = append(problems, "must not contain your email address")
+	}
+	if length >= p.MinLength && PasswordStrength(password, userInputs...) < p.MinScore {
+		problems = append(problems, "is too easy to guess; try a longer phrase of unrelated words")
+	}
+	if p.Breached != nil && password != "" {
+		breached, err := p.Breached.IsBreached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			problems = append(problems, "has appeared in a data breach and must not be used")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PasswordPolicyError{Problems: problems}
+	}
+	return nil
+}
+
+//go:embed data/common_passwords.txt
+var commonPasswordsFile []byte
+
+var commonPasswordRanks = loadRankedWords(commonPasswordsFile)
+
+func loadRankedWords(data []byte) map[string]int {
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if _, ok := ranks[word]; !ok {
+			ranks[word] = len(ranks) + 1
+		}
+	}
+	return ranks
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p",
+}
+
+var leetSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g',
+	'1': 'i', '!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's',
+	'7': 't', '+': 't', '2': 'z',
+}
+
+const (
+	// bruteforceCardinality is the number of guesses charged for each
+	// character that is not part of a recognisable pattern.
+	bruteforceCardinality = 10
+	// maxEstimateLength is how many characters estimateGuesses looks at.
+	// Anything past it only makes a password harder to guess.
+	maxEstimateLength = 256
+	// maxPatternLength is the longest segment matched against patterns,
+	// which keeps the search linear in the password's length. It covers the
+	// longest common password and keyboard row.
+	maxPatternLength = 80
+)
+
+// PasswordStrength scores a password from 0 (trivially guessable) to 4
+// (very hard to guess), in the spirit of zxcvbn. It estimates how many
+// guesses an attacker who knows common passwords, keyboard walks, repeats,
+// sequences, years and the user's own details would need, and buckets that
+// estimate on a log scale.
+func PasswordStrength(password string, userInputs ...string) int {
+	guesses := estimateGuesses(password, userInputs)
+	switch {
+	case guesses < 1e3:
+		return 0
+	case guesses < 1e6:
+		return 1
+	case guesses < 1e8:
+		return 2
+	case guesses < 1e10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// estimateGuesses finds the cheapest way to cover the password with known
+// patterns and brute-forced characters, multiplying the guesses each piece
+// needs.
+func estimateGuesses(password string, userInputs []string) float64 {
+	runes := []rune(password)
+	if len(runes) > maxEstimateLength {
+		runes = runes[:maxEstimateLength]
+	}
+	n := len(runes)
+	if n == 0 {
+		return 1
+	}
+	lower := make([]rune, n)
+	unleet := make([]rune, n)
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+		unleet[i] = lower[i]
+		if sub, ok := leetSubstitutions[lower[i]]; ok {
+			unleet[i] = sub
+		}
+	}
+	inputs := userInputTokens(userInputs)
+
+	// best[j] is the fewest guesses needed for the first j characters.
+	best := make([]float64, n+1)
+	best[0] = 1
+	for j := 1; j <= n; j++ {
+		best[j] = best[j-1] * bruteforceCardinality
+		for i := max(0, j-maxPatternLength); i < j; i++ {
+			g := patternGuesses(runes[i:j], lower[i:j], unleet[i:j], inputs)
+			if g > 0 && best[i]*g < best[j] {
+				best[j] = best[i] * g
+			}
+		}
+	}
+	return best[n]
+}
+
+// patternGuesses returns the guesses needed for a segment that matches a
+// known pattern, or 0 if it matches none.
+func patternGuesses(original, lower, unleet []rune, inputs map[string]bool) float64 {
+	n := len(lower)
+	if n < 3 {
+		return 0
+	}
+	word := string(lower)
+	guesses := math.Inf(1)
+
+	if inputs[word] {
+		guesses = math.Min(guesses, 1)
+	}
+	if rank, ok := commonPasswordRanks[word]; ok {
+		guesses = math.Min(guesses, float64(rank)*uppercaseVariations(original))
+	}
+	if rank, ok := commonPasswordRanks[string(unleet)]; ok && string(unleet) != word {
+		guesses = math.Min(guesses, float64(rank)*uppercaseVariations(original)*2)
+	}
+	if isRepeat(lower) {
+		guesses = math.Min(guesses, bruteforceCardinality*float64(n))
+	}
+	if isSequence(lower) {
+		guesses = math.Min(guesses, 26*float64(n))
+	}
+	if n >= 4 && isKeyboardWalk(word) {
+		guesses = math.Min(guesses, 50*float64(n))
+	}
+	if n == 4 && isYear(word) {
+		guesses = math.Min(guesses, 120)
+	}
+
+	if math.IsInf(guesses, 1) {
+		return 0
+	}
+	return guesses
+}
+
+// uppercaseVariations charges extra guesses for capitalisation beyond the
+// common all-lower, all-upper and leading-capital forms.
+func uppercaseVariations(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case upper == len(word), upper == 1 && unicode.IsUpper(word[0]):
+		return 2
+	default:
+		return float64(len(word))
+	}
+}
+
+func isRepeat(s []rune) bool {
+	for _, r := range s[1:] {
+		if r != s[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func isSequence(s []rune) bool {
+	delta := s[1] - s[0]
+	if delta != 1 && delta != -1 {
+		return false
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i]-s[i-1] != delta {
+			return false
+		}
+	}
+	return true
+}
+
+func isKeyboardWalk(s string) bool {
+	reversed := []rune(s)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(row, string(reversed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isYear(s string) bool {
+	return (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) &&
+		strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) == -1
+}
+
+// userInputTokens splits values like "jane.doe@example.com" into the
+// lowercase pieces an attacker would try: the whole value, its local part
+// and every alphanumeric run of three or more characters.
+func userInputTokens(userInputs []string) map[string]bool {
+	tokens := map[string]bool{}
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if input == "" {
+			continue
+		}
+		tokens[input] = true
+		if local, _, ok := strings.Cut(input, "@"); ok {
+			tokens[local] = true
+		}
+		for _, part := range strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len(part) >= 3 {
+				tokens[part] = true
+			}
+		}
+	}
+	return tokens
+}
+
+func containsUserInput(password string, userInputs []string) bool {
+	lower := strings.ToLower(password)
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if input == "" {
+			continue
+		}
+		if strings.Contains(lower, input) {
+			return true
+		}
+		if local, _, ok := strings.Cut(input, "@"); ok && len(local) >= 4 && strings.Contains(lower, local) {
+			return true
+		}
+	}
+	return false
+}
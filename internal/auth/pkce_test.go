@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// Example from RFC 7636 appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got := PKCEChallenge(verifier); got != challenge {
+		t.Errorf("PKCEChallenge = %s, want %s", got, challenge)
+	}
+	if !VerifyPKCE(verifier, challenge) {
+		t.Error("Expected the RFC verifier to pass")
+	}
+
+	for name, v := range map[string]string{
+		"wrong verifier": strings.Replace(verifier, "d", "e", 1),
+		"too short":      verifier[:42],
+		"too long":       strings.Repeat("a", 129),
+		"reserved char":  verifier[:42] + "+",
+	} {
+		if VerifyPKCE(v, PKCEChallenge(v)) && name != "wrong verifier" {
+			t.Errorf("%s: expected verifier to be rejected", name)
+		}
+		if VerifyPKCE(v, challenge) {
+			t.Errorf("%s: expected the RFC challenge to be rejected", name)
+		}
+	}
+	if !VerifyPKCE(strings.Repeat("~", 128), PKCEChallenge(strings.Repeat("~", 128))) {
+		t.Error("Expected a 128 character verifier to pass")
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed from RFC 6238 appendix B.
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC vectors are 8 digits; a 6 digit code is their last 6.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode(%d): %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := TOTPStep(now)
+	code, _ := TOTPCode(rfc6238Secret, step)
+
+	got, ok := ValidateTOTP(rfc6238Secret, code, now, 0)
+	if !ok || got != step {
+		t.Fatalf("Expected current code to match step %d, got %d %v", step, got, ok)
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, code, now, step); ok {
+		t.Error("Expected a used step to be refused")
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, code, now.Add(30*time.Second), 0); !ok {
+		t.Error("Expected the previous step to be accepted for clock drift")
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, code, now.Add(2*time.Minute), 0); ok {
+		t.Error("Expected a stale code to be refused")
+	}
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, bad, now, 0); ok {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+	if _, ok := ValidateTOTP("not base32!", "123456", now, 0); ok {
+		t.Error("Expected an invalid secret to be refused")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 || strings.Contains(secret, "=") {
+		t.Errorf("Expected 32 unpadded base32 characters, got %q", secret)
+	}
+	if _, err := TOTPCode(secret, 1); err != nil {
+		t.Errorf("Expected generated secret to be usable: %v", err)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(TOTPURI("Chirpy", "user@example.com", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Chirpy:user@example.com" {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+	q := uri.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "Chirpy" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("Unexpected parameters %v", q)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 {
+			t.Errorf("Unexpected code format %q", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate code %q", code)
+		}
+		seen[code] = true
+	}
+
+	hash := HashRecoveryCode(codes[0])
+	loose := strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))
+	if HashRecoveryCode(loose) != hash {
+		t.Error("Expected case, spaces and dashes to be ignored")
+	}
+	if HashRecoveryCode(codes[1]) == hash {
+		t.Error("Expected different codes to hash differently")
+	}
+}
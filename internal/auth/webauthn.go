@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// COSE algorithm identifiers for the passkey signatures we accept.
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+)
+
+// Authenticator data flags, WebAuthn section 6.1.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+	flagExtensions   = 0x80
+)
+
+// RelyingParty is this server as WebAuthn sees it. Credentials are scoped to
+// ID, and ceremonies are only accepted from one of Origins.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+	// RequireUserVerification rejects authenticators that only checked
+	// presence, not a PIN or biometric.
+	RequireUserVerification bool
+}
+
+// WebAuthnCredential is a newly registered passkey.
+type WebAuthnCredential struct {
+	ID []byte
+	// PublicKey is the COSE_Key exactly as the authenticator sent it.
+	PublicKey []byte
+	SignCount uint32
+}
+
+// ErrSignCountRegressed means an authenticator reported a signature counter
+// no greater than the last one seen, which suggests the credential has been
+// cloned.
+var ErrSignCountRegressed = errors.New("authenticator sign count did not increase")
+
+// NewChallenge returns a random WebAuthn challenge, base64url encoded as it
+// appears in client data.
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ClientData is the part of CollectedClientData the server checks.
+type ClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// ParseClientData decodes clientDataJSON. Servers use it to find the
+// challenge a response claims to answer before verifying it.
+func ParseClientData(clientDataJSON []byte) (ClientData, error) {
+	var cd ClientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return ClientData{}, fmt.Errorf("invalid client data: %w", err)
+	}
+	return cd, nil
+}
+
+// VerifyRegistration checks the response to a registration ceremony for
+// challenge and returns the new credential. Attestation statements are not
+// checked: Chirpy asks for "none" and trusts any authenticator.
+func (rp RelyingParty) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (WebAuthnCredential, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	decoded, rest, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return WebAuthnCredential{}, errors.New("invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return WebAuthnCredential{}, errors.New("attestation object has no authenticator data")
+	}
+
+	authData, err := rp.checkAuthenticatorData(rawAuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.credentialID == nil {
+		return WebAuthnCredential{}, errors.New("authenticator data has no attested credential")
+	}
+	if _, err := parseCOSEKey(authData.publicKey); err != nil {
+		return WebAuthnCredential{}, err
+	}
+	return WebAuthnCredential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks the response to an authentication ceremony for
+// challenge against a stored credential and returns the authenticator's new
+// signature counter.
+func (rp RelyingParty) VerifyAssertion(challenge string, publicKey []byte, storedSignCount uint32, clientDataJSON, authenticatorData, signature []byte) (uint32, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	authData, err := rp.checkAuthenticatorData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clip(authenticatorData), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return 0, errors.New("invalid assertion signature")
+	}
+
+	// Authenticators without a counter always report zero.
+	if (authData.signCount != 0 || storedSignCount != 0) && authData.signCount <= storedSignCount {
+		return 0, ErrSignCountRegressed
+	}
+	return authData.signCount, nil
+}
+
+func (rp RelyingParty) checkClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	cd, err := ParseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("unexpected client data type %q", cd.Type)
+	}
+	if challenge == "" || cd.Challenge != challenge {
+		return errors.New("client data challenge does not match")
+	}
+	if !slices.Contains(rp.Origins, cd.Origin) || cd.CrossOrigin {
+		return fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// checkAuthenticatorData parses authenticator data and checks it is for
+// this relying party and that the user was present.
+func (rp RelyingParty) checkAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return authenticatorData{}, errors.New("authenticator data is for another relying party")
+	}
+	ad := authenticatorData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return authenticatorData{}, errors.New("user presence was not confirmed")
+	}
+	if rp.RequireUserVerification && ad.flags&flagUserVerified == 0 {
+		return authenticatorData{}, errors.New("user was not verified")
+	}
+
+	rest := data[37:]
+	if ad.flags&flagAttestedData != 0 {
+		// AAGUID (16 bytes), credential ID length (2 bytes), credential ID,
+		// then the COSE public key.
+		if len(rest) < 18 {
+			return authenticatorData{}, errors.New("attested credential data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return authenticatorData{}, errors.New("invalid credential ID")
+		}
+		ad.credentialID = append([]byte(nil), rest[:idLen]...)
+		rest = rest[idLen:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		ad.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+		rest = after
+	}
+	if ad.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, fmt.Errorf("invalid extensions: %w", err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return authenticatorData{}, errors.New("trailing bytes in authenticator data")
+	}
+	return ad, nil
+}
+
+type coseKey struct {
+	alg int64
+	pub crypto.PublicKey
+}
+
+// parseCOSEKey reads an ES256 (P-256) or EdDSA (Ed25519) COSE_Key.
+func parseCOSEKey(data []byte) (coseKey, error) {
+	decoded, rest, err := decodeCBOR(data)
+	if err != nil {
+		return coseKey{}, fmt.Errorf("invalid COSE key: %w", err)
+	}
+	m, ok := decoded.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return coseKey{}, errors.New("invalid COSE key")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+
+	switch {
+	case kty == 2 && alg == COSEAlgES256 && crv == 1:
+		y, _ := m[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return coseKey{}, errors.New("invalid P-256 coordinates")
+		}
+		// ecdh rejects points that are not on the curve.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return coseKey{}, fmt.Errorf("invalid P-256 point: %w", err)
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return coseKey{alg: alg, pub: pub}, nil
+	case kty == 1 && alg == COSEAlgEdDSA && crv == 6:
+		if len(x) != ed25519.PublicKeySize {
+			return coseKey{}, errors.New("invalid Ed25519 public key")
+		}
+		return coseKey{alg: alg, pub: ed25519.PublicKey(x)}, nil
+	default:
+		return coseKey{}, fmt.Errorf("unsupported COSE key (kty %d, alg %d, crv %d)", kty, alg, crv)
+	}
+}
+
+func (k coseKey) verify(signed, signature []byte) bool {
+	switch pub := k.pub.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(pub, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, signature)
+	default:
+		return false
+	}
+}
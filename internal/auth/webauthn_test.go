@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thmastin/Chirpy/internal/softauthn"
+)
+
+var testRP = RelyingParty{ID: "chirpy.test", Name: "Chirpy", Origins: []string{"https://chirpy.test"}}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	for name, alg := range map[string]int{"ES256": softauthn.ES256, "EdDSA": softauthn.EdDSA} {
+		t.Run(name, func(t *testing.T) {
+			authenticator := softauthn.New()
+			challenge, _ := NewChallenge()
+			att, err := authenticator.Register("https://chirpy.test", "chirpy.test", challenge, []byte("user"), alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cred, err := testRP.VerifyRegistration(challenge, att.ClientDataJSON, att.AttestationObject)
+			if err != nil {
+				t.Fatalf("VerifyRegistration: %v", err)
+			}
+			if !bytes.Equal(cred.ID, att.CredentialID) {
+				t.Errorf("Expected credential ID %x, got %x", att.CredentialID, cred.ID)
+			}
+
+			count := cred.SignCount
+			for range 2 {
+				challenge, _ = NewChallenge()
+				assertion, _ := authenticator.Login("https://chirpy.test", "chirpy.test", challenge, nil)
+				count, err = testRP.VerifyAssertion(challenge, cred.PublicKey, count, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature)
+				if err != nil {
+					t.Fatalf("VerifyAssertion: %v", err)
+				}
+			}
+			if count != 2 {
+				t.Errorf("Expected sign count 2, got %d", count)
+			}
+		})
+	}
+}
+
+func TestWebAuthnRegistrationRejections(t *testing.T) {
+	authenticator := softauthn.New()
+	challenge, _ := NewChallenge()
+
+	tests := []struct {
+		name   string
+		origin string
+		rpID   string
+		answer string
+	}{
+		{"wrong challenge", "https://chirpy.test", "chirpy.test", "c29tZXRoaW5nIGVsc2U"},
+		{"wrong origin", "https://evil.test", "chirpy.test", challenge},
+		{"wrong relying party", "https://chirpy.test", "evil.test", challenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			att, _ := authenticator.Register(tt.origin, tt.rpID, tt.answer, []byte("user"), softauthn.EdDSA)
+			if _, err := testRP.VerifyRegistration(challenge, att.ClientDataJSON, att.AttestationObject); err == nil {
+				t.Error("Expected registration to be rejected")
+			}
+		})
+	}
+
+	att, _ := authenticator.Register("https://chirpy.test", "chirpy.test", challenge, []byte("user"), softauthn.EdDSA)
+	if _, err := testRP.VerifyRegistration(challenge, att.ClientDataJSON, att.AttestationObject[:len(att.AttestationObject)-1]); err == nil {
+		t.Error("Expected truncated attestation object to be rejected")
+	}
+	if _, err := testRP.VerifyRegistration("", att.ClientDataJSON, att.AttestationObject); err == nil {
+		t.Error("Expected an empty challenge to be rejected")
+	}
+}
+
+func TestWebAuthnAssertionRejections(t *testing.T) {
+	authenticator := softauthn.New()
+	challenge, _ := NewChallenge()
+	att, _ := authenticator.Register("https://chirpy.test", "chirpy.test", challenge, []byte("user"), softauthn.ES256)
+	cred, err := testRP.VerifyRegistration(challenge, att.ClientDataJSON, att.AttestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, _ = NewChallenge()
+	assertion, _ := authenticator.Login("https://chirpy.test", "chirpy.test", challenge, nil)
+	verify := func(challenge string, publicKey []byte, count uint32, clientData, authData, sig []byte) error {
+		_, err := testRP.VerifyAssertion(challenge, publicKey, count, clientData, authData, sig)
+		return err
+	}
+
+	badSig := bytes.Clone(assertion.Signature)
+	badSig[len(badSig)-1] ^= 1
+	other, _ := NewChallenge()
+	otherAtt, _ := softauthn.New().Register("https://chirpy.test", "chirpy.test", other, nil, softauthn.ES256)
+	otherCred, _ := testRP.VerifyRegistration(other, otherAtt.ClientDataJSON, otherAtt.AttestationObject)
+
+	if err := verify(other, cred.PublicKey, 0, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature); err == nil {
+		t.Error("Expected wrong challenge to be rejected")
+	}
+	if err := verify(challenge, cred.PublicKey, 0, assertion.ClientDataJSON, assertion.AuthenticatorData, badSig); err == nil {
+		t.Error("Expected a bad signature to be rejected")
+	}
+	if err := verify(challenge, otherCred.PublicKey, 0, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature); err == nil {
+		t.Error("Expected another credential's key to be rejected")
+	}
+	if err := verify(challenge, cred.PublicKey, 0, att.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature); err == nil {
+		t.Error("Expected registration client data to be rejected")
+	}
+	if err := verify(challenge, cred.PublicKey, 5, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature); !errors.Is(err, ErrSignCountRegressed) {
+		t.Errorf("Expected ErrSignCountRegressed, got %v", err)
+	}
+	if err := verify(challenge, cred.PublicKey, 0, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature); err != nil {
+		t.Errorf("Expected a valid assertion to pass, got %v", err)
+	}
+}
+
+func TestWebAuthnStaticCounter(t *testing.T) {
+	authenticator := softauthn.New()
+	authenticator.StaticCounter = true
+	challenge, _ := NewChallenge()
+	att, _ := authenticator.Register("https://chirpy.test", "chirpy.test", challenge, nil, softauthn.EdDSA)
+	cred, _ := testRP.VerifyRegistration(challenge, att.ClientDataJSON, att.AttestationObject)
+
+	for range 2 {
+		challenge, _ = NewChallenge()
+		assertion, _ := authenticator.Login("https://chirpy.test", "chirpy.test", challenge, nil)
+		if _, err := testRP.VerifyAssertion(challenge, cred.PublicKey, 0, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature); err != nil {
+			t.Fatalf("Expected counterless authenticator to be accepted, got %v", err)
+		}
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// Vectors from RFC 8949 appendix A.
+	tests := []struct {
+		hex  string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.hex)
+		got, rest, err := decodeCBOR(data)
+		if err != nil {
+			t.Errorf("decodeCBOR(%s): %v", tt.hex, err)
+			continue
+		}
+		if len(rest) != 0 || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeCBOR(%s) = %#v (rest %x), want %#v", tt.hex, got, rest, tt.want)
+		}
+	}
+
+	for name, input := range map[string]string{
+		"truncated":          "1a0001",
+		"short string":       "4401",
+		"indefinite length":  "5f42010243030405ff",
+		"float":              "f93c00",
+		"duplicate key":      "a201020103",
+		"array key":          "a1800102",
+		"huge array":         "9bffffffffffffffff",
+		"integer overflow":   "1bffffffffffffffff",
+		"too deep":           strings.Repeat("81", maxCBORDepth+2) + "00",
+		"empty":              "",
+		"tag":                "c11a514b67b0",
+		"reserved info":      "1c",
+		"huge map":           "bb7fffffffffffffff",
+		"negative overflow":  "3bffffffffffffffff",
+		"truncated map pair": "a101",
+	} {
+		data, _ := hex.DecodeString(input)
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	for _, seed := range []string{"a201020304", "83010203", "5f42010243030405ff", "a26161016162820203"} {
+		data, _ := hex.DecodeString(seed)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, rest, err := decodeCBOR(data)
+		if err == nil && len(rest) > len(data) {
+			t.Fatalf("rest is longer than input")
+		}
+	})
+}
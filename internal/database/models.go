@@ -11,6 +11,19 @@ import (
 	"github.com/google/uuid"
 )
 
+type Attachment struct {
+	ID                   uuid.UUID
+	UserID               uuid.NullUUID
+	ChirpID              uuid.NullUUID
+	Position             sql.NullInt32
+	ContentType          string
+	ThumbnailContentType string
+	Width                int32
+	Height               int32
+	SizeBytes            int64
+	CreatedAt            time.Time
+}
+
 type Chirp struct {
 	ID        uuid.UUID
 	CreatedAt time.Time
@@ -19,20 +32,118 @@ type Chirp struct {
 	UserID    uuid.UUID
 }
 
-type RefreshToken struct {
-	Token     string
+type Follow struct {
+	FollowerID uuid.UUID
+	FolloweeID uuid.UUID
+	CreatedAt  time.Time
+}
+
+type OauthAuthorizationCode struct {
+	CodeHash      string
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	RedirectUri   string
+	Scopes        []string
+	CodeChallenge string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+type OauthClient struct {
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	Name         string
+	RedirectUris []string
+	SecretHash   sql.NullString
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+type OauthGrant struct {
+	UserID    uuid.UUID
+	ClientID  uuid.UUID
+	Scopes    []string
 	CreatedAt time.Time
 	UpdatedAt time.Time
+}
+
+type PasswordResetToken struct {
+	TokenHash string
 	UserID    uuid.UUID
+	CreatedAt time.Time
 	ExpiresAt time.Time
-	RevokedAt sql.NullTime
+	UsedAt    sql.NullTime
+}
+
+type PersonalAccessToken struct {
+	ID         uuid.UUID
+	UserID     uuid.UUID
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+}
+
+type RecoveryCode struct {
+	CodeHash  string
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type RefreshToken struct {
+	TokenHash  string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	UserID     uuid.UUID
+	ExpiresAt  time.Time
+	RevokedAt  sql.NullTime
+	FamilyID   uuid.UUID
+	UserAgent  string
+	IpAddress  string
+	LastUsedAt time.Time
+}
+
+type TotpCredential struct {
+	UserID       uuid.UUID
+	Secret       string
+	CreatedAt    time.Time
+	ConfirmedAt  sql.NullTime
+	LastUsedStep int64
 }
 
 type User struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	HashedPassword string
-	IsChirpyRed    bool
+	ID              uuid.UUID
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Email           string
+	HashedPassword  string
+	IsChirpyRed     bool
+	TokenVersion    int32
+	EmailVerifiedAt sql.NullTime
+	Role            string
+	DeleteAfter     sql.NullTime
+	Handle          sql.NullString
+	DisplayName     string
+	Bio             string
+	AvatarUrl       string
+}
+
+type WebauthnChallenge struct {
+	Challenge string
+	Ceremony  string
+	UserID    uuid.NullUUID
+	ExpiresAt time.Time
+}
+
+type WebauthnCredential struct {
+	ID         []byte
+	UserID     uuid.UUID
+	PublicKey  []byte
+	SignCount  int64
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
 }
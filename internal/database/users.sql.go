@@ -13,6 +13,17 @@ import (
 	"github.com/google/uuid"
 )
 
+const cancelUserDeletion = `-- name: CancelUserDeletion :exec
+UPDATE users
+SET updated_at = NOW(), delete_after = NULL
+WHERE id = $1
+`
+
+func (q *Queries) CancelUserDeletion(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, cancelUserDeletion, id)
+	return err
+}
+
 const createUser = `-- name: CreateUser :one
 INSERT INTO users (id, created_at, updated_at, email, hashed_password)
 VALUES (
@@ -22,7 +33,7 @@ VALUES (
     $1,
     $2
 )
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, token_version, email_verified_at, role, delete_after, handle, display_name, bio, avatar_url
 `
 
 type CreateUserParams struct {
@@ -40,13 +51,80 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.TokenVersion,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeleteAfter,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
 	)
 	return i, err
 }
 
+const deleteUser = `-- name: DeleteUser :execrows
+DELETE FROM users
+WHERE id = $1
+`
+
+func (q *Queries) DeleteUser(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteUser, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const getEmailConflicts = `-- name: GetEmailConflicts :many
+SELECT lower(btrim(email)) AS normalized_email, id, email, created_at
+FROM users
+WHERE lower(btrim(email)) IN (
+    SELECT lower(btrim(email)) FROM users
+    GROUP BY lower(btrim(email))
+    HAVING COUNT(*) > 1
+)
+ORDER BY normalized_email, created_at
+`
+
+type GetEmailConflictsRow struct {
+	NormalizedEmail string
+	ID              uuid.UUID
+	Email           string
+	CreatedAt       time.Time
+}
+
+func (q *Queries) GetEmailConflicts(ctx context.Context) ([]GetEmailConflictsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getEmailConflicts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetEmailConflictsRow
+	for rows.Next() {
+		var i GetEmailConflictsRow
+		if err := rows.Scan(
+			&i.NormalizedEmail,
+			&i.ID,
+			&i.Email,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getUserByEmail = `-- name: GetUserByEmail :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users
-WHERE email = $1
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, token_version, email_verified_at, role, delete_after, handle, display_name, bio, avatar_url FROM users
+WHERE lower(email) = lower($1)
 `
 
 func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error) {
@@ -59,35 +137,82 @@ func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.TokenVersion,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeleteAfter,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+	)
+	return i, err
+}
+
+const getUserByID = `-- name: GetUserByID :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, token_version, email_verified_at, role, delete_after, handle, display_name, bio, avatar_url FROM users
+WHERE id = $1
+`
+
+func (q *Queries) GetUserByID(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByID, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.TokenVersion,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeleteAfter,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
 	)
 	return i, err
 }
 
 const getUserFromRefreshToken = `-- name: GetUserFromRefreshToken :one
-SELECT id, users.created_at, users.updated_at, email, hashed_password, is_chirpy_red, token, refresh_tokens.created_at, refresh_tokens.updated_at, user_id, expires_at, revoked_at FROM users 
+SELECT id, users.created_at, users.updated_at, email, hashed_password, is_chirpy_red, token_version, email_verified_at, role, delete_after, handle, display_name, bio, avatar_url, token_hash, refresh_tokens.created_at, refresh_tokens.updated_at, user_id, expires_at, revoked_at, family_id, user_agent, ip_address, last_used_at FROM users 
 JOIN refresh_tokens ON users.id = refresh_tokens.user_id
-WHERE refresh_tokens.token = $1
+WHERE refresh_tokens.token_hash = $1
 AND refresh_tokens.expires_at > NOW()
 AND refresh_tokens.revoked_at IS NULL
 `
 
 type GetUserFromRefreshTokenRow struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	HashedPassword string
-	IsChirpyRed    bool
-	Token          string
-	CreatedAt_2    time.Time
-	UpdatedAt_2    time.Time
-	UserID         uuid.UUID
-	ExpiresAt      time.Time
-	RevokedAt      sql.NullTime
+	ID              uuid.UUID
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Email           string
+	HashedPassword  string
+	IsChirpyRed     bool
+	TokenVersion    int32
+	EmailVerifiedAt sql.NullTime
+	Role            string
+	DeleteAfter     sql.NullTime
+	Handle          sql.NullString
+	DisplayName     string
+	Bio             string
+	AvatarUrl       string
+	TokenHash       string
+	CreatedAt_2     time.Time
+	UpdatedAt_2     time.Time
+	UserID          uuid.UUID
+	ExpiresAt       time.Time
+	RevokedAt       sql.NullTime
+	FamilyID        uuid.UUID
+	UserAgent       string
+	IpAddress       string
+	LastUsedAt      time.Time
 }
 
-func (q *Queries) GetUserFromRefreshToken(ctx context.Context, token string) (GetUserFromRefreshTokenRow, error) {
-	row := q.db.QueryRowContext(ctx, getUserFromRefreshToken, token)
+func (q *Queries) GetUserFromRefreshToken(ctx context.Context, tokenHash string) (GetUserFromRefreshTokenRow, error) {
+	row := q.db.QueryRowContext(ctx, getUserFromRefreshToken, tokenHash)
 	var i GetUserFromRefreshTokenRow
 	err := row.Scan(
 		&i.ID,
@@ -96,16 +221,90 @@ func (q *Queries) GetUserFromRefreshToken(ctx context.Context, token string) (Ge
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
-		&i.Token,
+		&i.TokenVersion,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeleteAfter,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+		&i.TokenHash,
 		&i.CreatedAt_2,
 		&i.UpdatedAt_2,
 		&i.UserID,
 		&i.ExpiresAt,
 		&i.RevokedAt,
+		&i.FamilyID,
+		&i.UserAgent,
+		&i.IpAddress,
+		&i.LastUsedAt,
 	)
 	return i, err
 }
 
+const getUserProfileByHandle = `-- name: GetUserProfileByHandle :one
+SELECT users.id, users.handle, users.display_name, users.bio, users.avatar_url, users.created_at,
+    (SELECT COUNT(*) FROM chirps WHERE chirps.user_id = users.id) AS chirp_count,
+    (SELECT COUNT(*) FROM follows WHERE follows.followee_id = users.id) AS follower_count,
+    (SELECT COUNT(*) FROM follows WHERE follows.follower_id = users.id) AS following_count
+FROM users
+WHERE users.handle = $1 AND users.delete_after IS NULL
+`
+
+type GetUserProfileByHandleRow struct {
+	ID             uuid.UUID
+	Handle         sql.NullString
+	DisplayName    string
+	Bio            string
+	AvatarUrl      string
+	CreatedAt      time.Time
+	ChirpCount     int64
+	FollowerCount  int64
+	FollowingCount int64
+}
+
+func (q *Queries) GetUserProfileByHandle(ctx context.Context, handle sql.NullString) (GetUserProfileByHandleRow, error) {
+	row := q.db.QueryRowContext(ctx, getUserProfileByHandle, handle)
+	var i GetUserProfileByHandleRow
+	err := row.Scan(
+		&i.ID,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+		&i.CreatedAt,
+		&i.ChirpCount,
+		&i.FollowerCount,
+		&i.FollowingCount,
+	)
+	return i, err
+}
+
+const incrementTokenVersion = `-- name: IncrementTokenVersion :exec
+UPDATE users
+SET updated_at = NOW(), token_version = token_version + 1
+WHERE id = $1
+`
+
+func (q *Queries) IncrementTokenVersion(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, incrementTokenVersion, id)
+	return err
+}
+
+const purgeDeletedUsers = `-- name: PurgeDeletedUsers :execrows
+DELETE FROM users
+WHERE delete_after <= NOW()
+`
+
+func (q *Queries) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeDeletedUsers)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const reset = `-- name: Reset :exec
 DELETE FROM users
 `
@@ -115,28 +314,89 @@ func (q *Queries) Reset(ctx context.Context) error {
 	return err
 }
 
-const setUserToRed = `-- name: SetUserToRed :exec
+const resetUserPassword = `-- name: ResetUserPassword :exec
+UPDATE users
+SET updated_at = NOW(), hashed_password = $1, token_version = token_version + 1,
+    email_verified_at = COALESCE(email_verified_at, NOW())
+WHERE id = $2
+`
+
+type ResetUserPasswordParams struct {
+	HashedPassword string
+	ID             uuid.UUID
+}
+
+func (q *Queries) ResetUserPassword(ctx context.Context, arg ResetUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, resetUserPassword, arg.HashedPassword, arg.ID)
+	return err
+}
+
+const scheduleUserDeletion = `-- name: ScheduleUserDeletion :one
+UPDATE users
+SET updated_at = NOW(), delete_after = NOW() + $1::float8 * INTERVAL '1 second', token_version = token_version + 1
+WHERE id = $2
+RETURNING delete_after
+`
+
+type ScheduleUserDeletionParams struct {
+	GraceSeconds float64
+	ID           uuid.UUID
+}
+
+func (q *Queries) ScheduleUserDeletion(ctx context.Context, arg ScheduleUserDeletionParams) (sql.NullTime, error) {
+	row := q.db.QueryRowContext(ctx, scheduleUserDeletion, arg.GraceSeconds, arg.ID)
+	var delete_after sql.NullTime
+	err := row.Scan(&delete_after)
+	return delete_after, err
+}
+
+const setUserRole = `-- name: SetUserRole :execrows
+UPDATE users
+SET updated_at = NOW(), role = $1
+WHERE id = $2
+`
+
+type SetUserRoleParams struct {
+	Role string
+	ID   uuid.UUID
+}
+
+func (q *Queries) SetUserRole(ctx context.Context, arg SetUserRoleParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setUserRole, arg.Role, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setUserToRed = `-- name: SetUserToRed :execrows
 UPDATE users
 SET is_chirpy_red = TRUE
 WHERE id = $1
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
 `
 
-func (q *Queries) SetUserToRed(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, setUserToRed, id)
-	return err
+func (q *Queries) SetUserToRed(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setUserToRed, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 const updateUserLogin = `-- name: UpdateUserLogin :one
 UPDATE users
-SET updated_at = NOW(), email = $1, hashed_password = $2
+SET updated_at = NOW(),
+    email = COALESCE($1, email),
+    hashed_password = COALESCE($2, hashed_password),
+    token_version = CASE WHEN $2::TEXT IS NULL THEN token_version ELSE token_version + 1 END,
+    email_verified_at = CASE WHEN email = COALESCE($1, email) THEN email_verified_at ELSE NULL END
 WHERE id = $3
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, token_version, email_verified_at, role, delete_after, handle, display_name, bio, avatar_url
 `
 
 type UpdateUserLoginParams struct {
-	Email          string
-	HashedPassword string
+	Email          sql.NullString
+	HashedPassword sql.NullString
 	ID             uuid.UUID
 }
 
@@ -150,6 +410,96 @@ func (q *Queries) UpdateUserLogin(ctx context.Context, arg UpdateUserLoginParams
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.TokenVersion,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeleteAfter,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
 	)
 	return i, err
 }
+
+const updateUserPassword = `-- name: UpdateUserPassword :exec
+UPDATE users
+SET updated_at = NOW(), hashed_password = $1
+WHERE id = $2
+`
+
+type UpdateUserPasswordParams struct {
+	HashedPassword string
+	ID             uuid.UUID
+}
+
+func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserPassword, arg.HashedPassword, arg.ID)
+	return err
+}
+
+const updateUserProfile = `-- name: UpdateUserProfile :one
+UPDATE users
+SET updated_at = NOW(),
+    handle = COALESCE($1, handle),
+    display_name = COALESCE($2, display_name),
+    bio = COALESCE($3, bio),
+    avatar_url = COALESCE($4, avatar_url)
+WHERE id = $5
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, token_version, email_verified_at, role, delete_after, handle, display_name, bio, avatar_url
+`
+
+type UpdateUserProfileParams struct {
+	Handle      sql.NullString
+	DisplayName sql.NullString
+	Bio         sql.NullString
+	AvatarUrl   sql.NullString
+	ID          uuid.UUID
+}
+
+func (q *Queries) UpdateUserProfile(ctx context.Context, arg UpdateUserProfileParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, updateUserProfile,
+		arg.Handle,
+		arg.DisplayName,
+		arg.Bio,
+		arg.AvatarUrl,
+		arg.ID,
+	)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.TokenVersion,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeleteAfter,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+	)
+	return i, err
+}
+
+const verifyUserEmail = `-- name: VerifyUserEmail :execrows
+UPDATE users
+SET updated_at = NOW(), email_verified_at = NOW()
+WHERE id = $1 AND email = $2 AND email_verified_at IS NULL
+`
+
+type VerifyUserEmailParams struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) VerifyUserEmail(ctx context.Context, arg VerifyUserEmailParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, verifyUserEmail, arg.ID, arg.Email)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
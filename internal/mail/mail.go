@@ -0,0 +1,109 @@
+// Package mail sends the emails Chirpy needs, such as address verification
+// links, through a pluggable Mailer.
+package mail
+
+import (
+	"context"
+	"fmt"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPMailer sends mail through an SMTP relay. The connection is upgraded
+// with STARTTLS when the server offers it.
+type SMTPMailer struct {
+	// Addr is the relay's host:port.
+	Addr string
+	// From is the sender, with or without a display name, e.g.
+	// "Chirpy <no-reply@example.com>".
+	From string
+	// Auth is optional; use smtp.PlainAuth for most relays.
+	Auth smtp.Auth
+}
+
+func (m SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The envelope takes the bare address; the display name only belongs
+	// in the From header.
+	sender, err := netmail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %w", m.From, err)
+	}
+	if err := smtp.SendMail(m.Addr, m.Auth, sender.Address, []string{msg.To}, format(m.From, msg, time.Now())); err != nil {
+		return fmt.Errorf("sending mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// MemoryOutbox keeps sent messages in memory, for tests.
+type MemoryOutbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (o *MemoryOutbox) Send(ctx context.Context, msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// Messages returns every message sent so far, oldest first.
+func (o *MemoryOutbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
+
+// FileOutbox writes each message to its own .eml file in Dir instead of
+// sending it, for local development.
+type FileOutbox struct {
+	Dir  string
+	From string
+}
+
+func (o FileOutbox) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(o.Dir, 0o755); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405"), uuid.NewString())
+	return os.WriteFile(filepath.Join(o.Dir, name), format(o.From, msg, now), 0o644)
+}
+
+// format renders msg as an RFC 5322 message. Header values are stripped of
+// line breaks so user input cannot inject headers.
+func format(from string, msg Message, date time.Time) []byte {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", clean.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", clean.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
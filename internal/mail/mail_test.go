@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryOutbox(t *testing.T) {
+	outbox := &MemoryOutbox{}
+	outbox.Send(context.Background(), Message{To: "a@example.com", Subject: "one"})
+	outbox.Send(context.Background(), Message{To: "b@example.com", Subject: "two"})
+
+	messages := outbox.Messages()
+	if len(messages) != 2 || messages[0].Subject != "one" || messages[1].Subject != "two" {
+		t.Errorf("Unexpected messages %+v", messages)
+	}
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	outbox := FileOutbox{Dir: dir, From: "chirpy@example.com"}
+	err := outbox.Send(context.Background(), Message{
+		To:      "user@example.com\r\nBcc: victim@example.com",
+		Subject: "Verify your email",
+		Body:    "line one\nline two",
+	})
+	if err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one .eml file, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	got := string(data)
+	if strings.Contains(got, "\r\nBcc:") {
+		t.Errorf("Expected header injection to be stripped, got %q", got)
+	}
+	for _, want := range []string{"From: chirpy@example.com\r\n", "Subject: Verify your email\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in message, got %q", want, got)
+		}
+	}
+}
+
+// smtpSession is what fakeSMTPServer received from a client.
+type smtpSession struct {
+	MailFrom string
+	Data     string
+}
+
+// fakeSMTPServer accepts a single session and sends the envelope sender and
+// DATA it receives on the returned channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan smtpSession, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		var session smtpSession
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				session.MailFrom = strings.TrimSpace(line)[len("MAIL FROM:"):]
+				reply("250 ok")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				session.Data = data.String()
+				received <- session
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	mailer := SMTPMailer{Addr: addr, From: "chirpy@example.com"}
+	err := mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "Hi there"})
+	if err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	select {
+	case session := <-received:
+		if session.MailFrom != "<chirpy@example.com>" {
+			t.Errorf("Unexpected envelope sender %q", session.MailFrom)
+		}
+		if !strings.Contains(session.Data, "To: user@example.com\r\n") || !strings.HasSuffix(session.Data, "Hi there\r\n") {
+			t.Errorf("Unexpected message data %q", session.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+func TestSMTPMailerDisplayName(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	mailer := SMTPMailer{Addr: addr, From: "Chirpy <no-reply@chirpy.local>"}
+	err := mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "Hi there"})
+	if err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	select {
+	case session := <-received:
+		if session.MailFrom != "<no-reply@chirpy.local>" {
+			t.Errorf("Expected the bare address as envelope sender, got %q", session.MailFrom)
+		}
+		if !strings.Contains(session.Data, "From: Chirpy <no-reply@chirpy.local>\r\n") {
+			t.Errorf("Expected the display name in the From header, got %q", session.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+
+	mailer.From = "not an address"
+	if err := mailer.Send(context.Background(), Message{To: "user@example.com"}); err == nil {
+		t.Error("Expected an invalid sender to be rejected")
+	}
+}
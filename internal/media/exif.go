@@ -0,0 +1,89 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const exifOrientationTag = 0x0112
+
+// exifOrientation returns the orientation tag from a JPEG's EXIF segment,
+// or 1 (upright) when there is none or it cannot be read.
+func exifOrientation(jpegData []byte) int {
+	if len(jpegData) < 4 || jpegData[0] != 0xFF || jpegData[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(jpegData); {
+		if jpegData[i] != 0xFF {
+			return 1
+		}
+		marker := jpegData[i+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker.
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Markers without a length.
+			i += 2
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			// Image data starts; metadata segments come before it.
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(jpegData[i+2:]))
+		if length < 2 || i+2+length > len(jpegData) {
+			return 1
+		}
+		segment := jpegData[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation from the first IFD of the TIFF
+// structure inside an EXIF segment.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// A SHORT value sits in the first two bytes of the value field.
+		if order.Uint16(tiff[entry+2:]) != 3 {
+			return 1
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
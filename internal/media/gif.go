@@ -0,0 +1,54 @@
+package media
+
+import "errors"
+
+var errGIFStructure = errors.New("media: malformed GIF")
+
+// gifFrameCount counts the image descriptors in a GIF by walking its
+// blocks, without decoding any pixels, so an animation's decoded size can
+// be checked before any frame is allocated.
+func gifFrameCount(data []byte) (int, error) {
+	// Header and logical screen descriptor.
+	if len(data) < 13 {
+		return 0, errGIFStructure
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+
+	frames := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension: label, then data sub-blocks
+			i += 2
+		case 0x2C: // image descriptor, then LZW code size and sub-blocks
+			if i+10 > len(data) {
+				return 0, errGIFStructure
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, errGIFStructure
+		}
+		// Skip data sub-blocks up to the zero-length terminator.
+		for {
+			if i >= len(data) {
+				return 0, errGIFStructure
+			}
+			n := int(data[i])
+			i += n + 1
+			if n == 0 {
+				break
+			}
+		}
+	}
+	return 0, errGIFStructure
+}
@@ -0,0 +1,221 @@
+// Package media checks uploaded images and prepares them for serving. Every
+// image is decoded and re-encoded, which drops EXIF and any other embedded
+// metadata, and gets a thumbnail.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+const (
+	// MaxPixels bounds the decoded size of an image, across all frames of
+	// a GIF, so a small file cannot expand into gigabytes of memory.
+	MaxPixels = 40_000_000
+	// ThumbnailSize is the largest width and height of a thumbnail.
+	ThumbnailSize = 320
+)
+
+var (
+	ErrUnsupportedType = errors.New("media: only JPEG, PNG and GIF images are supported")
+	ErrInvalidImage    = errors.New("media: image could not be decoded")
+	ErrTooLarge        = errors.New("media: image dimensions are too large")
+)
+
+// Image is a processed upload.
+type Image struct {
+	// ContentType is sniffed from the upload, never taken from the client.
+	ContentType string
+	Data        []byte
+	Width       int
+	Height      int
+
+	Thumbnail            []byte
+	ThumbnailContentType string
+}
+
+// Process sniffs data's type, re-encodes it without metadata and makes a
+// thumbnail. JPEGs are turned upright using their EXIF orientation first,
+// since that tag is dropped with the rest.
+func Process(data []byte) (Image, error) {
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return Image{}, ErrUnsupportedType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return Image{}, ErrInvalidImage
+	}
+	if config.Width*config.Height > MaxPixels {
+		return Image{}, ErrTooLarge
+	}
+
+	var out bytes.Buffer
+	var still image.Image
+	switch contentType {
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return Image{}, ErrInvalidImage
+		}
+		still = orient(toRGBA(img), exifOrientation(data))
+		err = jpeg.Encode(&out, still, &jpeg.Options{Quality: 90})
+		if err != nil {
+			return Image{}, err
+		}
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return Image{}, ErrInvalidImage
+		}
+		still = img
+		if err := png.Encode(&out, img); err != nil {
+			return Image{}, err
+		}
+	case "image/gif":
+		// Every frame lies within the logical screen, so counting them
+		// bounds the decoded size before DecodeAll allocates anything.
+		frames, err := gifFrameCount(data)
+		if err != nil {
+			return Image{}, ErrInvalidImage
+		}
+		if frames*config.Width*config.Height > MaxPixels {
+			return Image{}, ErrTooLarge
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return Image{}, ErrInvalidImage
+		}
+		// EncodeAll writes only the frames and loop count, leaving out
+		// comments and application extensions.
+		if err := gif.EncodeAll(&out, g); err != nil {
+			return Image{}, err
+		}
+		first := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+		draw.Draw(first, g.Image[0].Bounds(), g.Image[0], g.Image[0].Bounds().Min, draw.Over)
+		still = first
+	}
+
+	bounds := still.Bounds()
+	result := Image{
+		ContentType:          contentType,
+		Data:                 out.Bytes(),
+		Width:                bounds.Dx(),
+		Height:               bounds.Dy(),
+		ThumbnailContentType: "image/png",
+	}
+
+	var thumb bytes.Buffer
+	small := thumbnail(toRGBA(still), ThumbnailSize)
+	if contentType == "image/jpeg" {
+		result.ThumbnailContentType = "image/jpeg"
+		err = jpeg.Encode(&thumb, small, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&thumb, small)
+	}
+	if err != nil {
+		return Image{}, err
+	}
+	result.Thumbnail = thumb.Bytes()
+	return result, nil
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
+
+// thumbnail scales src down to fit in a size by size box, keeping its
+// aspect ratio. Each output pixel averages the block of source pixels it
+// covers. Images that already fit are returned as they are.
+func thumbnail(src *image.RGBA, size int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+	dw, dh := size, size
+	if sw >= sh {
+		dh = max(1, sh*size/sw)
+	} else {
+		dw = max(1, sw*size/sh)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					sum[0] += int(p[0])
+					sum[1] += int(p[1])
+					sum[2] += int(p[2])
+					sum[3] += int(p[3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for i := range sum {
+				d[i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// orient applies an EXIF orientation (1 to 8) to src, returning an image
+// that displays upright without the tag.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs turning clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs turning anticlockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
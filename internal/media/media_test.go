@@ -0,0 +1,278 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var (
+	red  = color.RGBA{255, 0, 0, 255}
+	blue = color.RGBA{0, 0, 255, 255}
+)
+
+// halves returns a w by h image, red on the left and blue on the right.
+func halves(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, red)
+			} else {
+				img.Set(x, y, blue)
+			}
+		}
+	}
+	return img
+}
+
+// withEXIF inserts an APP1 segment after the JPEG's start marker holding
+// an orientation and a description.
+func withEXIF(t *testing.T, jpegData []byte, orientation uint16, description string) []byte {
+	t.Helper()
+	var tiff bytes.Buffer
+	be := binary.BigEndian
+	tiff.WriteString("MM")
+	binary.Write(&tiff, be, uint16(42))
+	binary.Write(&tiff, be, uint32(8))
+	binary.Write(&tiff, be, uint16(2))
+	// Orientation, SHORT.
+	binary.Write(&tiff, be, []uint16{0x0112, 3})
+	binary.Write(&tiff, be, uint32(1))
+	binary.Write(&tiff, be, []uint16{orientation, 0})
+	// ImageDescription, ASCII, stored after the IFD.
+	binary.Write(&tiff, be, []uint16{0x010E, 2})
+	binary.Write(&tiff, be, uint32(len(description)+1))
+	binary.Write(&tiff, be, uint32(8+2+2*12+4))
+	binary.Write(&tiff, be, uint32(0))
+	tiff.WriteString(description + "\x00")
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	be.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, app1...)
+	return append(out, jpegData[2:]...)
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func near(c color.Color, want color.RGBA) bool {
+	r, g, b, _ := c.RGBA()
+	diff := func(a uint32, b uint8) bool { return int(a>>8)-int(b) < 40 && int(b)-int(a>>8) < 40 }
+	return diff(r, want.R) && diff(g, want.G) && diff(b, want.B)
+}
+
+func TestProcessJPEGStripsEXIF(t *testing.T) {
+	upload := withEXIF(t, encodeJPEG(t, halves(40, 20)), 6, "SECRET-GPS-DATA")
+	if exifOrientation(upload) != 6 {
+		t.Fatalf("Expected orientation 6, got %d", exifOrientation(upload))
+	}
+
+	img, err := Process(upload)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if img.ContentType != "image/jpeg" || img.ThumbnailContentType != "image/jpeg" {
+		t.Errorf("Unexpected content types %q, %q", img.ContentType, img.ThumbnailContentType)
+	}
+	if bytes.Contains(img.Data, []byte("Exif")) || bytes.Contains(img.Data, []byte("SECRET-GPS-DATA")) {
+		t.Error("Expected EXIF to be stripped")
+	}
+	if exifOrientation(img.Data) != 1 {
+		t.Error("Expected no orientation tag in the output")
+	}
+
+	// Turned clockwise: the red left half is now the top half.
+	if img.Width != 20 || img.Height != 40 {
+		t.Fatalf("Expected a 20x40 image, got %dx%d", img.Width, img.Height)
+	}
+	decoded, _ := jpeg.Decode(bytes.NewReader(img.Data))
+	if !near(decoded.At(10, 5), red) || !near(decoded.At(10, 35), blue) {
+		t.Errorf("Expected red above blue, got %v and %v", decoded.At(10, 5), decoded.At(10, 35))
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image whose pixels are numbered in reading order.
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.Pix[i*4] = uint8(i + 1)
+	}
+	for orientation, want := range map[int][]uint8{
+		1: {1, 2, 3, 4, 5, 6},
+		2: {3, 2, 1, 6, 5, 4},
+		3: {6, 5, 4, 3, 2, 1},
+		4: {4, 5, 6, 1, 2, 3},
+		5: {1, 4, 2, 5, 3, 6},
+		6: {4, 1, 5, 2, 6, 3},
+		7: {6, 3, 5, 2, 4, 1},
+		8: {3, 6, 2, 5, 1, 4},
+	} {
+		dst := orient(src, orientation)
+		var got []uint8
+		for i := 0; i < 6; i++ {
+			got = append(got, dst.Pix[i*4])
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("orientation %d: expected %v, got %v", orientation, want, got)
+		}
+	}
+}
+
+func TestProcessThumbnail(t *testing.T) {
+	img, err := Process(encodePNG(t, halves(1000, 500)))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	thumb, err := png.Decode(bytes.NewReader(img.Thumbnail))
+	if err != nil {
+		t.Fatalf("Unable to decode thumbnail: %v", err)
+	}
+	if b := thumb.Bounds(); b.Dx() != ThumbnailSize || b.Dy() != ThumbnailSize/2 {
+		t.Errorf("Expected a %dx%d thumbnail, got %v", ThumbnailSize, ThumbnailSize/2, b)
+	}
+	if !near(thumb.At(0, 0), red) || !near(thumb.At(ThumbnailSize-1, 0), blue) {
+		t.Errorf("Expected the thumbnail to keep the picture, got %v and %v", thumb.At(0, 0), thumb.At(ThumbnailSize-1, 0))
+	}
+
+	// Small images are not enlarged.
+	img, _ = Process(encodePNG(t, halves(100, 50)))
+	thumb, _ = png.Decode(bytes.NewReader(img.Thumbnail))
+	if b := thumb.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Errorf("Expected a 100x50 thumbnail, got %v", b)
+	}
+}
+
+func TestProcessPNGStripsMetadata(t *testing.T) {
+	upload := encodePNG(t, halves(10, 10))
+	// Insert a tEXt chunk after IHDR, which ends at byte 33.
+	chunk := []byte("tEXtComment\x00SECRET")
+	text := binary.BigEndian.AppendUint32(nil, uint32(len(chunk)-4))
+	text = append(text, chunk...)
+	text = binary.BigEndian.AppendUint32(text, crc32.ChecksumIEEE(chunk))
+	upload = append(append(append([]byte{}, upload[:33]...), text...), upload[33:]...)
+	if _, err := png.Decode(bytes.NewReader(upload)); err != nil {
+		t.Fatalf("Test PNG is invalid: %v", err)
+	}
+
+	img, err := Process(upload)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if img.ContentType != "image/png" || bytes.Contains(img.Data, []byte("SECRET")) {
+		t.Errorf("Expected the text chunk to be stripped from a PNG, got %q", img.ContentType)
+	}
+}
+
+func TestProcessAnimatedGIF(t *testing.T) {
+	palette := color.Palette{red, blue}
+	g := &gif.GIF{LoopCount: 0}
+	for i := 0; i < 2; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, g)
+
+	img, err := Process(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	out, err := gif.DecodeAll(bytes.NewReader(img.Data))
+	if err != nil || len(out.Image) != 2 {
+		t.Fatalf("Expected the animation to be kept, got %v frames (%v)", len(out.Image), err)
+	}
+	if img.ContentType != "image/gif" || img.ThumbnailContentType != "image/png" {
+		t.Errorf("Unexpected content types %q, %q", img.ContentType, img.ThumbnailContentType)
+	}
+}
+
+func TestProcessManyFrameGIF(t *testing.T) {
+	// Tiny frames on a large logical screen: small to store, but each
+	// frame may cover the whole screen once decoded.
+	palette := color.Palette{red, blue}
+	g := &gif.GIF{Config: image.Config{Width: 1000, Height: 1000, ColorModel: palette}}
+	for i := 0; i < MaxPixels/1_000_000+1; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), palette))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("EncodeAll: %v", err)
+	}
+
+	if frames, err := gifFrameCount(buf.Bytes()); err != nil || frames != len(g.Image) {
+		t.Fatalf("Expected %d frames, got %d (%v)", len(g.Image), frames, err)
+	}
+	if _, err := Process(buf.Bytes()); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+	if _, err := Process(buf.Bytes()[:buf.Len()-1]); !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("Expected a GIF without a trailer to be rejected, got %v", err)
+	}
+
+	g.Image, g.Delay = g.Image[:2], g.Delay[:2]
+	buf.Reset()
+	gif.EncodeAll(&buf, g)
+	if _, err := Process(buf.Bytes()); err != nil {
+		t.Errorf("Expected a GIF within the budget to be accepted, got %v", err)
+	}
+}
+
+func TestProcessRejects(t *testing.T) {
+	// A valid PNG header claiming to be 100000 pixels square.
+	huge := encodePNG(t, halves(1, 1))
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+
+	truncated := encodePNG(t, halves(10, 10))
+	truncated = truncated[:len(truncated)/2]
+
+	for name, tc := range map[string]struct {
+		data []byte
+		want error
+	}{
+		"text":        {[]byte("hello, this is not an image"), ErrUnsupportedType},
+		"svg":         {[]byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`), ErrUnsupportedType},
+		"pdf":         {[]byte("%PDF-1.4\n"), ErrUnsupportedType},
+		"webp":        {[]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), ErrUnsupportedType},
+		"huge":        {huge, ErrTooLarge},
+		"truncated":   {truncated, ErrInvalidImage},
+		"header only": {[]byte("\xFF\xD8\xFF\xE0"), ErrInvalidImage},
+	} {
+		if _, err := Process(tc.data); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+}
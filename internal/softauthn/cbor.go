@@ -0,0 +1,56 @@
+package softauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// pair is a map entry. Maps are lists of pairs so their encoding keeps the
+// order they were written in.
+type pair struct {
+	key   any
+	value any
+}
+
+func encodeMap(pairs []pair) []byte {
+	out := encodeHead(5, uint64(len(pairs)))
+	for _, p := range pairs {
+		out = append(out, encode(p.key)...)
+		out = append(out, encode(p.value)...)
+	}
+	return out
+}
+
+func encode(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return encodeHead(1, uint64(-1-v))
+		}
+		return encodeHead(0, uint64(v))
+	case []byte:
+		return append(encodeHead(2, uint64(len(v))), v...)
+	case string:
+		return append(encodeHead(3, uint64(len(v))), v...)
+	case []pair:
+		return encodeMap(v)
+	default:
+		panic(fmt.Sprintf("softauthn: cannot encode %T", v))
+	}
+}
+
+func encodeHead(major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return []byte{m | byte(n)}
+	case n <= 0xff:
+		return []byte{m | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{m | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{m | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{m | 27}, n)
+	}
+}
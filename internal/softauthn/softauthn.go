@@ -0,0 +1,219 @@
+// Package softauthn is a software WebAuthn authenticator for tests. It
+// produces registration and authentication responses the way a browser and
+// platform authenticator would, without attestation.
+package softauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// COSE algorithms a credential can be created with.
+const (
+	ES256 = -7
+	EdDSA = -8
+)
+
+// Authenticator holds credentials created through it.
+type Authenticator struct {
+	// StaticCounter makes every signature report a counter of zero, like
+	// authenticators that sync passkeys between devices.
+	StaticCounter bool
+
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	alg        int
+	ecKey      *ecdsa.PrivateKey
+	edKey      ed25519.PrivateKey
+	count      uint32
+}
+
+// Attestation is the response to a registration ceremony.
+type Attestation struct {
+	CredentialID      []byte
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+// Assertion is the response to an authentication ceremony.
+type Assertion struct {
+	CredentialID      []byte
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte
+}
+
+// New returns an authenticator with no credentials.
+func New() *Authenticator {
+	return &Authenticator{}
+}
+
+// Register creates a credential for rpID and answers challenge with it.
+func (a *Authenticator) Register(origin, rpID, challenge string, userHandle []byte, alg int) (Attestation, error) {
+	c := &credential{rpID: rpID, userHandle: userHandle, alg: alg, id: make([]byte, 16)}
+	rand.Read(c.id)
+	var coseKey []byte
+	switch alg {
+	case ES256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return Attestation{}, err
+		}
+		ecdhKey, err := key.PublicKey.ECDH()
+		if err != nil {
+			return Attestation{}, err
+		}
+		point := ecdhKey.Bytes()
+		c.ecKey = key
+		coseKey = encodeMap([]pair{
+			{1, 2}, {3, ES256}, {-1, 1}, {-2, point[1:33]}, {-3, point[33:]},
+		})
+	case EdDSA:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return Attestation{}, err
+		}
+		c.edKey = priv
+		coseKey = encodeMap([]pair{
+			{1, 1}, {3, EdDSA}, {-1, 6}, {-2, []byte(pub)},
+		})
+	default:
+		return Attestation{}, fmt.Errorf("unsupported algorithm %d", alg)
+	}
+	a.credentials = append(a.credentials, c)
+
+	authData := c.authenticatorData(0x01|0x04|0x40, 0)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(c.id)))
+	authData = append(authData, c.id...)
+	authData = append(authData, coseKey...)
+
+	return Attestation{
+		CredentialID:   c.id,
+		ClientDataJSON: clientData("webauthn.create", challenge, origin),
+		AttestationObject: encodeMap([]pair{
+			{"fmt", "none"}, {"attStmt", []pair{}}, {"authData", authData},
+		}),
+	}, nil
+}
+
+// Login answers challenge with the newest credential for rpID, or with the
+// credential credentialID if it is not nil.
+func (a *Authenticator) Login(origin, rpID, challenge string, credentialID []byte) (Assertion, error) {
+	c := a.find(rpID, credentialID)
+	if c == nil {
+		return Assertion{}, errors.New("no matching credential")
+	}
+	if !a.StaticCounter {
+		c.count++
+	}
+	authData := c.authenticatorData(0x01|0x04, c.count)
+	cd := clientData("webauthn.get", challenge, origin)
+	hash := sha256.Sum256(cd)
+	signed := append(authData, hash[:]...)
+
+	var sig []byte
+	switch c.alg {
+	case ES256:
+		digest := sha256.Sum256(signed)
+		var err error
+		sig, err = ecdsa.SignASN1(rand.Reader, c.ecKey, digest[:])
+		if err != nil {
+			return Assertion{}, err
+		}
+	case EdDSA:
+		sig = ed25519.Sign(c.edKey, signed)
+	}
+	return Assertion{
+		CredentialID:      c.id,
+		ClientDataJSON:    cd,
+		AuthenticatorData: authData,
+		Signature:         sig,
+		UserHandle:        c.userHandle,
+	}, nil
+}
+
+// SetSignCount sets a credential's signature counter, for simulating a
+// cloned authenticator.
+func (a *Authenticator) SetSignCount(credentialID []byte, count uint32) {
+	if c := a.find("", credentialID); c != nil {
+		c.count = count
+	}
+}
+
+func (a *Authenticator) find(rpID string, credentialID []byte) *credential {
+	for i := len(a.credentials) - 1; i >= 0; i-- {
+		c := a.credentials[i]
+		if credentialID != nil && string(c.id) == string(credentialID) {
+			return c
+		}
+		if credentialID == nil && c.rpID == rpID {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *credential) authenticatorData(flags byte, count uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, count)
+}
+
+func clientData(typ, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      origin,
+		"crossOrigin": false,
+	})
+	return b
+}
+
+// MarshalJSON encodes the attestation as a PublicKeyCredential, the way a
+// browser's toJSON() does.
+func (a Attestation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"id":    b64(a.CredentialID),
+		"rawId": b64(a.CredentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(a.ClientDataJSON),
+			"attestationObject": b64(a.AttestationObject),
+		},
+	})
+}
+
+// MarshalJSON encodes the assertion as a PublicKeyCredential, the way a
+// browser's toJSON() does.
+func (a Assertion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"id":    b64(a.CredentialID),
+		"rawId": b64(a.CredentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(a.ClientDataJSON),
+			"authenticatorData": b64(a.AuthenticatorData),
+			"signature":         b64(a.Signature),
+			"userHandle":        b64(a.UserHandle),
+		},
+	})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
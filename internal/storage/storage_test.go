@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testStore runs the behaviour every Store must share.
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "media/1/original", []byte("image bytes"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	r, err := s.Get(ctx, "media/1/original")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "image bytes" {
+		t.Errorf("Expected the stored bytes, got %q", data)
+	}
+
+	if err := s.Put(ctx, "media/1/original", []byte("replaced"), "image/png"); err != nil {
+		t.Fatalf("Put over an existing key: %v", err)
+	}
+	r, _ = s.Get(ctx, "media/1/original")
+	data, _ = io.ReadAll(r)
+	r.Close()
+	if string(data) != "replaced" {
+		t.Errorf("Expected the object to be replaced, got %q", data)
+	}
+
+	if err := s.Delete(ctx, "media/1/original"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "media/1/original"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	if err := s.Delete(ctx, "media/1/original"); err != nil {
+		t.Errorf("Expected deleting a missing key to succeed, got %v", err)
+	}
+
+	for _, key := range []string{"", "/etc/passwd", "../outside", "media/../../outside", "media//x", `media\x`} {
+		if err := s.Put(ctx, key, []byte("x"), "text/plain"); err == nil {
+			t.Errorf("Expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	testStore(t, LocalStore{Dir: t.TempDir()})
+}
@@ -0,0 +1,115 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Policy controls how repeated failures for a key are slowed down.
+type Policy struct {
+	// FreeAttempts is how many failures are allowed before any delay.
+	FreeAttempts int
+	// BaseDelay is the wait after the first penalised failure. It doubles
+	// with every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutThreshold is the failure count at which the key is locked for
+	// LockoutDuration instead of backing off.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// Window is how long after its last failure a key is forgotten.
+	Window time.Duration
+}
+
+type entry struct {
+	failures     int
+	blockedUntil time.Time
+	lastFailure  time.Time
+}
+
+// Tracker counts failures per key, such as an email address or client IP,
+// and tells callers how long a key must wait before trying again. It keeps
+// its state in memory, so limits apply per process.
+type Tracker struct {
+	mu        sync.Mutex
+	policy    Policy
+	entries   map[string]*entry
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func NewTracker(policy Policy) *Tracker {
+	return &Tracker{
+		policy:  policy,
+		entries: map[string]*entry{},
+		now:     time.Now,
+	}
+}
+
+// Check returns how long key must wait before its next attempt, or zero if
+// it may try now.
+func (t *Tracker) Check(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	e, ok := t.entries[key]
+	if !ok || now.After(e.blockedUntil) {
+		return 0
+	}
+	return e.blockedUntil.Sub(now)
+}
+
+// Fail records a failed attempt for key and returns how long it must now
+// wait before trying again.
+func (t *Tracker) Fail(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.prune(now)
+
+	e, ok := t.entries[key]
+	if !ok || now.Sub(e.lastFailure) > t.policy.Window {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	switch {
+	case t.policy.LockoutThreshold > 0 && e.failures >= t.policy.LockoutThreshold:
+		e.blockedUntil = now.Add(t.policy.LockoutDuration)
+	case e.failures > t.policy.FreeAttempts:
+		delay := t.policy.BaseDelay << (e.failures - t.policy.FreeAttempts - 1)
+		if delay <= 0 || delay > t.policy.MaxDelay {
+			delay = t.policy.MaxDelay
+		}
+		e.blockedUntil = now.Add(delay)
+	}
+	if now.After(e.blockedUntil) {
+		return 0
+	}
+	return e.blockedUntil.Sub(now)
+}
+
+// Reset forgets every failure recorded for key, lifting any lockout.
+func (t *Tracker) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// prune drops keys that are neither blocked nor inside their window. It runs
+// at most once per window so Fail stays cheap.
+func (t *Tracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.policy.Window {
+		return
+	}
+	t.lastPrune = now
+	for key, e := range t.entries {
+		if now.After(e.blockedUntil) && now.Sub(e.lastFailure) > t.policy.Window {
+			delete(t.entries, key)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestTracker(policy Policy) (*Tracker, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tracker := NewTracker(policy)
+	tracker.now = clock.Now
+	return tracker, clock
+}
+
+var testPolicy = Policy{
+	FreeAttempts:     2,
+	BaseDelay:        time.Second,
+	MaxDelay:         10 * time.Second,
+	LockoutThreshold: 8,
+	LockoutDuration:  time.Hour,
+	Window:           24 * time.Hour,
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	tracker, clock := newTestTracker(testPolicy)
+
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}
+	for i, want := range expected {
+		got := tracker.Fail("key")
+		if got != want {
+			t.Errorf("Failure %d: expected delay %v, got %v", i+1, want, got)
+		}
+		if tracker.Check("key") != want {
+			t.Errorf("Failure %d: expected Check to report %v, got %v", i+1, want, tracker.Check("key"))
+		}
+		clock.now = clock.now.Add(got)
+	}
+
+	if tracker.Check("other") != 0 {
+		t.Error("Expected unrelated key not to be blocked")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	tracker, clock := newTestTracker(testPolicy)
+
+	var delay time.Duration
+	for i := 0; i < testPolicy.LockoutThreshold; i++ {
+		clock.now = clock.now.Add(delay)
+		delay = tracker.Fail("key")
+	}
+	if delay != time.Hour {
+		t.Fatalf("Expected lockout of %v, got %v", time.Hour, delay)
+	}
+
+	clock.now = clock.now.Add(59 * time.Minute)
+	if tracker.Check("key") == 0 {
+		t.Error("Expected key to still be locked")
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	if tracker.Check("key") != 0 {
+		t.Error("Expected lockout to have expired")
+	}
+}
+
+func TestReset(t *testing.T) {
+	tracker, _ := newTestTracker(testPolicy)
+	for i := 0; i < testPolicy.LockoutThreshold; i++ {
+		tracker.Fail("key")
+	}
+	tracker.Reset("key")
+	if tracker.Check("key") != 0 {
+		t.Error("Expected reset key not to be blocked")
+	}
+	if tracker.Fail("key") != 0 {
+		t.Error("Expected failure count to restart after reset")
+	}
+}
+
+func TestWindowForgetsOldFailures(t *testing.T) {
+	tracker, clock := newTestTracker(testPolicy)
+	tracker.Fail("key")
+	tracker.Fail("key")
+
+	clock.now = clock.now.Add(25 * time.Hour)
+	if delay := tracker.Fail("key"); delay != 0 {
+		t.Errorf("Expected failures outside the window to be forgotten, got delay %v", delay)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/thmastin/Chirpy/internal/auth"
+)
+
+// loadTokenKeys builds the access token key set. Tokens are signed with the
+// PEM key in signingKeyFile when one is given, and with the shared SECRET
+// otherwise. verificationKeyFiles is a comma separated list of retired keys
+// that are still accepted. While switching from SECRET to a signing key,
+// leave SECRET set until the HS256 tokens it signed have expired.
+func loadTokenKeys(secret, signingKeyFile, verificationKeyFiles string) (*auth.KeySet, error) {
+	var hmacKey *auth.Key
+	if secret != "" {
+		key, err := auth.NewHMACKey([]byte(secret))
+		if err != nil {
+			return nil, err
+		}
+		hmacKey = key
+	}
+
+	retired := []*auth.Key{}
+	for _, path := range strings.Split(verificationKeyFiles, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		retired = append(retired, key)
+	}
+
+	if signingKeyFile == "" {
+		if hmacKey == nil {
+			return nil, errors.New("SECRET or JWT_SIGNING_KEY_FILE must be set")
+		}
+		return auth.NewKeySet(hmacKey, retired...)
+	}
+
+	signingKey, err := readKeyFile(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if hmacKey != nil {
+		retired = append(retired, hmacKey)
+	}
+	return auth.NewKeySet(signingKey, retired...)
+}
+
+func readKeyFile(path string) (*auth.Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := auth.ParseKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// handlerJWKS publishes the public keys access tokens are signed with so
+// other services can verify them without the shared secret.
+func handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, apiCfg.jwtConfig.Keys.JWKS())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+)
+
+func writeEd25519KeyFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path
+}
+
+func TestLoadTokenKeys(t *testing.T) {
+	dir := t.TempDir()
+	signing := writeEd25519KeyFile(t, dir, "signing.pem")
+	retired := writeEd25519KeyFile(t, dir, "retired.pem")
+
+	if _, err := loadTokenKeys("", "", ""); err == nil {
+		t.Error("Expected error with no secret and no signing key")
+	}
+	if _, err := loadTokenKeys("", filepath.Join(dir, "missing.pem"), ""); err == nil {
+		t.Error("Expected error for missing signing key file")
+	}
+
+	keys, err := loadTokenKeys("", signing, retired)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	if keys.SigningKey().Algorithm != auth.AlgEdDSA {
+		t.Errorf("Expected EdDSA signing key, got %s", keys.SigningKey().Algorithm)
+	}
+	if n := len(keys.JWKS().Keys); n != 2 {
+		t.Errorf("Expected signing and retired keys in JWKS, got %d", n)
+	}
+
+	// Tokens signed with SECRET keep verifying after switching to a key file.
+	hmacOnly, _ := loadTokenKeys("old-secret", "", "")
+	oldToken, _ := auth.MakeJWT(auth.Claims{Type: auth.TokenTypeAccess, UserID: uuid.New()}, auth.JWTConfig{Keys: hmacOnly}, time.Hour)
+	switched, err := loadTokenKeys("old-secret", signing, "")
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	if switched.SigningKey().Algorithm != auth.AlgEdDSA {
+		t.Errorf("Expected key file to take over signing, got %s", switched.SigningKey().Algorithm)
+	}
+	if _, err := auth.ValidateJWT(oldToken, auth.JWTConfig{Keys: switched}, auth.TokenTypeAccess); err != nil {
+		t.Errorf("Expected HS256 token to verify against SECRET, got %v", err)
+	}
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	db := setupTestAPI(t)
+	keys, err := loadTokenKeys("", writeEd25519KeyFile(t, t.TempDir(), "signing.pem"), "")
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	apiCfg.jwtConfig.Keys = keys
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	rec := httptest.NewRecorder()
+	handlerJWKS(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	var jwks auth.JWKS
+	json.NewDecoder(rec.Body).Decode(&jwks)
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("Expected one published key, got %+v", jwks)
+	}
+
+	// Another service verifies a Chirpy access token with only the JWKS.
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+	published := jwks.Keys[0]
+	x, _ := base64.RawURLEncoding.DecodeString(published.X)
+	_, err = jwt.Parse(session.Token, func(token *jwt.Token) (any, error) {
+		if token.Header["kid"] != published.Kid {
+			t.Errorf("Expected kid %s, got %v", published.Kid, token.Header["kid"])
+		}
+		return ed25519.PublicKey(x), nil
+	}, jwt.WithValidMethods([]string{published.Alg}))
+	if err != nil {
+		t.Errorf("Expected token to verify with the published key: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/throttle"
+)
+
+// loginAccountPolicy slows down guessing against a single email address.
+var loginAccountPolicy = throttle.Policy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	Window:           time.Hour,
+}
+
+// loginIPPolicy slows down a single client spraying many accounts.
+var loginIPPolicy = throttle.Policy{
+	FreeAttempts:     20,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 100,
+	LockoutDuration:  time.Hour,
+	Window:           time.Hour,
+}
+
+// loginAccountKey identifies an account for throttling by the email that was
+// submitted, whether or not it is registered, so a lockout looks the same
+// for real and unknown accounts.
+func loginAccountKey(email string) string {
+	return "email:" + normalizeEmail(email)
+}
+
+// clientIP returns the address of the directly connected client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginRetryAfter returns how long the caller must wait before another login
+// attempt for email is accepted from this client.
+func loginRetryAfter(r *http.Request, email string) time.Duration {
+	return max(
+		apiCfg.loginAccountThrottle.Check(loginAccountKey(email)),
+		apiCfg.loginIPThrottle.Check(clientIP(r)),
+	)
+}
+
+// recordLoginFailure counts a failed attempt against both the account and
+// the client address.
+func recordLoginFailure(r *http.Request, email string) {
+	apiCfg.loginAccountThrottle.Fail(loginAccountKey(email))
+	apiCfg.loginIPThrottle.Fail(clientIP(r))
+}
+
+func respondTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithError(w, 429, fmt.Sprintf("Too many attempts, try again in %d seconds", seconds))
+}
+
+func handlerUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid userID")
+		return
+	}
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	apiCfg.loginAccountThrottle.Reset(loginAccountKey(user.Email))
+	respondWithJSON(w, 204, nil)
+}
@@ -1,22 +1,29 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	netmail "net/mail"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/thmastin/Chirpy/internal/auth"
 	"github.com/thmastin/Chirpy/internal/database"
+	"github.com/thmastin/Chirpy/internal/mail"
+	"github.com/thmastin/Chirpy/internal/storage"
+	"github.com/thmastin/Chirpy/internal/throttle"
 )
 
 var apiCfg apiConfig
@@ -30,33 +37,148 @@ func main() {
 		os.Exit(1)
 	}
 	dbQueries := database.New(db)
-	platform := os.Getenv("PLATFORM")
-	tokenSecret := os.Getenv("SECRET")
+	if len(os.Args) > 1 {
+		if err := runCommand(context.Background(), dbQueries, os.Args[1:], os.Stdout); err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	polkaKey := os.Getenv("POLKA_KEY")
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080"
+	}
+
+	relyingParty, err := relyingPartyFromEnv(publicURL)
+	if err != nil {
+		fmt.Printf("error configuring WebAuthn: %v\n", err)
+		os.Exit(1)
+	}
+
+	tokenKeys, err := loadTokenKeys(os.Getenv("SECRET"), os.Getenv("JWT_SIGNING_KEY_FILE"), os.Getenv("JWT_VERIFICATION_KEY_FILES"))
+	if err != nil {
+		fmt.Printf("error loading token keys: %v\n", err)
+		os.Exit(1)
+	}
+	jwtConfig := auth.JWTConfig{
+		Keys:     tokenKeys,
+		Issuer:   "chirpy",
+		Audience: os.Getenv("JWT_AUDIENCE"),
+		Leeway:   30 * time.Second,
+	}
+	if v := os.Getenv("JWT_ISSUER"); v != "" {
+		jwtConfig.Issuer = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("JWT_LEEWAY")); err == nil {
+		jwtConfig.Leeway = v
+	}
+
+	var accountDeletionGrace time.Duration
+	if v, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE")); err == nil {
+		accountDeletionGrace = v
+	}
+
+	if os.Getenv("PASSWORD_HASHER") == "bcrypt" {
+		auth.DefaultHasher = auth.BcryptHasher{Cost: 12}
+	}
+
+	passwordPolicy := auth.DefaultPasswordPolicy()
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil {
+		passwordPolicy.MinLength = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_SCORE")); err == nil {
+		passwordPolicy.MinScore = v
+	}
+	if os.Getenv("PASSWORD_BREACH_CHECK") == "off" {
+		passwordPolicy.Breached = nil
+	}
+	if _, ok := auth.DefaultHasher.(auth.BcryptHasher); ok {
+		passwordPolicy.MaxBytes = auth.BcryptMaxPasswordBytes
+	}
 
 	apiCfg = apiConfig{
 		fileserverHits: atomic.Int32{},
 		dbQueries:      dbQueries,
-		platform:       platform,
-		tokenSecret:    tokenSecret,
+		jwtConfig:      jwtConfig,
 		polkaKey:       polkaKey,
+		passwordPolicy: passwordPolicy,
+		mailer:         mailerFromEnv(),
+		publicURL:      strings.TrimRight(publicURL, "/"),
+		relyingParty:   relyingParty,
+
+		accountDeletionGrace: accountDeletionGrace,
+		mediaStore:           mediaStoreFromEnv(),
+
+		loginAccountThrottle:  throttle.NewTracker(loginAccountPolicy),
+		loginIPThrottle:       throttle.NewTracker(loginIPPolicy),
+		verificationThrottle:  throttle.NewTracker(verificationResendPolicy),
+		passwordResetThrottle: throttle.NewTracker(passwordResetPolicy),
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
-	mux.HandleFunc("GET /admin/healthz", handlerHealthz)
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
-	mux.HandleFunc("POST /admin/reset", apiCfg.handlerReset)
+	// Only static/ is served: the working directory also holds the local
+	// mail outbox and media store, which must never be listed.
+	mux.Handle("/app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("static")))))
+	mux.HandleFunc("GET /api/healthz", handlerHealthz)
+	mux.HandleFunc("GET /.well-known/jwks.json", handlerJWKS)
+	mux.HandleFunc("GET /admin/metrics", requireRole(roleModerator, apiCfg.handlerMetrics))
+	mux.HandleFunc("POST /admin/reset", requireRole(roleAdmin, apiCfg.handlerReset))
+	mux.HandleFunc("POST /admin/users/{userID}/unlock", requireRole(roleModerator, handlerUnlockUser))
+	mux.HandleFunc("PUT /admin/users/{userID}/role", requireRole(roleAdmin, handlerSetUserRole))
 	mux.HandleFunc("POST /api/users", handlerAddUser)
-	mux.HandleFunc("POST /api/chirps", handlerChirps)
-	mux.HandleFunc("GET /api/chirps", handlerGetChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", handlerGetChirp)
+	mux.HandleFunc("GET /api/users/verify", handlerVerifyEmail)
+	mux.HandleFunc("POST /api/users/verify", handlerVerifyEmail)
+	mux.HandleFunc("POST /api/users/verify/resend", handlerResendVerification)
+	mux.HandleFunc("POST /api/chirps", requireScope(scopeWriteChirps, handlerChirps))
+	mux.HandleFunc("GET /api/chirps", optionalScope(scopeReadChirps, handlerGetChirps))
+	mux.HandleFunc("GET /api/chirps/{chirpID}", optionalScope(scopeReadChirps, handlerGetChirp))
+	mux.HandleFunc("POST /api/password-reset/request", handlerRequestPasswordReset)
+	mux.HandleFunc("POST /api/password-reset/confirm", handlerConfirmPasswordReset)
 	mux.HandleFunc("POST /api/login", handlerLogin)
+	mux.HandleFunc("POST /api/login/mfa", handlerLoginMFA)
+	mux.HandleFunc("POST /api/login/passkey/begin", handlerBeginPasskeyLogin)
+	mux.HandleFunc("POST /api/login/passkey/finish", handlerFinishPasskeyLogin)
 	mux.HandleFunc("POST /api/refresh", handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", handlerRevoke)
-	mux.HandleFunc("PUT /api/users", handlerUpdateUserLogin)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", handlerDeleteChirp)
+	mux.HandleFunc("PUT /api/users", requireAuth(handlerUpdateUserLogin))
+	mux.HandleFunc("PATCH /api/users", requireAuth(handlerUpdateUserLogin))
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", requireScope(scopeWriteChirps, handlerDeleteChirp))
+	mux.HandleFunc("POST /api/media", requireScope(scopeWriteChirps, handlerUploadMedia))
+	mux.HandleFunc("GET /api/media/{mediaID}", handlerGetMedia("original"))
+	mux.HandleFunc("GET /api/media/{mediaID}/thumbnail", handlerGetMedia("thumbnail"))
 	mux.HandleFunc("POST /api/polka/webhooks", handlerSetRed)
+	mux.HandleFunc("GET /api/users/{handle}", handlerGetProfile)
+	mux.HandleFunc("PATCH /api/users/me", requireAuth(handlerUpdateProfile))
+	mux.HandleFunc("PUT /api/users/{handle}/follow", requireAuth(handlerFollowUser))
+	mux.HandleFunc("DELETE /api/users/{handle}/follow", requireAuth(handlerUnfollowUser))
+	mux.HandleFunc("DELETE /api/users/me", requireAuth(handlerDeleteAccount))
+	mux.HandleFunc("GET /api/users/me/export", requireAuth(handlerExportAccount))
+	mux.HandleFunc("GET /api/users/me/sessions", requireAuth(handlerGetSessions))
+	mux.HandleFunc("DELETE /api/users/me/sessions", requireAuth(handlerRevokeAllSessions))
+	mux.HandleFunc("DELETE /api/users/me/sessions/{sessionID}", requireAuth(handlerRevokeSession))
+	mux.HandleFunc("POST /api/users/me/totp", requireAuth(handlerEnrollTOTP))
+	mux.HandleFunc("POST /api/users/me/totp/confirm", requireAuth(handlerConfirmTOTP))
+	mux.HandleFunc("POST /api/users/me/totp/recovery-codes", requireAuth(handlerRegenerateRecoveryCodes))
+	mux.HandleFunc("DELETE /api/users/me/totp", requireAuth(handlerDisableTOTP))
+	mux.HandleFunc("GET /api/users/me/passkeys", requireAuth(handlerGetPasskeys))
+	mux.HandleFunc("POST /api/users/me/passkeys/register/begin", requireAuth(handlerBeginPasskeyRegistration))
+	mux.HandleFunc("POST /api/users/me/passkeys/register/finish", requireAuth(handlerFinishPasskeyRegistration))
+	mux.HandleFunc("DELETE /api/users/me/passkeys/{passkeyID}", requireAuth(handlerDeletePasskey))
+	mux.HandleFunc("GET /api/users/me/tokens", requireAuth(handlerGetPersonalAccessTokens))
+	mux.HandleFunc("POST /api/users/me/tokens", requireAuth(handlerCreatePersonalAccessToken))
+	mux.HandleFunc("DELETE /api/users/me/tokens/{tokenID}", requireAuth(handlerRevokePersonalAccessToken))
+	mux.HandleFunc("GET /api/users/me/oauth/grants", requireAuth(handlerGetOAuthGrants))
+	mux.HandleFunc("DELETE /api/users/me/oauth/grants/{clientID}", requireAuth(handlerRevokeOAuthGrant))
+	mux.HandleFunc("GET /api/oauth/clients", requireAuth(handlerGetOAuthClients))
+	mux.HandleFunc("POST /api/oauth/clients", requireAuth(handlerCreateOAuthClient))
+	mux.HandleFunc("DELETE /api/oauth/clients/{clientID}", requireAuth(handlerDeleteOAuthClient))
+	mux.HandleFunc("GET /api/oauth/authorize", requireAuth(handlerGetAuthorization))
+	mux.HandleFunc("POST /api/oauth/authorize", requireAuth(handlerAuthorize))
+	mux.HandleFunc("POST /api/oauth/token", handlerOAuthToken)
+
+	go purgeDeletedUsers(context.Background(), time.Hour)
+	go purgeUnattachedMedia(context.Background(), time.Hour)
 
 	var s http.Server
 	s.Handler = mux
@@ -74,10 +196,24 @@ func handlerHealthz(w http.ResponseWriter, r *http.Request) {
 
 type apiConfig struct {
 	fileserverHits atomic.Int32
-	dbQueries      *database.Queries
-	platform       string
-	tokenSecret    string
+	dbQueries      database.Querier
+	jwtConfig      auth.JWTConfig
 	polkaKey       string
+	passwordPolicy auth.PasswordPolicy
+	mailer         mail.Mailer
+	// publicURL is where clients reach the server, used to build links in
+	// emails.
+	publicURL    string
+	relyingParty auth.RelyingParty
+	// accountDeletionGrace is how long a deleted account can be restored by
+	// logging in. Zero deletes accounts immediately.
+	accountDeletionGrace time.Duration
+	mediaStore           storage.Store
+
+	loginAccountThrottle  *throttle.Tracker
+	loginIPThrottle       *throttle.Tracker
+	verificationThrottle  *throttle.Tracker
+	passwordResetThrottle *throttle.Tracker
 }
 
 func (apiCfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -96,10 +232,6 @@ func (apiCfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request)
 }
 
 func (apiCfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
-	if apiCfg.platform != "dev" {
-		respondWithError(w, 403, "forbidden")
-		return
-	}
 	err := apiCfg.dbQueries.Reset(r.Context())
 	if err != nil {
 		respondWithError(w, 500, fmt.Sprintf("unable to reset users table: %v", err))
@@ -112,27 +244,18 @@ func (apiCfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 
 func handlerChirps(w http.ResponseWriter, r *http.Request) {
 	type paramaters struct {
-		Body string `json:"body"`
+		Body     string      `json:"body"`
+		MediaIDs []uuid.UUID `json:"media_ids"`
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
-		return
-	}
-
-	userID, err := auth.ValidateJWT(token, apiCfg.tokenSecret)
-	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
-		return
-	}
+	userID := currentPrincipal(r).UserID
 
 	decoder := json.NewDecoder(r.Body)
 	params := paramaters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+		respondWithError(w, 400, "Invalid request body")
 		return
 	}
 
@@ -149,6 +272,20 @@ func handlerChirps(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(params.MediaIDs) > maxAttachments {
+		respondWithError(w, 400, fmt.Sprintf("A chirp can have at most %d media", maxAttachments))
+		return
+	}
+	ok, err := checkAttachments(r.Context(), userID, params.MediaIDs)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("unable to check media: %v", err))
+		return
+	}
+	if !ok {
+		respondWithError(w, 400, "Invalid media_ids")
+		return
+	}
+
 	args := database.CreateChirpParams{
 		Body:   cleanedChirp,
 		UserID: userID,
@@ -159,13 +296,20 @@ func handlerChirps(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 500, fmt.Sprintf("unable to create chirp: %v", err))
 		return
 	}
-	chirp := Chirp{
-		ID:        newChirp.ID,
-		CreatedAt: newChirp.CreatedAt,
-		UpdatedAt: newChirp.UpdatedAt,
-		Body:      newChirp.Body,
-		UserID:    newChirp.UserID,
+	chirp := convertChirp(newChirp)
+	attached, err := attachMedia(r.Context(), newChirp, params.MediaIDs)
+	if err != nil {
+		if err := apiCfg.dbQueries.DeleteChirp(r.Context(), newChirp.ID); err != nil {
+			log.Printf("Unable to delete chirp %s after failed attach: %v", newChirp.ID, err)
+		}
+		if errors.Is(err, errMediaTaken) {
+			respondWithError(w, 409, "Media is already attached to a chirp")
+			return
+		}
+		respondWithError(w, 500, fmt.Sprintf("unable to attach media: %v", err))
+		return
 	}
+	chirp.Media = attached
 	respondWithJSON(w, 201, chirp)
 }
 
@@ -175,18 +319,30 @@ func handlerAddUser(w http.ResponseWriter, r *http.Request) {
 		Email    string `json:"email"`
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxCredentialsBodyBytes)
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	params.Email = normalizeEmail(params.Email)
+	if !validEmail(params.Email) {
+		respondWithError(w, 400, "Invalid email address")
+		return
+	}
+	if !validatePassword(w, params.Password, params.Email) {
 		return
 	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
 		log.Printf("Error hashing password: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
 	}
 
 	args := database.CreateUserParams{
@@ -194,19 +350,33 @@ func handlerAddUser(w http.ResponseWriter, r *http.Request) {
 		HashedPassword: hashedPassword,
 	}
 
+	// A duplicate email gets the same response as a new account so signup
+	// cannot be used to find out who is registered. The address owner is
+	// told by email instead, unless repeated signups have used up the
+	// address's or client's allowance, in which case the notice is dropped
+	// without changing the response.
 	newUser, err := apiCfg.dbQueries.CreateUser(r.Context(), args)
-	if err != nil {
+	switch {
+	case isUniqueViolation(err):
+		if reserveVerificationEmail(r, params.Email) == 0 {
+			err = sendAccountExistsEmail(r.Context(), params.Email)
+		}
+	case err != nil:
 		respondWithError(w, 500, fmt.Sprintf("unable to create user: %v", err))
 		return
+	default:
+		err = sendVerificationEmail(r.Context(), newUser)
 	}
-	user := User{
-		ID:          newUser.ID,
-		CreatedAt:   newUser.CreatedAt,
-		UpdatedAt:   newUser.UpdatedAt,
-		Email:       newUser.Email,
-		IsChirpyRed: newUser.IsChirpyRed,
+	if err != nil {
+		log.Printf("Unable to send signup email: %v", err)
 	}
-	respondWithJSON(w, 201, user)
+	respondWithJSON(w, 202, signupResponse{
+		Message: "If this email is not already registered, your account has been created. Check your inbox to verify your email address.",
+	})
+}
+
+type signupResponse struct {
+	Message string `json:"message"`
 }
 
 func handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -215,67 +385,94 @@ func handlerLogin(w http.ResponseWriter, r *http.Request) {
 		Email    string `json:"email"`
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxCredentialsBodyBytes)
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	params.Email = normalizeEmail(params.Email)
+	if retryAfter := loginRetryAfter(r, params.Email); retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter)
 		return
 	}
 
 	apiUser, err := apiCfg.dbQueries.GetUserByEmail(r.Context(), params.Email)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
+		// Spend as long as a real comparison so timing does not reveal
+		// whether the email is registered.
+		auth.SimulatePasswordCheck(params.Password)
+		recordLoginFailure(r, params.Email)
 		respondWithError(w, 401, "Incorrect email or password")
 		return
 	}
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
 
 	err = auth.CheckPasswordHash(params.Password, apiUser.HashedPassword)
 	if err != nil {
+		recordLoginFailure(r, params.Email)
 		respondWithError(w, 401, "Incorrect email or password")
 		return
 	}
+	apiCfg.loginAccountThrottle.Reset(loginAccountKey(params.Email))
 
-	token, err := auth.MakeJWT(apiUser.ID, apiCfg.tokenSecret, time.Hour)
-	if err != nil {
-		log.Printf("Error creating token: %v", err)
+	if auth.NeedsRehash(apiUser.HashedPassword) {
+		rehashPassword(r.Context(), apiUser.ID, params.Password)
 	}
 
-	refreshToken, err := auth.MakeRefreshToken()
-	if err != nil {
-		log.Printf("failed to create refresh token: %v", err)
-		respondWithError(w, 500, "failed to create refresh token")
+	if mfaRequired(w, r, apiUser) {
 		return
 	}
+	issueSession(w, r, apiUser)
+}
 
-	currentTime := time.Now()
-	expiryTime := currentTime.AddDate(0, 0, 60)
+// issueSession starts a new session for a fully authenticated user and
+// responds with its access and refresh tokens.
+func issueSession(w http.ResponseWriter, r *http.Request, apiUser database.User) {
+	if apiUser.DeleteAfter.Valid {
+		// Logging in during the grace period restores the account.
+		if err := apiCfg.dbQueries.CancelUserDeletion(r.Context(), apiUser.ID); err != nil {
+			log.Printf("Unable to cancel user deletion: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
+	}
 
-	refreshTokenParams := database.CreateRefreshTokenParams{
-		Token:     refreshToken,
-		UserID:    apiUser.ID,
-		ExpiresAt: expiryTime,
+	sessionID := uuid.New()
+	token, err := auth.MakeJWT(auth.Claims{
+		Type:         auth.TokenTypeAccess,
+		UserID:       apiUser.ID,
+		TokenVersion: apiUser.TokenVersion,
+		SessionID:    sessionID,
+	}, apiCfg.jwtConfig, time.Hour)
+	if err != nil {
+		log.Printf("Error creating token: %v", err)
+		respondWithError(w, 500, "failed to create token")
+		return
 	}
 
-	newRefreshToken, err := apiCfg.dbQueries.CreateRefreshToken(r.Context(), refreshTokenParams)
+	refreshToken, err := createRefreshToken(r, apiUser.ID, sessionID)
 	if err != nil {
 		log.Printf("failed to create refresh token: %v", err)
 		respondWithError(w, 500, "failed to create refresh token")
+		return
 	}
 
-	user := User{
-		ID:           apiUser.ID,
-		CreatedAt:    apiUser.CreatedAt,
-		UpdatedAt:    apiUser.UpdatedAt,
-		Email:        apiUser.Email,
-		Token:        token,
-		RefreshToken: newRefreshToken.Token,
-		IsChirpyRed:  apiUser.IsChirpyRed,
-	}
+	user := convertUser(apiUser)
+	user.Token = token
+	user.RefreshToken = refreshToken
 
 	respondWithJSON(w, 200, user)
-
 }
+
 func handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 	apiChirps := []Chirp{}
 	dbChirps := []database.Chirp{}
@@ -284,13 +481,13 @@ func handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 	if s != "" {
 		userID, err := uuid.Parse(s)
 		if err != nil {
-			log.Printf("Unable to pars author_id: %v", err)
-			respondWithError(w, 500, "Server Error")
+			respondWithError(w, 400, "Invalid author_id")
 			return
 		}
 		dbChirps, err = apiCfg.dbQueries.GetChirpsByUser(r.Context(), userID)
 		if err != nil {
 			respondWithError(w, 500, fmt.Sprintf("Unable to get chirps: %v", err))
+			return
 		}
 	} else {
 		dbChirps, err = apiCfg.dbQueries.GetAllChirps(r.Context())
@@ -325,6 +522,10 @@ func handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 	for i := range dbChirps {
 		apiChirps = append(apiChirps, convertChirp(dbChirps[i]))
 	}
+	if err := loadAttachments(r.Context(), apiChirps); err != nil {
+		respondWithError(w, 500, fmt.Sprintf("unable to retrieve media: %v", err))
+		return
+	}
 
 	respondWithJSON(w, 200, apiChirps)
 }
@@ -333,132 +534,304 @@ func handlerGetChirp(w http.ResponseWriter, r *http.Request) {
 	chirpID := r.PathValue("chirpID")
 	chirpUUID, err := uuid.Parse(chirpID)
 	if err != nil {
-		respondWithError(w, 500, fmt.Sprintf("unable to parse request: %v", err))
+		respondWithError(w, 400, "Invalid chirpID")
 		return
 	}
 	chirp, err := apiCfg.dbQueries.GetChirp(r.Context(), chirpUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "chirp not found")
+		return
+	}
 	if err != nil {
-		respondWithError(w, 404, fmt.Sprintf("chirp not found: %v", err))
+		respondWithError(w, 500, fmt.Sprintf("unable to get chirp: %v", err))
 		return
 	}
-	apiChirp := convertChirp(chirp)
-	respondWithJSON(w, 200, apiChirp)
+	apiChirps := []Chirp{convertChirp(chirp)}
+	if err := loadAttachments(r.Context(), apiChirps); err != nil {
+		respondWithError(w, 500, fmt.Sprintf("unable to get media: %v", err))
+		return
+	}
+	respondWithJSON(w, 200, apiChirps[0])
 }
 
 func handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+		respondUnauthorized(w, "Bearer", err)
+		return
+	}
+	user, err := apiCfg.dbQueries.GetUserFromRefreshToken(r.Context(), auth.HashRefreshToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		detectRefreshTokenReuse(r.Context(), token)
+		respondUnauthorized(w, "Bearer", errInvalidToken)
 		return
 	}
-	user, err := apiCfg.dbQueries.GetUserFromRefreshToken(r.Context(), token)
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+		log.Printf("Unable to get user from refresh token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	// Rotate: the replacement is stored before the presented token is
+	// spent, so the session always has a live token and its access tokens
+	// keep working. Losing the race to another request presenting the same
+	// token means it was copied, and revoking the family takes the
+	// replacement with it.
+	newRefreshToken, err := createRefreshToken(r, user.ID, user.FamilyID)
+	if err != nil {
+		log.Printf("failed to create refresh token: %v", err)
+		respondWithError(w, 500, "failed to create refresh token")
+		return
+	}
+	revoked, err := apiCfg.dbQueries.RevokeRefreshToken(r.Context(), auth.HashRefreshToken(token))
+	if err != nil {
+		log.Printf("Unable to revoke refresh token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if revoked == 0 {
+		revokeRefreshTokenFamily(r.Context(), user.FamilyID)
+		respondUnauthorized(w, "Bearer", errInvalidToken)
 		return
 	}
-	newToken, err := auth.MakeJWT(user.ID, apiCfg.tokenSecret, time.Hour)
+
+	newToken, err := auth.MakeJWT(auth.Claims{
+		Type:         auth.TokenTypeAccess,
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+		SessionID:    user.FamilyID,
+	}, apiCfg.jwtConfig, time.Hour)
 	if err != nil {
 		log.Printf("Failed to generate JWT: %v", err)
 		respondWithError(w, 500, "Failed to generate new token")
 		return
 	}
 	respondWithJSON(w, 200, map[string]string{
-		"token": newToken,
+		"token":         newToken,
+		"refresh_token": newRefreshToken,
 	})
 
 }
 
-func handlerRevoke(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+// refreshTokenTTL is how long a refresh token lasts before the user has to
+// log in again.
+const refreshTokenTTL = 60 * 24 * time.Hour
+
+// createRefreshToken makes a new 60 day refresh token for the user. Only its
+// digest is stored; the token itself is returned to be handed to the client.
+// familyID links every token rotated from the same login, and the request's
+// client details are recorded so the user can recognise the session.
+func createRefreshToken(r *http.Request, userID, familyID uuid.UUID) (string, error) {
+	refreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
-		return
+		return "", err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
 	}
-	err = apiCfg.dbQueries.RevokeRefreshToken(r.Context(), token)
+
+	_, err = apiCfg.dbQueries.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
+		TokenHash:  auth.HashRefreshToken(refreshToken),
+		UserID:     userID,
+		TtlSeconds: refreshTokenTTL.Seconds(),
+		FamilyID:   familyID,
+		UserAgent:  userAgent,
+		IpAddress:  clientIP(r),
+	})
 	if err != nil {
-		log.Printf("Unable to revoke refresh token: %v", err)
+		return "", err
 	}
-	respondWithJSON(w, 204, nil)
+	return refreshToken, nil
 }
 
-func handlerUpdateUserLogin(w http.ResponseWriter, r *http.Request) {
-	type paramaters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+// detectRefreshTokenReuse treats an already rotated or revoked refresh token
+// being presented again as a sign it was stolen, and revokes every token in
+// its family so neither the thief nor the victim can keep refreshing.
+func detectRefreshTokenReuse(ctx context.Context, token string) {
+	stored, err := apiCfg.dbQueries.GetRefreshToken(ctx, auth.HashRefreshToken(token))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Unable to get refresh token: %v", err)
+		}
+		return
 	}
+	if stored.RevokedAt.Valid {
+		revokeRefreshTokenFamily(ctx, stored.FamilyID)
+	}
+}
 
+func revokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) {
+	log.Printf("Refresh token reuse detected, revoking token family %s", familyID)
+	err := apiCfg.dbQueries.RevokeRefreshTokenFamily(ctx, familyID)
+	if err != nil {
+		log.Printf("Unable to revoke refresh token family: %v", err)
+	}
+}
+
+func handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+		respondUnauthorized(w, "Bearer", err)
 		return
 	}
-
-	userID, err := auth.ValidateJWT(token, apiCfg.tokenSecret)
+	revoked, err := apiCfg.dbQueries.RevokeRefreshToken(r.Context(), auth.HashRefreshToken(token))
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+		log.Printf("Unable to revoke refresh token: %v", err)
+		respondWithError(w, 500, "Server Error")
 		return
 	}
+	if revoked == 0 {
+		respondUnauthorized(w, "Bearer", errInvalidToken)
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
+
+// handlerUpdateUserLogin changes the caller's email, password or both.
+// Fields left out of the request are unchanged, and either change needs
+// the current password.
+func handlerUpdateUserLogin(w http.ResponseWriter, r *http.Request) {
+	type paramaters struct {
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+
+	principal := currentPrincipal(r)
+	userID := principal.UserID
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxCredentialsBodyBytes)
 	decoder := json.NewDecoder(r.Body)
 	params := paramaters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	if params.Email == nil && params.Password == nil {
+		respondWithError(w, 400, "Provide an email or password to change")
 		return
 	}
 
-	newHashedPassword, err := auth.HashPassword(params.Password)
+	currentUser, err := apiCfg.dbQueries.GetUserByID(r.Context(), userID)
 	if err != nil {
-		log.Printf("Failed to hash password: %v", err)
+		log.Printf("Unable to get user: %v", err)
 		respondWithError(w, 500, "Server Error")
 		return
 	}
+	if !confirmPassword(w, r, currentUser, params.CurrentPassword) {
+		return
+	}
 
-	args := database.UpdateUserLoginParams{
-		Email:          params.Email,
-		HashedPassword: newHashedPassword,
-		ID:             userID,
+	args := database.UpdateUserLoginParams{ID: userID}
+	email := currentUser.Email
+	if params.Email != nil {
+		email = normalizeEmail(*params.Email)
+		if !validEmail(email) {
+			respondWithError(w, 400, "Invalid email address")
+			return
+		}
+		if email != currentUser.Email {
+			args.Email = sql.NullString{String: email, Valid: true}
+		}
+	}
+	if params.Password != nil {
+		if !validatePassword(w, *params.Password, email) {
+			return
+		}
+		newHashedPassword, err := auth.HashPassword(*params.Password)
+		if err != nil {
+			log.Printf("Failed to hash password: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
+		args.HashedPassword = sql.NullString{String: newHashedPassword, Valid: true}
 	}
 
-	updatedUser, err := apiCfg.dbQueries.UpdateUserLogin(r.Context(), args)
-	if err != nil {
-		log.Printf("Error updating user: %v", err)
-		respondWithError(w, 500, "Server Error")
+	// Saving an unchanged email is a no-op rather than a credential change.
+	updatedUser := currentUser
+	if args.Email.Valid || args.HashedPassword.Valid {
+		updatedUser, err = apiCfg.dbQueries.UpdateUserLogin(r.Context(), args)
+		if isUniqueViolation(err) {
+			respondWithError(w, 409, "email already in use")
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating user: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
 	}
 
-	user := User{
-		ID:          updatedUser.ID,
-		CreatedAt:   updatedUser.CreatedAt,
-		UpdatedAt:   updatedUser.UpdatedAt,
-		Email:       updatedUser.Email,
-		IsChirpyRed: updatedUser.IsChirpyRed,
+	if updatedUser.Email != currentUser.Email {
+		// The new address is unverified until its owner follows the link,
+		// and the old one is told in case the change was not theirs.
+		if err := sendVerificationEmail(r.Context(), updatedUser); err != nil {
+			log.Printf("Unable to send verification email: %v", err)
+		}
+		if err := sendEmailChangedEmail(r.Context(), currentUser.Email, updatedUser.Email); err != nil {
+			log.Printf("Unable to send email change notice: %v", err)
+		}
 	}
-	respondWithJSON(w, 200, user)
-}
 
-func handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
-		return
+	// Changing the password bumps the token version, which invalidates every
+	// access token issued so far. Sign the user out everywhere else and hand
+	// this session a replacement token.
+	if args.HashedPassword.Valid {
+		err = apiCfg.dbQueries.RevokeOtherRefreshTokensForUser(r.Context(), database.RevokeOtherRefreshTokensForUserParams{
+			UserID:   updatedUser.ID,
+			FamilyID: principal.SessionID,
+		})
+		if err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
+		// Personal access tokens were minted with the old password, so a
+		// new one revokes them too.
+		if err := apiCfg.dbQueries.DeletePersonalAccessTokensForUser(r.Context(), updatedUser.ID); err != nil {
+			log.Printf("Error revoking personal access tokens: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
 	}
 
-	userID, err := auth.ValidateJWT(token, apiCfg.tokenSecret)
+	token, err := auth.MakeJWT(auth.Claims{
+		Type:         auth.TokenTypeAccess,
+		UserID:       updatedUser.ID,
+		TokenVersion: updatedUser.TokenVersion,
+		SessionID:    principal.SessionID,
+	}, apiCfg.jwtConfig, time.Hour)
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+		log.Printf("Error creating token: %v", err)
+		respondWithError(w, 500, "failed to create token")
 		return
 	}
 
+	user := convertUser(updatedUser)
+	user.Token = token
+	respondWithJSON(w, 200, user)
+}
+
+func handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
 	chirpID := r.PathValue("chirpID")
 	chirpUUID, err := uuid.Parse(chirpID)
 	if err != nil {
-		respondWithError(w, 500, fmt.Sprintf("unable to parse request: %v", err))
+		respondWithError(w, 400, "Invalid chirpID")
 		return
 	}
 	chirp, err := apiCfg.dbQueries.GetChirp(r.Context(), chirpUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "chirp not found")
+		return
+	}
 	if err != nil {
-		respondWithError(w, 404, fmt.Sprintf("chirp not found: %v", err))
+		respondWithError(w, 500, fmt.Sprintf("unable to get chirp: %v", err))
 		return
 	}
 
@@ -480,11 +853,12 @@ func handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
 func handlerSetRed(w http.ResponseWriter, r *http.Request) {
 	apiKey, err := auth.GetAPIKey(r.Header)
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+		respondUnauthorized(w, "ApiKey", err)
 		return
 	}
 	if apiKey != apiCfg.polkaKey {
-		respondWithError(w, 401, "Unauthorize")
+		respondUnauthorized(w, "ApiKey", errInvalidToken)
+		return
 	}
 
 	type UserUpgradedEvent struct {
@@ -499,7 +873,7 @@ func handlerSetRed(w http.ResponseWriter, r *http.Request) {
 	err = json.NewDecoder(r.Body).Decode(&event)
 	if err != nil {
 		log.Printf("Error decoding request: %v", err)
-		respondWithError(w, 500, "Server Error")
+		respondWithError(w, 400, "Invalid request body")
 		return
 	}
 
@@ -508,8 +882,13 @@ func handlerSetRed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = apiCfg.dbQueries.SetUserToRed(r.Context(), event.Data.UserID)
+	upgraded, err := apiCfg.dbQueries.SetUserToRed(r.Context(), event.Data.UserID)
 	if err != nil {
+		log.Printf("Unable to upgrade user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if upgraded == 0 {
 		respondWithError(w, 404, "User not found")
 		return
 	}
@@ -550,6 +929,66 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(dat)
 }
 
+// rehashPassword upgrades a stored hash to the current hasher and parameters.
+// Failure is logged rather than surfaced because the login itself succeeded.
+func rehashPassword(ctx context.Context, userID uuid.UUID, password string) {
+	hashedPassword, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("Error rehashing password: %v", err)
+		return
+	}
+	err = apiCfg.dbQueries.UpdateUserPassword(ctx, database.UpdateUserPasswordParams{
+		HashedPassword: hashedPassword,
+		ID:             userID,
+	})
+	if err != nil {
+		log.Printf("Error storing rehashed password: %v", err)
+	}
+}
+
+// maxCredentialsBodyBytes bounds request bodies that carry passwords, which
+// comfortably fits any password the policy accepts.
+const maxCredentialsBodyBytes = 16 << 10
+
+// validatePassword checks a new password against the configured policy and
+// writes a 400 describing every unmet requirement when it fails.
+func validatePassword(w http.ResponseWriter, password, email string) bool {
+	err := apiCfg.passwordPolicy.Validate(password, email)
+	if err == nil {
+		return true
+	}
+	var policyErr *auth.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		respondWithError(w, 400, policyErr.Error())
+		return false
+	}
+	log.Printf("Error validating password: %v", err)
+	respondWithError(w, 500, "Server Error")
+	return false
+}
+
+// normalizeEmail is applied to every email the API receives, so addresses
+// match regardless of case or surrounding whitespace. Mail providers treat
+// the local part case-insensitively in practice, so the whole address is
+// lowercased.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validEmail reports whether a normalized email is a bare address such as
+// user@example.com, with no display name or angle brackets.
+func validEmail(email string) bool {
+	addr, err := netmail.ParseAddress(email)
+	return err == nil && addr.Name == "" && addr.Address == email
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint
+// violation, e.g. inserting an email that is already registered.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 func cleanChirpBody(s string) string {
 	words := strings.Split(s, " ")
 	for i := range words {
@@ -569,6 +1008,7 @@ func convertChirp(c database.Chirp) Chirp {
 		UpdatedAt: c.UpdatedAt,
 		Body:      c.Body,
 		UserID:    c.UserID,
+		Media:     []Attachment{},
 	}
 }
 
@@ -589,12 +1029,39 @@ type User struct {
 	Token        string    `json:"token"`
 	RefreshToken string    `json:"refresh_token"`
 	IsChirpyRed  bool      `json:"is_chirpy_red"`
+	// IsEmailVerified is false until the emailed verification link is used.
+	IsEmailVerified bool    `json:"is_email_verified"`
+	Handle          *string `json:"handle"`
+	DisplayName     string  `json:"display_name"`
+	Bio             string  `json:"bio"`
+	AvatarURL       string  `json:"avatar_url"`
+}
+
+// convertUser returns the signed-in user's own view of their account,
+// without tokens.
+func convertUser(u database.User) User {
+	user := User{
+		ID:              u.ID,
+		CreatedAt:       u.CreatedAt,
+		UpdatedAt:       u.UpdatedAt,
+		Email:           u.Email,
+		IsChirpyRed:     u.IsChirpyRed,
+		IsEmailVerified: u.EmailVerifiedAt.Valid,
+		DisplayName:     u.DisplayName,
+		Bio:             u.Bio,
+		AvatarURL:       u.AvatarUrl,
+	}
+	if u.Handle.Valid {
+		user.Handle = &u.Handle.String
+	}
+	return user
 }
 
 type Chirp struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Body      string    `json:"body"`
-	UserID    uuid.UUID `json:"user_id"`
+	ID        uuid.UUID    `json:"id"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	Body      string       `json:"body"`
+	UserID    uuid.UUID    `json:"user_id"`
+	Media     []Attachment `json:"media"`
 }
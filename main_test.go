@@ -1,7 +1,23 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+	"github.com/thmastin/Chirpy/internal/mail"
+	"github.com/thmastin/Chirpy/internal/storage"
+	"github.com/thmastin/Chirpy/internal/throttle"
 )
 
 func TestCleanChirpBody(t *testing.T) {
@@ -34,3 +50,1591 @@ func TestCleanChirpBody(t *testing.T) {
 	}
 
 }
+
+// fakeQueries is an in-memory stand-in for the database. Methods that a test
+// does not exercise fall through to the embedded nil Querier and panic.
+type fakeQueries struct {
+	database.Querier
+	users         map[uuid.UUID]database.User
+	chirps        map[uuid.UUID]database.Chirp
+	refreshTokens map[string]database.RefreshToken
+	resetTokens   map[string]database.PasswordResetToken
+	totp          map[uuid.UUID]database.TotpCredential
+	recoveryCodes map[string]database.RecoveryCode
+	passkeys      map[string]database.WebauthnCredential
+	challenges    map[string]database.WebauthnChallenge
+	oauthClients  map[uuid.UUID]database.OauthClient
+	oauthCodes    map[string]database.OauthAuthorizationCode
+	oauthGrants   map[database.GetOAuthGrantParams]database.OauthGrant
+	patTokens     map[uuid.UUID]database.PersonalAccessToken
+	follows       map[database.FollowUserParams]time.Time
+	attachments   map[uuid.UUID]database.Attachment
+}
+
+// fromNow is the fake's stand-in for NOW() + seconds.
+func fromNow(seconds float64) time.Time {
+	return time.Now().Add(time.Duration(seconds * float64(time.Second)))
+}
+
+func newFakeQueries() *fakeQueries {
+	return &fakeQueries{
+		users:         map[uuid.UUID]database.User{},
+		chirps:        map[uuid.UUID]database.Chirp{},
+		refreshTokens: map[string]database.RefreshToken{},
+		resetTokens:   map[string]database.PasswordResetToken{},
+		totp:          map[uuid.UUID]database.TotpCredential{},
+		recoveryCodes: map[string]database.RecoveryCode{},
+		passkeys:      map[string]database.WebauthnCredential{},
+		challenges:    map[string]database.WebauthnChallenge{},
+		oauthClients:  map[uuid.UUID]database.OauthClient{},
+		oauthCodes:    map[string]database.OauthAuthorizationCode{},
+		oauthGrants:   map[database.GetOAuthGrantParams]database.OauthGrant{},
+		patTokens:     map[uuid.UUID]database.PersonalAccessToken{},
+		follows:       map[database.FollowUserParams]time.Time{},
+		attachments:   map[uuid.UUID]database.Attachment{},
+	}
+}
+
+func (f *fakeQueries) CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error) {
+	for _, u := range f.users {
+		if strings.EqualFold(u.Email, arg.Email) {
+			return database.User{}, &pq.Error{Code: "23505"}
+		}
+	}
+	now := time.Now()
+	u := database.User{
+		ID:             uuid.New(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Email:          arg.Email,
+		HashedPassword: arg.HashedPassword,
+		Role:           "user",
+	}
+	f.users[u.ID] = u
+	return u, nil
+}
+
+func (f *fakeQueries) GetUserByEmail(ctx context.Context, email string) (database.User, error) {
+	for _, u := range f.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return database.User{}, sql.ErrNoRows
+}
+
+func (f *fakeQueries) GetEmailConflicts(ctx context.Context) ([]database.GetEmailConflictsRow, error) {
+	groups := map[string][]database.GetEmailConflictsRow{}
+	for _, u := range f.users {
+		normalized := strings.ToLower(strings.TrimSpace(u.Email))
+		groups[normalized] = append(groups[normalized], database.GetEmailConflictsRow{
+			NormalizedEmail: normalized,
+			ID:              u.ID,
+			Email:           u.Email,
+			CreatedAt:       u.CreatedAt,
+		})
+	}
+	var rows []database.GetEmailConflictsRow
+	for _, group := range groups {
+		if len(group) > 1 {
+			rows = append(rows, group...)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].NormalizedEmail != rows[j].NormalizedEmail {
+			return rows[i].NormalizedEmail < rows[j].NormalizedEmail
+		}
+		return rows[i].CreatedAt.Before(rows[j].CreatedAt)
+	})
+	return rows, nil
+}
+
+func (f *fakeQueries) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	u, ok := f.users[id]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (f *fakeQueries) UpdateUserLogin(ctx context.Context, arg database.UpdateUserLoginParams) (database.User, error) {
+	for _, u := range f.users {
+		if arg.Email.Valid && strings.EqualFold(u.Email, arg.Email.String) && u.ID != arg.ID {
+			return database.User{}, &pq.Error{Code: "23505"}
+		}
+	}
+	u, ok := f.users[arg.ID]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+	if arg.Email.Valid && u.Email != arg.Email.String {
+		u.Email = arg.Email.String
+		u.EmailVerifiedAt = sql.NullTime{}
+	}
+	if arg.HashedPassword.Valid {
+		u.HashedPassword = arg.HashedPassword.String
+		u.TokenVersion++
+	}
+	u.UpdatedAt = time.Now()
+	f.users[u.ID] = u
+	return u, nil
+}
+
+func (f *fakeQueries) UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error {
+	u, ok := f.users[arg.ID]
+	if !ok {
+		return nil
+	}
+	u.HashedPassword = arg.HashedPassword
+	f.users[u.ID] = u
+	return nil
+}
+
+func (f *fakeQueries) VerifyUserEmail(ctx context.Context, arg database.VerifyUserEmailParams) (int64, error) {
+	u, ok := f.users[arg.ID]
+	if !ok || u.Email != arg.Email || u.EmailVerifiedAt.Valid {
+		return 0, nil
+	}
+	u.EmailVerifiedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	f.users[u.ID] = u
+	return 1, nil
+}
+
+func (f *fakeQueries) ResetUserPassword(ctx context.Context, arg database.ResetUserPasswordParams) error {
+	u, ok := f.users[arg.ID]
+	if !ok {
+		return nil
+	}
+	u.HashedPassword = arg.HashedPassword
+	u.TokenVersion++
+	if !u.EmailVerifiedAt.Valid {
+		u.EmailVerifiedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	f.users[arg.ID] = u
+	return nil
+}
+
+// deleteUser removes a user and, like ON DELETE CASCADE, everything that
+// references them.
+func (f *fakeQueries) deleteUser(id uuid.UUID) {
+	delete(f.users, id)
+	delete(f.totp, id)
+	for k, v := range f.chirps {
+		if v.UserID == id {
+			f.DeleteChirp(context.Background(), k)
+		}
+	}
+	for k, v := range f.attachments {
+		if v.UserID.Valid && v.UserID.UUID == id {
+			v.UserID = uuid.NullUUID{}
+			f.attachments[k] = v
+		}
+	}
+	for k, v := range f.refreshTokens {
+		if v.UserID == id {
+			delete(f.refreshTokens, k)
+		}
+	}
+	for k, v := range f.resetTokens {
+		if v.UserID == id {
+			delete(f.resetTokens, k)
+		}
+	}
+	for k, v := range f.recoveryCodes {
+		if v.UserID == id {
+			delete(f.recoveryCodes, k)
+		}
+	}
+	for k, v := range f.passkeys {
+		if v.UserID == id {
+			delete(f.passkeys, k)
+		}
+	}
+	for k, v := range f.challenges {
+		if v.UserID.Valid && v.UserID.UUID == id {
+			delete(f.challenges, k)
+		}
+	}
+	for k, v := range f.oauthClients {
+		if v.UserID == id {
+			f.DeleteOAuthClientForUser(context.Background(), database.DeleteOAuthClientForUserParams{ID: k, UserID: id})
+		}
+	}
+	for k, v := range f.oauthCodes {
+		if v.UserID == id || f.oauthClients[v.ClientID].ID == uuid.Nil {
+			delete(f.oauthCodes, k)
+		}
+	}
+	for k := range f.oauthGrants {
+		if k.UserID == id {
+			delete(f.oauthGrants, k)
+		}
+	}
+	for k, v := range f.patTokens {
+		if v.UserID == id {
+			delete(f.patTokens, k)
+		}
+	}
+	for k := range f.follows {
+		if k.FollowerID == id || k.FolloweeID == id {
+			delete(f.follows, k)
+		}
+	}
+}
+
+func (f *fakeQueries) DeleteUser(ctx context.Context, id uuid.UUID) (int64, error) {
+	if _, ok := f.users[id]; !ok {
+		return 0, nil
+	}
+	f.deleteUser(id)
+	return 1, nil
+}
+
+func (f *fakeQueries) ScheduleUserDeletion(ctx context.Context, arg database.ScheduleUserDeletionParams) (sql.NullTime, error) {
+	u, ok := f.users[arg.ID]
+	if !ok {
+		return sql.NullTime{}, sql.ErrNoRows
+	}
+	u.DeleteAfter = sql.NullTime{Time: fromNow(arg.GraceSeconds), Valid: true}
+	u.TokenVersion++
+	f.users[u.ID] = u
+	return u.DeleteAfter, nil
+}
+
+func (f *fakeQueries) CancelUserDeletion(ctx context.Context, id uuid.UUID) error {
+	if u, ok := f.users[id]; ok {
+		u.DeleteAfter = sql.NullTime{}
+		f.users[u.ID] = u
+	}
+	return nil
+}
+
+func (f *fakeQueries) IncrementTokenVersion(ctx context.Context, id uuid.UUID) error {
+	if u, ok := f.users[id]; ok {
+		u.TokenVersion++
+		f.users[u.ID] = u
+	}
+	return nil
+}
+
+func (f *fakeQueries) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	var purged int64
+	for id, u := range f.users {
+		if u.DeleteAfter.Valid && !u.DeleteAfter.Time.After(time.Now()) {
+			f.deleteUser(id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (f *fakeQueries) GetUserProfileByHandle(ctx context.Context, handle sql.NullString) (database.GetUserProfileByHandleRow, error) {
+	for _, u := range f.users {
+		if u.Handle != handle || u.DeleteAfter.Valid {
+			continue
+		}
+		row := database.GetUserProfileByHandleRow{
+			ID:          u.ID,
+			Handle:      u.Handle,
+			DisplayName: u.DisplayName,
+			Bio:         u.Bio,
+			AvatarUrl:   u.AvatarUrl,
+			CreatedAt:   u.CreatedAt,
+		}
+		for _, c := range f.chirps {
+			if c.UserID == u.ID {
+				row.ChirpCount++
+			}
+		}
+		for k := range f.follows {
+			if k.FolloweeID == u.ID {
+				row.FollowerCount++
+			}
+			if k.FollowerID == u.ID {
+				row.FollowingCount++
+			}
+		}
+		return row, nil
+	}
+	return database.GetUserProfileByHandleRow{}, sql.ErrNoRows
+}
+
+func (f *fakeQueries) UpdateUserProfile(ctx context.Context, arg database.UpdateUserProfileParams) (database.User, error) {
+	if arg.Handle.Valid {
+		for _, u := range f.users {
+			if u.Handle == arg.Handle && u.ID != arg.ID {
+				return database.User{}, &pq.Error{Code: "23505"}
+			}
+		}
+	}
+	u, ok := f.users[arg.ID]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+	if arg.Handle.Valid {
+		u.Handle = arg.Handle
+	}
+	if arg.DisplayName.Valid {
+		u.DisplayName = arg.DisplayName.String
+	}
+	if arg.Bio.Valid {
+		u.Bio = arg.Bio.String
+	}
+	if arg.AvatarUrl.Valid {
+		u.AvatarUrl = arg.AvatarUrl.String
+	}
+	u.UpdatedAt = time.Now()
+	f.users[u.ID] = u
+	return u, nil
+}
+
+func (f *fakeQueries) FollowUser(ctx context.Context, arg database.FollowUserParams) error {
+	if _, ok := f.follows[arg]; !ok {
+		f.follows[arg] = time.Now()
+	}
+	return nil
+}
+
+func (f *fakeQueries) UnfollowUser(ctx context.Context, arg database.UnfollowUserParams) error {
+	delete(f.follows, database.FollowUserParams{FollowerID: arg.FollowerID, FolloweeID: arg.FolloweeID})
+	return nil
+}
+
+func (f *fakeQueries) SetUserRole(ctx context.Context, arg database.SetUserRoleParams) (int64, error) {
+	u, ok := f.users[arg.ID]
+	if !ok {
+		return 0, nil
+	}
+	u.Role = arg.Role
+	f.users[u.ID] = u
+	return 1, nil
+}
+
+func (f *fakeQueries) SetUserToRed(ctx context.Context, id uuid.UUID) (int64, error) {
+	u, ok := f.users[id]
+	if !ok {
+		return 0, nil
+	}
+	u.IsChirpyRed = true
+	f.users[id] = u
+	return 1, nil
+}
+
+func (f *fakeQueries) CreateChirp(ctx context.Context, arg database.CreateChirpParams) (database.Chirp, error) {
+	now := time.Now()
+	c := database.Chirp{
+		ID:        uuid.New(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Body:      arg.Body,
+		UserID:    arg.UserID,
+	}
+	f.chirps[c.ID] = c
+	return c, nil
+}
+
+func (f *fakeQueries) GetChirp(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	c, ok := f.chirps[id]
+	if !ok {
+		return database.Chirp{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (f *fakeQueries) GetAllChirps(ctx context.Context) ([]database.Chirp, error) {
+	chirps := []database.Chirp{}
+	for _, c := range f.chirps {
+		chirps = append(chirps, c)
+	}
+	return chirps, nil
+}
+
+func (f *fakeQueries) GetChirpsByUser(ctx context.Context, userID uuid.UUID) ([]database.Chirp, error) {
+	chirps := []database.Chirp{}
+	for _, c := range f.chirps {
+		if c.UserID == userID {
+			chirps = append(chirps, c)
+		}
+	}
+	return chirps, nil
+}
+
+func (f *fakeQueries) DeleteChirp(ctx context.Context, id uuid.UUID) error {
+	delete(f.chirps, id)
+	for k, v := range f.attachments {
+		if v.ChirpID.Valid && v.ChirpID.UUID == id {
+			v.ChirpID = uuid.NullUUID{}
+			v.Position = sql.NullInt32{}
+			f.attachments[k] = v
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) CreateAttachment(ctx context.Context, arg database.CreateAttachmentParams) (database.Attachment, error) {
+	a := database.Attachment{
+		ID:                   arg.ID,
+		UserID:               arg.UserID,
+		ContentType:          arg.ContentType,
+		ThumbnailContentType: arg.ThumbnailContentType,
+		Width:                arg.Width,
+		Height:               arg.Height,
+		SizeBytes:            arg.SizeBytes,
+		CreatedAt:            time.Now(),
+	}
+	f.attachments[a.ID] = a
+	return a, nil
+}
+
+func (f *fakeQueries) GetAttachment(ctx context.Context, id uuid.UUID) (database.Attachment, error) {
+	a, ok := f.attachments[id]
+	if !ok {
+		return database.Attachment{}, sql.ErrNoRows
+	}
+	return a, nil
+}
+
+func (f *fakeQueries) AttachToChirp(ctx context.Context, arg database.AttachToChirpParams) (int64, error) {
+	a, ok := f.attachments[arg.ID]
+	if !ok || a.UserID != arg.UserID || a.ChirpID.Valid {
+		return 0, nil
+	}
+	for _, other := range f.attachments {
+		if other.ChirpID == arg.ChirpID && other.Position == arg.Position {
+			return 0, &pq.Error{Code: "23505"}
+		}
+	}
+	a.ChirpID = arg.ChirpID
+	a.Position = arg.Position
+	f.attachments[a.ID] = a
+	return 1, nil
+}
+
+func (f *fakeQueries) GetAttachmentsForChirps(ctx context.Context, chirpIds []uuid.UUID) ([]database.Attachment, error) {
+	attachments := []database.Attachment{}
+	for _, a := range f.attachments {
+		for _, id := range chirpIds {
+			if a.ChirpID.Valid && a.ChirpID.UUID == id {
+				attachments = append(attachments, a)
+			}
+		}
+	}
+	sort.Slice(attachments, func(i, j int) bool {
+		if attachments[i].ChirpID.UUID != attachments[j].ChirpID.UUID {
+			return attachments[i].ChirpID.UUID.String() < attachments[j].ChirpID.UUID.String()
+		}
+		return attachments[i].Position.Int32 < attachments[j].Position.Int32
+	})
+	return attachments, nil
+}
+
+func (f *fakeQueries) DeleteUnattachedAttachments(ctx context.Context, maxAgeSeconds float64) ([]uuid.UUID, error) {
+	createdAt := fromNow(-maxAgeSeconds)
+	ids := []uuid.UUID{}
+	for k, a := range f.attachments {
+		if !a.ChirpID.Valid && (!a.UserID.Valid || a.CreatedAt.Before(createdAt)) {
+			delete(f.attachments, k)
+			ids = append(ids, k)
+		}
+	}
+	return ids, nil
+}
+
+func (f *fakeQueries) CreateRefreshToken(ctx context.Context, arg database.CreateRefreshTokenParams) (database.RefreshToken, error) {
+	now := time.Now()
+	t := database.RefreshToken{
+		TokenHash:  arg.TokenHash,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		UserID:     arg.UserID,
+		ExpiresAt:  fromNow(arg.TtlSeconds),
+		FamilyID:   arg.FamilyID,
+		UserAgent:  arg.UserAgent,
+		IpAddress:  arg.IpAddress,
+		LastUsedAt: now,
+	}
+	f.refreshTokens[t.TokenHash] = t
+	return t, nil
+}
+
+func (f *fakeQueries) GetUserFromRefreshToken(ctx context.Context, tokenHash string) (database.GetUserFromRefreshTokenRow, error) {
+	t, ok := f.refreshTokens[tokenHash]
+	if !ok || t.RevokedAt.Valid || t.ExpiresAt.Before(time.Now()) {
+		return database.GetUserFromRefreshTokenRow{}, sql.ErrNoRows
+	}
+	u := f.users[t.UserID]
+	return database.GetUserFromRefreshTokenRow{
+		ID:             u.ID,
+		CreatedAt:      u.CreatedAt,
+		UpdatedAt:      u.UpdatedAt,
+		Email:          u.Email,
+		HashedPassword: u.HashedPassword,
+		IsChirpyRed:    u.IsChirpyRed,
+		TokenVersion:   u.TokenVersion,
+		TokenHash:      t.TokenHash,
+		CreatedAt_2:    t.CreatedAt,
+		UpdatedAt_2:    t.UpdatedAt,
+		UserID:         t.UserID,
+		ExpiresAt:      t.ExpiresAt,
+		RevokedAt:      t.RevokedAt,
+		FamilyID:       t.FamilyID,
+	}, nil
+}
+
+func (f *fakeQueries) GetRefreshToken(ctx context.Context, tokenHash string) (database.RefreshToken, error) {
+	t, ok := f.refreshTokens[tokenHash]
+	if !ok {
+		return database.RefreshToken{}, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (f *fakeQueries) GetSessionsForUser(ctx context.Context, userID uuid.UUID) ([]database.GetSessionsForUserRow, error) {
+	signedIn := map[uuid.UUID]time.Time{}
+	for _, t := range f.refreshTokens {
+		if first, ok := signedIn[t.FamilyID]; !ok || t.CreatedAt.Before(first) {
+			signedIn[t.FamilyID] = t.CreatedAt
+		}
+	}
+	sessions := []database.GetSessionsForUserRow{}
+	for _, t := range f.refreshTokens {
+		if t.UserID != userID || t.RevokedAt.Valid || t.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		sessions = append(sessions, database.GetSessionsForUserRow{
+			FamilyID:   t.FamilyID,
+			UserAgent:  t.UserAgent,
+			IpAddress:  t.IpAddress,
+			LastUsedAt: t.LastUsedAt,
+			ExpiresAt:  t.ExpiresAt,
+			SignedInAt: signedIn[t.FamilyID],
+		})
+	}
+	return sessions, nil
+}
+
+func (f *fakeQueries) RevokeSessionForUser(ctx context.Context, arg database.RevokeSessionForUserParams) (int64, error) {
+	var revoked int64
+	for hash, t := range f.refreshTokens {
+		if t.FamilyID == arg.FamilyID && t.UserID == arg.UserID && !t.RevokedAt.Valid {
+			t.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			f.refreshTokens[hash] = t
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (f *fakeQueries) RevokeAllRefreshTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	for hash, t := range f.refreshTokens {
+		if t.UserID == userID && !t.RevokedAt.Valid {
+			t.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			f.refreshTokens[hash] = t
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) RevokeOtherRefreshTokensForUser(ctx context.Context, arg database.RevokeOtherRefreshTokensForUserParams) error {
+	for hash, t := range f.refreshTokens {
+		if t.UserID == arg.UserID && t.FamilyID != arg.FamilyID && !t.RevokedAt.Valid {
+			t.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			f.refreshTokens[hash] = t
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	for token, t := range f.refreshTokens {
+		if t.FamilyID == familyID && !t.RevokedAt.Valid {
+			t.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			f.refreshTokens[token] = t
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) IsSessionActive(ctx context.Context, familyID uuid.UUID) (bool, error) {
+	for _, t := range f.refreshTokens {
+		if t.FamilyID == familyID && !t.RevokedAt.Valid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeQueries) RevokeRefreshToken(ctx context.Context, tokenHash string) (int64, error) {
+	t, ok := f.refreshTokens[tokenHash]
+	if !ok || t.RevokedAt.Valid {
+		return 0, nil
+	}
+	t.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	f.refreshTokens[tokenHash] = t
+	return 1, nil
+}
+
+func (f *fakeQueries) CreatePasswordResetToken(ctx context.Context, arg database.CreatePasswordResetTokenParams) error {
+	f.resetTokens[arg.TokenHash] = database.PasswordResetToken{
+		TokenHash: arg.TokenHash,
+		UserID:    arg.UserID,
+		CreatedAt: time.Now(),
+		ExpiresAt: fromNow(arg.TtlSeconds),
+	}
+	return nil
+}
+
+func (f *fakeQueries) GetPasswordResetToken(ctx context.Context, tokenHash string) (database.PasswordResetToken, error) {
+	t, ok := f.resetTokens[tokenHash]
+	if !ok || t.UsedAt.Valid || t.ExpiresAt.Before(time.Now()) {
+		return database.PasswordResetToken{}, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (f *fakeQueries) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (int64, error) {
+	if _, err := f.GetPasswordResetToken(ctx, tokenHash); err != nil {
+		return 0, nil
+	}
+	t := f.resetTokens[tokenHash]
+	t.UsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	f.resetTokens[tokenHash] = t
+	return 1, nil
+}
+
+func (f *fakeQueries) InvalidatePasswordResetTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	for hash, t := range f.resetTokens {
+		if t.UserID == userID && !t.UsedAt.Valid {
+			t.UsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			f.resetTokens[hash] = t
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) CreatePendingTOTPCredential(ctx context.Context, arg database.CreatePendingTOTPCredentialParams) (int64, error) {
+	if c, ok := f.totp[arg.UserID]; ok && c.ConfirmedAt.Valid {
+		return 0, nil
+	}
+	f.totp[arg.UserID] = database.TotpCredential{UserID: arg.UserID, Secret: arg.Secret, CreatedAt: time.Now()}
+	return 1, nil
+}
+
+func (f *fakeQueries) GetTOTPCredential(ctx context.Context, userID uuid.UUID) (database.TotpCredential, error) {
+	c, ok := f.totp[userID]
+	if !ok {
+		return database.TotpCredential{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (f *fakeQueries) ConfirmTOTPCredential(ctx context.Context, arg database.ConfirmTOTPCredentialParams) (int64, error) {
+	c, ok := f.totp[arg.UserID]
+	if !ok || c.ConfirmedAt.Valid {
+		return 0, nil
+	}
+	c.ConfirmedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	c.LastUsedStep = arg.LastUsedStep
+	f.totp[arg.UserID] = c
+	return 1, nil
+}
+
+func (f *fakeQueries) UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error) {
+	c, ok := f.totp[arg.UserID]
+	if !ok || c.LastUsedStep >= arg.LastUsedStep {
+		return 0, nil
+	}
+	c.LastUsedStep = arg.LastUsedStep
+	f.totp[arg.UserID] = c
+	return 1, nil
+}
+
+func (f *fakeQueries) DeleteTOTPCredential(ctx context.Context, userID uuid.UUID) error {
+	delete(f.totp, userID)
+	return nil
+}
+
+func (f *fakeQueries) CreateRecoveryCode(ctx context.Context, arg database.CreateRecoveryCodeParams) error {
+	f.recoveryCodes[arg.CodeHash] = database.RecoveryCode{CodeHash: arg.CodeHash, UserID: arg.UserID, CreatedAt: time.Now()}
+	return nil
+}
+
+func (f *fakeQueries) UseRecoveryCode(ctx context.Context, arg database.UseRecoveryCodeParams) (int64, error) {
+	c, ok := f.recoveryCodes[arg.CodeHash]
+	if !ok || c.UserID != arg.UserID || c.UsedAt.Valid {
+		return 0, nil
+	}
+	c.UsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	f.recoveryCodes[arg.CodeHash] = c
+	return 1, nil
+}
+
+func (f *fakeQueries) DeleteRecoveryCodesForUser(ctx context.Context, userID uuid.UUID) error {
+	for hash, c := range f.recoveryCodes {
+		if c.UserID == userID {
+			delete(f.recoveryCodes, hash)
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) CreateWebAuthnCredential(ctx context.Context, arg database.CreateWebAuthnCredentialParams) (database.WebauthnCredential, error) {
+	if _, ok := f.passkeys[string(arg.ID)]; ok {
+		return database.WebauthnCredential{}, &pq.Error{Code: "23505"}
+	}
+	c := database.WebauthnCredential{
+		ID:        arg.ID,
+		UserID:    arg.UserID,
+		PublicKey: arg.PublicKey,
+		SignCount: arg.SignCount,
+		Name:      arg.Name,
+		CreatedAt: time.Now(),
+	}
+	f.passkeys[string(arg.ID)] = c
+	return c, nil
+}
+
+func (f *fakeQueries) GetWebAuthnCredential(ctx context.Context, id []byte) (database.WebauthnCredential, error) {
+	c, ok := f.passkeys[string(id)]
+	if !ok {
+		return database.WebauthnCredential{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (f *fakeQueries) GetWebAuthnCredentialsForUser(ctx context.Context, userID uuid.UUID) ([]database.WebauthnCredential, error) {
+	credentials := []database.WebauthnCredential{}
+	for _, c := range f.passkeys {
+		if c.UserID == userID {
+			credentials = append(credentials, c)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].CreatedAt.Before(credentials[j].CreatedAt) })
+	return credentials, nil
+}
+
+func (f *fakeQueries) UpdateWebAuthnSignCount(ctx context.Context, arg database.UpdateWebAuthnSignCountParams) (int64, error) {
+	c, ok := f.passkeys[string(arg.ID)]
+	if !ok || c.SignCount != arg.PreviousSignCount {
+		return 0, nil
+	}
+	c.SignCount = arg.SignCount
+	c.LastUsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	f.passkeys[string(arg.ID)] = c
+	return 1, nil
+}
+
+func (f *fakeQueries) DeleteWebAuthnCredentialForUser(ctx context.Context, arg database.DeleteWebAuthnCredentialForUserParams) (int64, error) {
+	c, ok := f.passkeys[string(arg.ID)]
+	if !ok || c.UserID != arg.UserID {
+		return 0, nil
+	}
+	delete(f.passkeys, string(arg.ID))
+	return 1, nil
+}
+
+func (f *fakeQueries) DeleteWebAuthnCredentialsForUser(ctx context.Context, userID uuid.UUID) error {
+	for id, c := range f.passkeys {
+		if c.UserID == userID {
+			delete(f.passkeys, id)
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) CreateWebAuthnChallenge(ctx context.Context, arg database.CreateWebAuthnChallengeParams) error {
+	f.challenges[arg.Challenge] = database.WebauthnChallenge{
+		Challenge: arg.Challenge,
+		Ceremony:  arg.Ceremony,
+		UserID:    arg.UserID,
+		ExpiresAt: fromNow(arg.TtlSeconds),
+	}
+	return nil
+}
+
+func (f *fakeQueries) ConsumeWebAuthnChallenge(ctx context.Context, arg database.ConsumeWebAuthnChallengeParams) (database.WebauthnChallenge, error) {
+	c, ok := f.challenges[arg.Challenge]
+	if !ok || c.Ceremony != arg.Ceremony || !c.ExpiresAt.After(time.Now()) {
+		return database.WebauthnChallenge{}, sql.ErrNoRows
+	}
+	delete(f.challenges, arg.Challenge)
+	return c, nil
+}
+
+func (f *fakeQueries) DeleteExpiredWebAuthnChallenges(ctx context.Context) error {
+	for k, c := range f.challenges {
+		if !c.ExpiresAt.After(time.Now()) {
+			delete(f.challenges, k)
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) CreateOAuthClient(ctx context.Context, arg database.CreateOAuthClientParams) (database.OauthClient, error) {
+	now := time.Now()
+	c := database.OauthClient{
+		ID:           uuid.New(),
+		UserID:       arg.UserID,
+		Name:         arg.Name,
+		RedirectUris: arg.RedirectUris,
+		SecretHash:   arg.SecretHash,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	f.oauthClients[c.ID] = c
+	return c, nil
+}
+
+func (f *fakeQueries) GetOAuthClient(ctx context.Context, id uuid.UUID) (database.OauthClient, error) {
+	c, ok := f.oauthClients[id]
+	if !ok {
+		return database.OauthClient{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (f *fakeQueries) GetOAuthClientsForUser(ctx context.Context, userID uuid.UUID) ([]database.OauthClient, error) {
+	var clients []database.OauthClient
+	for _, c := range f.oauthClients {
+		if c.UserID == userID {
+			clients = append(clients, c)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].CreatedAt.Before(clients[j].CreatedAt) })
+	return clients, nil
+}
+
+func (f *fakeQueries) DeleteOAuthClientForUser(ctx context.Context, arg database.DeleteOAuthClientForUserParams) (int64, error) {
+	c, ok := f.oauthClients[arg.ID]
+	if !ok || c.UserID != arg.UserID {
+		return 0, nil
+	}
+	delete(f.oauthClients, arg.ID)
+	for k := range f.oauthGrants {
+		if k.ClientID == arg.ID {
+			delete(f.oauthGrants, k)
+		}
+	}
+	return 1, nil
+}
+
+func (f *fakeQueries) CreateOAuthAuthorizationCode(ctx context.Context, arg database.CreateOAuthAuthorizationCodeParams) error {
+	f.oauthCodes[arg.CodeHash] = database.OauthAuthorizationCode{
+		CodeHash:      arg.CodeHash,
+		ClientID:      arg.ClientID,
+		UserID:        arg.UserID,
+		RedirectUri:   arg.RedirectUri,
+		Scopes:        arg.Scopes,
+		CodeChallenge: arg.CodeChallenge,
+		CreatedAt:     time.Now(),
+		ExpiresAt:     fromNow(arg.TtlSeconds),
+	}
+	return nil
+}
+
+func (f *fakeQueries) ConsumeOAuthAuthorizationCode(ctx context.Context, codeHash string) (database.OauthAuthorizationCode, error) {
+	c, ok := f.oauthCodes[codeHash]
+	if !ok || !c.ExpiresAt.After(time.Now()) {
+		return database.OauthAuthorizationCode{}, sql.ErrNoRows
+	}
+	delete(f.oauthCodes, codeHash)
+	return c, nil
+}
+
+func (f *fakeQueries) DeleteExpiredOAuthAuthorizationCodes(ctx context.Context) error {
+	for k, c := range f.oauthCodes {
+		if !c.ExpiresAt.After(time.Now()) {
+			delete(f.oauthCodes, k)
+		}
+	}
+	return nil
+}
+
+func (f *fakeQueries) UpsertOAuthGrant(ctx context.Context, arg database.UpsertOAuthGrantParams) error {
+	key := database.GetOAuthGrantParams{UserID: arg.UserID, ClientID: arg.ClientID}
+	now := time.Now()
+	g, ok := f.oauthGrants[key]
+	if !ok {
+		g = database.OauthGrant{UserID: arg.UserID, ClientID: arg.ClientID, CreatedAt: now}
+	}
+	g.Scopes = arg.Scopes
+	g.UpdatedAt = now
+	f.oauthGrants[key] = g
+	return nil
+}
+
+func (f *fakeQueries) GetOAuthGrant(ctx context.Context, arg database.GetOAuthGrantParams) (database.OauthGrant, error) {
+	g, ok := f.oauthGrants[arg]
+	if !ok {
+		return database.OauthGrant{}, sql.ErrNoRows
+	}
+	return g, nil
+}
+
+func (f *fakeQueries) GetOAuthGrantsForUser(ctx context.Context, userID uuid.UUID) ([]database.GetOAuthGrantsForUserRow, error) {
+	var rows []database.GetOAuthGrantsForUserRow
+	for _, g := range f.oauthGrants {
+		if g.UserID == userID {
+			rows = append(rows, database.GetOAuthGrantsForUserRow{
+				UserID:     g.UserID,
+				ClientID:   g.ClientID,
+				Scopes:     g.Scopes,
+				CreatedAt:  g.CreatedAt,
+				UpdatedAt:  g.UpdatedAt,
+				ClientName: f.oauthClients[g.ClientID].Name,
+			})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].CreatedAt.Before(rows[j].CreatedAt) })
+	return rows, nil
+}
+
+func (f *fakeQueries) DeleteOAuthGrant(ctx context.Context, arg database.DeleteOAuthGrantParams) (int64, error) {
+	key := database.GetOAuthGrantParams{UserID: arg.UserID, ClientID: arg.ClientID}
+	if _, ok := f.oauthGrants[key]; !ok {
+		return 0, nil
+	}
+	delete(f.oauthGrants, key)
+	return 1, nil
+}
+
+func (f *fakeQueries) CreatePersonalAccessToken(ctx context.Context, arg database.CreatePersonalAccessTokenParams) (database.PersonalAccessToken, error) {
+	t := database.PersonalAccessToken{
+		ID:        uuid.New(),
+		UserID:    arg.UserID,
+		Name:      arg.Name,
+		TokenHash: arg.TokenHash,
+		Scopes:    arg.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if arg.TtlSeconds.Valid {
+		t.ExpiresAt = sql.NullTime{Time: fromNow(arg.TtlSeconds.Float64), Valid: true}
+	}
+	f.patTokens[t.ID] = t
+	return t, nil
+}
+
+func (f *fakeQueries) GetPersonalAccessToken(ctx context.Context, tokenHash string) (database.PersonalAccessToken, error) {
+	for _, t := range f.patTokens {
+		if t.TokenHash == tokenHash && (!t.ExpiresAt.Valid || t.ExpiresAt.Time.After(time.Now())) {
+			return t, nil
+		}
+	}
+	return database.PersonalAccessToken{}, sql.ErrNoRows
+}
+
+func (f *fakeQueries) GetPersonalAccessTokensForUser(ctx context.Context, userID uuid.UUID) ([]database.PersonalAccessToken, error) {
+	var tokens []database.PersonalAccessToken
+	for _, t := range f.patTokens {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (f *fakeQueries) TouchPersonalAccessToken(ctx context.Context, id uuid.UUID) error {
+	if t, ok := f.patTokens[id]; ok {
+		t.LastUsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		f.patTokens[id] = t
+	}
+	return nil
+}
+
+func (f *fakeQueries) DeletePersonalAccessTokenForUser(ctx context.Context, arg database.DeletePersonalAccessTokenForUserParams) (int64, error) {
+	t, ok := f.patTokens[arg.ID]
+	if !ok || t.UserID != arg.UserID {
+		return 0, nil
+	}
+	delete(f.patTokens, arg.ID)
+	return 1, nil
+}
+
+func (f *fakeQueries) DeletePersonalAccessTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	for id, t := range f.patTokens {
+		if t.UserID == userID {
+			delete(f.patTokens, id)
+		}
+	}
+	return nil
+}
+
+// setupTestAPI points the global apiCfg at a fresh fake database.
+func setupTestAPI(t *testing.T) *fakeQueries {
+	t.Helper()
+	db := newFakeQueries()
+	tokenKeys, err := loadTokenKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("Failed to load token keys: %v", err)
+	}
+	apiCfg = apiConfig{
+		dbQueries:      db,
+		jwtConfig:      auth.JWTConfig{Keys: tokenKeys, Issuer: "chirpy"},
+		polkaKey:       "test-polka-key",
+		passwordPolicy: auth.DefaultPasswordPolicy(),
+		mailer:         &mail.MemoryOutbox{},
+		publicURL:      "http://chirpy.test",
+		relyingParty:   auth.RelyingParty{ID: "chirpy.test", Name: "Chirpy", Origins: []string{"http://chirpy.test"}},
+		mediaStore:     storage.LocalStore{Dir: t.TempDir()},
+
+		loginAccountThrottle:  throttle.NewTracker(loginAccountPolicy),
+		loginIPThrottle:       throttle.NewTracker(loginIPPolicy),
+		verificationThrottle:  throttle.NewTracker(verificationResendPolicy),
+		passwordResetThrottle: throttle.NewTracker(passwordResetPolicy),
+	}
+	return db
+}
+
+// sentMail returns the messages sent through the test outbox.
+func sentMail() []mail.Message {
+	return apiCfg.mailer.(*mail.MemoryOutbox).Messages()
+}
+
+// addTestUser stores a user with the given credentials and returns it.
+func addTestUser(t *testing.T, db *fakeQueries, email, password string) database.User {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	user, err := db.CreateUser(context.Background(), database.CreateUserParams{
+		Email:          email,
+		HashedPassword: hash,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user
+}
+
+func bearer(t *testing.T, userID uuid.UUID) string {
+	t.Helper()
+	token, err := auth.MakeJWT(auth.Claims{Type: auth.TokenTypeAccess, UserID: userID}, apiCfg.jwtConfig, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create JWT: %v", err)
+	}
+	return "Bearer " + token
+}
+
+type statusCase struct {
+	name       string
+	method     string
+	target     string
+	pathValues map[string]string
+	authHeader string
+	body       string
+	handler    http.HandlerFunc
+	wantStatus int
+}
+
+func runStatusCases(t *testing.T, cases []statusCase) {
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			for k, v := range tc.pathValues {
+				req.SetPathValue(k, v)
+			}
+			if tc.authHeader != "" {
+				req.Header.Set("Authorization", tc.authHeader)
+			}
+			rec := httptest.NewRecorder()
+			tc.handler(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestChirpHandlersStatus(t *testing.T) {
+	db := setupTestAPI(t)
+	owner := addTestUser(t, db, "owner@example.com", "correct horse battery staple")
+	other := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+	chirp, _ := db.CreateChirp(context.Background(), database.CreateChirpParams{Body: "hello", UserID: owner.ID})
+	missing := uuid.New().String()
+
+	runStatusCases(t, []statusCase{
+		{name: "create without token", method: "POST", target: "/api/chirps", body: `{"body":"hi"}`, handler: requireAuth(handlerChirps), wantStatus: 401},
+		{name: "create with bad json", method: "POST", target: "/api/chirps", authHeader: bearer(t, owner.ID), body: `{`, handler: requireAuth(handlerChirps), wantStatus: 400},
+		{name: "create too long", method: "POST", target: "/api/chirps", authHeader: bearer(t, owner.ID), body: `{"body":"` + strings.Repeat("a", 141) + `"}`, handler: requireAuth(handlerChirps), wantStatus: 400},
+		{name: "create profane", method: "POST", target: "/api/chirps", authHeader: bearer(t, owner.ID), body: `{"body":"what a kerfuffle"}`, handler: requireAuth(handlerChirps), wantStatus: 422},
+		{name: "create", method: "POST", target: "/api/chirps", authHeader: bearer(t, owner.ID), body: `{"body":"hi"}`, handler: requireAuth(handlerChirps), wantStatus: 201},
+		{name: "list", method: "GET", target: "/api/chirps", handler: handlerGetChirps, wantStatus: 200},
+		{name: "list by author", method: "GET", target: "/api/chirps?author_id=" + owner.ID.String(), handler: handlerGetChirps, wantStatus: 200},
+		{name: "list by invalid author", method: "GET", target: "/api/chirps?author_id=nope", handler: handlerGetChirps, wantStatus: 400},
+		{name: "get", method: "GET", target: "/api/chirps/" + chirp.ID.String(), pathValues: map[string]string{"chirpID": chirp.ID.String()}, handler: handlerGetChirp, wantStatus: 200},
+		{name: "get invalid id", method: "GET", target: "/api/chirps/nope", pathValues: map[string]string{"chirpID": "nope"}, handler: handlerGetChirp, wantStatus: 400},
+		{name: "get missing", method: "GET", target: "/api/chirps/" + missing, pathValues: map[string]string{"chirpID": missing}, handler: handlerGetChirp, wantStatus: 404},
+		{name: "delete without token", method: "DELETE", target: "/api/chirps/" + chirp.ID.String(), pathValues: map[string]string{"chirpID": chirp.ID.String()}, handler: requireAuth(handlerDeleteChirp), wantStatus: 401},
+		{name: "delete invalid id", method: "DELETE", target: "/api/chirps/nope", pathValues: map[string]string{"chirpID": "nope"}, authHeader: bearer(t, owner.ID), handler: requireAuth(handlerDeleteChirp), wantStatus: 400},
+		{name: "delete missing", method: "DELETE", target: "/api/chirps/" + missing, pathValues: map[string]string{"chirpID": missing}, authHeader: bearer(t, owner.ID), handler: requireAuth(handlerDeleteChirp), wantStatus: 404},
+		{name: "delete not owner", method: "DELETE", target: "/api/chirps/" + chirp.ID.String(), pathValues: map[string]string{"chirpID": chirp.ID.String()}, authHeader: bearer(t, other.ID), handler: requireAuth(handlerDeleteChirp), wantStatus: 403},
+		{name: "delete", method: "DELETE", target: "/api/chirps/" + chirp.ID.String(), pathValues: map[string]string{"chirpID": chirp.ID.String()}, authHeader: bearer(t, owner.ID), handler: requireAuth(handlerDeleteChirp), wantStatus: 204},
+	})
+}
+
+func TestUserHandlersStatus(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "taken@example.com", "correct horse battery staple")
+	addTestUser(t, db, "also-taken@example.com", "correct horse battery staple")
+
+	runStatusCases(t, []statusCase{
+		{name: "signup bad json", method: "POST", target: "/api/users", body: `{`, handler: handlerAddUser, wantStatus: 400},
+		{name: "signup oversized body", method: "POST", target: "/api/users", body: `{"email":"big@example.com","password":"` + strings.Repeat("a", maxCredentialsBodyBytes) + `"}`, handler: handlerAddUser, wantStatus: 400},
+		{name: "signup", method: "POST", target: "/api/users", body: `{"email":"new@example.com","password":"correct horse battery staple"}`, handler: handlerAddUser, wantStatus: 202},
+		{name: "signup invalid email", method: "POST", target: "/api/users", body: `{"email":"not an email","password":"correct horse battery staple"}`, handler: handlerAddUser, wantStatus: 400},
+		{name: "signup email with display name", method: "POST", target: "/api/users", body: `{"email":"Victim <victim@example.com>","password":"correct horse battery staple"}`, handler: handlerAddUser, wantStatus: 400},
+		{name: "signup weak password", method: "POST", target: "/api/users", body: `{"email":"weak@example.com","password":"password1"}`, handler: handlerAddUser, wantStatus: 400},
+		{name: "signup empty password", method: "POST", target: "/api/users", body: `{"email":"empty@example.com","password":""}`, handler: handlerAddUser, wantStatus: 400},
+		{name: "signup duplicate email", method: "POST", target: "/api/users", body: `{"email":"taken@example.com","password":"correct horse battery staple"}`, handler: handlerAddUser, wantStatus: 202},
+		{name: "login bad json", method: "POST", target: "/api/login", body: `{`, handler: handlerLogin, wantStatus: 400},
+		{name: "login wrong password", method: "POST", target: "/api/login", body: `{"email":"taken@example.com","password":"wrong"}`, handler: handlerLogin, wantStatus: 401},
+		{name: "login unknown email", method: "POST", target: "/api/login", body: `{"email":"nobody@example.com","password":"wrong"}`, handler: handlerLogin, wantStatus: 401},
+		{name: "login", method: "POST", target: "/api/login", body: `{"email":"taken@example.com","password":"correct horse battery staple"}`, handler: handlerLogin, wantStatus: 200},
+		{name: "update without token", method: "PUT", target: "/api/users", body: `{"email":"x@example.com","password":"pw"}`, handler: requireAuth(handlerUpdateUserLogin), wantStatus: 401},
+		{name: "update without current password", method: "PUT", target: "/api/users", authHeader: bearer(t, user.ID), body: `{"email":"x@example.com"}`, handler: requireAuth(handlerUpdateUserLogin), wantStatus: 403},
+		{name: "update bad json", method: "PUT", target: "/api/users", authHeader: bearer(t, user.ID), body: `{`, handler: requireAuth(handlerUpdateUserLogin), wantStatus: 400},
+		{name: "update weak password", method: "PUT", target: "/api/users", authHeader: bearer(t, user.ID), body: `{"password":"qwerty123","current_password":"correct horse battery staple"}`, handler: requireAuth(handlerUpdateUserLogin), wantStatus: 400},
+		{name: "update to taken email", method: "PUT", target: "/api/users", authHeader: bearer(t, user.ID), body: `{"email":"also-taken@example.com","current_password":"correct horse battery staple"}`, handler: requireAuth(handlerUpdateUserLogin), wantStatus: 409},
+		{name: "update", method: "PUT", target: "/api/users", authHeader: bearer(t, user.ID), body: `{"email":"renamed@example.com","current_password":"correct horse battery staple"}`, handler: requireAuth(handlerUpdateUserLogin), wantStatus: 200},
+	})
+}
+
+func TestRefreshTokenHandlersStatus(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	for _, token := range []string{"refresh-token", "revoke-token"} {
+		db.CreateRefreshToken(context.Background(), database.CreateRefreshTokenParams{
+			TokenHash:  auth.HashRefreshToken(token),
+			UserID:     user.ID,
+			TtlSeconds: time.Hour.Seconds(),
+			FamilyID:   uuid.New(),
+		})
+	}
+
+	runStatusCases(t, []statusCase{
+		{name: "refresh without token", method: "POST", target: "/api/refresh", handler: handlerRefresh, wantStatus: 401},
+		{name: "refresh unknown token", method: "POST", target: "/api/refresh", authHeader: "Bearer unknown", handler: handlerRefresh, wantStatus: 401},
+		{name: "refresh", method: "POST", target: "/api/refresh", authHeader: "Bearer refresh-token", handler: handlerRefresh, wantStatus: 200},
+		{name: "refresh rotated token", method: "POST", target: "/api/refresh", authHeader: "Bearer refresh-token", handler: handlerRefresh, wantStatus: 401},
+		{name: "revoke without token", method: "POST", target: "/api/revoke", handler: handlerRevoke, wantStatus: 401},
+		{name: "revoke unknown token", method: "POST", target: "/api/revoke", authHeader: "Bearer unknown", handler: handlerRevoke, wantStatus: 401},
+		{name: "revoke", method: "POST", target: "/api/revoke", authHeader: "Bearer revoke-token", handler: handlerRevoke, wantStatus: 204},
+		{name: "revoke twice", method: "POST", target: "/api/revoke", authHeader: "Bearer revoke-token", handler: handlerRevoke, wantStatus: 401},
+		{name: "refresh revoked token", method: "POST", target: "/api/refresh", authHeader: "Bearer revoke-token", handler: handlerRefresh, wantStatus: 401},
+	})
+}
+
+func TestPolkaWebhookStatus(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	upgrade := func(id uuid.UUID) string {
+		return `{"event":"user.upgraded","data":{"user_id":"` + id.String() + `"}}`
+	}
+
+	runStatusCases(t, []statusCase{
+		{name: "missing api key", method: "POST", target: "/api/polka/webhooks", body: upgrade(user.ID), handler: handlerSetRed, wantStatus: 401},
+		{name: "wrong api key", method: "POST", target: "/api/polka/webhooks", authHeader: "ApiKey wrong", body: upgrade(user.ID), handler: handlerSetRed, wantStatus: 401},
+		{name: "bad json", method: "POST", target: "/api/polka/webhooks", authHeader: "ApiKey test-polka-key", body: `{`, handler: handlerSetRed, wantStatus: 400},
+		{name: "ignored event", method: "POST", target: "/api/polka/webhooks", authHeader: "ApiKey test-polka-key", body: `{"event":"user.payment_failed"}`, handler: handlerSetRed, wantStatus: 204},
+		{name: "unknown user", method: "POST", target: "/api/polka/webhooks", authHeader: "ApiKey test-polka-key", body: upgrade(uuid.New()), handler: handlerSetRed, wantStatus: 404},
+		{name: "upgrade", method: "POST", target: "/api/polka/webhooks", authHeader: "ApiKey test-polka-key", body: upgrade(user.ID), handler: handlerSetRed, wantStatus: 204},
+	})
+}
+
+func TestLoginRehashesLegacyPassword(t *testing.T) {
+	db := setupTestAPI(t)
+	legacy, err := auth.BcryptHasher{Cost: 4}.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	user, _ := db.CreateUser(context.Background(), database.CreateUserParams{
+		Email:          "legacy@example.com",
+		HashedPassword: legacy,
+	})
+
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"legacy@example.com","password":"correct horse battery staple"}`))
+	rec := httptest.NewRecorder()
+	handlerLogin(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	stored := db.users[user.ID].HashedPassword
+	if !strings.HasPrefix(stored, "$argon2id$") {
+		t.Errorf("Expected password to be rehashed with argon2id, got: %s", stored)
+	}
+	if err := auth.CheckPasswordHash("correct horse battery staple", stored); err != nil {
+		t.Errorf("Expected rehashed password to verify, got: %v", err)
+	}
+}
+
+func login(email, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+	rec := httptest.NewRecorder()
+	handlerLogin(rec, req)
+	return rec
+}
+
+func TestLoginLockout(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "victim@example.com", "correct horse battery staple")
+
+	for _, email := range []string{"victim@example.com", "nobody@example.com"} {
+		var rec *httptest.ResponseRecorder
+		for i := 0; i < loginAccountPolicy.FreeAttempts; i++ {
+			rec = login(email, "wrong password")
+			if rec.Code != 401 {
+				t.Fatalf("%s attempt %d: expected status 401, got %d", email, i+1, rec.Code)
+			}
+		}
+		login(email, "wrong password")
+
+		// Locked out regardless of whether the email is registered.
+		rec = login(email, "correct horse battery staple")
+		if rec.Code != 429 {
+			t.Fatalf("%s: expected status 429, got %d", email, rec.Code)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected Retry-After header", email)
+		}
+	}
+
+	moderator := addTestUser(t, db, "moderator@example.com", "correct horse battery staple")
+	db.SetUserRole(context.Background(), database.SetUserRoleParams{Role: roleModerator, ID: moderator.ID})
+	unlock := func(authHeader, userID string) int {
+		req := httptest.NewRequest("POST", "/admin/users/"+userID+"/unlock", nil)
+		req.SetPathValue("userID", userID)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		rec := httptest.NewRecorder()
+		requireRole(roleModerator, handlerUnlockUser)(rec, req)
+		return rec.Code
+	}
+	if code := unlock("", user.ID.String()); code != 401 {
+		t.Errorf("Expected unlock without token to return 401, got %d", code)
+	}
+	if code := unlock(bearer(t, user.ID), user.ID.String()); code != 403 {
+		t.Errorf("Expected unlock by a user to return 403, got %d", code)
+	}
+	if code := unlock(bearer(t, moderator.ID), uuid.New().String()); code != 404 {
+		t.Errorf("Expected unlock of unknown user to return 404, got %d", code)
+	}
+	if code := unlock(bearer(t, moderator.ID), user.ID.String()); code != 204 {
+		t.Fatalf("Expected unlock to return 204, got %d", code)
+	}
+
+	if rec := login("victim@example.com", "correct horse battery staple"); rec.Code != 200 {
+		t.Errorf("Expected login after unlock to succeed, got %d", rec.Code)
+	}
+}
+
+func TestLoginIPThrottle(t *testing.T) {
+	setupTestAPI(t)
+	apiCfg.loginIPThrottle = throttle.NewTracker(throttle.Policy{
+		FreeAttempts: 2,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	})
+
+	login("a@example.com", "wrong password")
+	login("b@example.com", "wrong password")
+	login("c@example.com", "wrong password")
+	if rec := login("d@example.com", "wrong password"); rec.Code != 429 {
+		t.Errorf("Expected client to be throttled across accounts, got %d", rec.Code)
+	}
+}
+
+func TestLoginFailuresAreIndistinguishable(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "known@example.com", "correct horse battery staple")
+
+	known := login("known@example.com", "wrong password")
+	unknown := login("unknown@example.com", "wrong password")
+
+	if known.Code != unknown.Code {
+		t.Errorf("Expected identical status, got %d for known and %d for unknown email", known.Code, unknown.Code)
+	}
+	if known.Body.String() != unknown.Body.String() {
+		t.Errorf("Expected identical body, got %q for known and %q for unknown email", known.Body.String(), unknown.Body.String())
+	}
+}
+
+func TestSignupResponsesAreIndistinguishable(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "known@example.com", "correct horse battery staple")
+
+	signup := func(email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"email":"`+email+`","password":"correct horse battery staple"}`))
+		rec := httptest.NewRecorder()
+		handlerAddUser(rec, req)
+		return rec
+	}
+
+	existing := signup("known@example.com")
+	fresh := signup("fresh@example.com")
+
+	if existing.Code != fresh.Code {
+		t.Errorf("Expected identical status, got %d for existing and %d for new email", existing.Code, fresh.Code)
+	}
+	if existing.Body.String() != fresh.Body.String() {
+		t.Errorf("Expected identical body, got %q for existing and %q for new email", existing.Body.String(), fresh.Body.String())
+	}
+	if _, err := db.GetUserByEmail(context.Background(), "fresh@example.com"); err != nil {
+		t.Errorf("Expected new account to be created: %v", err)
+	}
+}
+
+func refresh(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handlerRefresh(rec, req)
+	return rec
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+	first := session.RefreshToken
+
+	rec := refresh(first)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var rotated struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(rec.Body).Decode(&rotated)
+	if rotated.Token == "" || rotated.RefreshToken == "" || rotated.RefreshToken == first {
+		t.Fatalf("Expected a new access and refresh token, got %+v", rotated)
+	}
+	if db.refreshTokens[auth.HashRefreshToken(rotated.RefreshToken)].FamilyID != db.refreshTokens[auth.HashRefreshToken(first)].FamilyID {
+		t.Error("Expected rotated token to stay in the same family")
+	}
+
+	second := rotated.RefreshToken
+	rec = refresh(second)
+	json.NewDecoder(rec.Body).Decode(&rotated)
+	third := rotated.RefreshToken
+
+	// Presenting an already rotated token revokes the whole family.
+	if rec := refresh(first); rec.Code != 401 {
+		t.Fatalf("Expected reused token to be rejected, got %d", rec.Code)
+	}
+	if rec := refresh(third); rec.Code != 401 {
+		t.Errorf("Expected latest token in family to be revoked after reuse, got %d", rec.Code)
+	}
+
+	// Other logins are unaffected.
+	var other User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&other)
+	if rec := refresh(other.RefreshToken); rec.Code != 200 {
+		t.Errorf("Expected unrelated token family to keep working, got %d", rec.Code)
+	}
+}
+
+func TestRefreshTokensStoredHashed(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+
+	if _, ok := db.refreshTokens[session.RefreshToken]; ok {
+		t.Error("Expected raw refresh token not to be stored")
+	}
+	if _, ok := db.refreshTokens[auth.HashRefreshToken(session.RefreshToken)]; !ok {
+		t.Error("Expected refresh token digest to be stored")
+	}
+	if rec := refresh(session.RefreshToken); rec.Code != 200 {
+		t.Errorf("Expected refresh by raw token to succeed, got %d", rec.Code)
+	}
+}
+
+func updateLogin(token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/api/users", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	requireAuth(handlerUpdateUserLogin)(rec, req)
+	return rec
+}
+
+func TestUpdateLoginChangesOnlyProvidedFields(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	addTestUser(t, db, "taken@example.com", "correct horse battery staple")
+	db.VerifyUserEmail(context.Background(), database.VerifyUserEmailParams{ID: user.ID, Email: user.Email})
+	token := bearer(t, user.ID)[len("Bearer "):]
+
+	for name, tc := range map[string]struct {
+		body string
+		want int
+	}{
+		"nothing to change":        {`{"current_password":"correct horse battery staple"}`, 400},
+		"missing current password": {`{"email":"new@example.com"}`, 403},
+		"wrong current password":   {`{"email":"new@example.com","current_password":"wrong"}`, 403},
+		"empty email":              {`{"email":" ","current_password":"correct horse battery staple"}`, 400},
+		"invalid email":            {`{"email":"user@","current_password":"correct horse battery staple"}`, 400},
+		"email with display name":  {`{"email":"Me <new@example.com>","current_password":"correct horse battery staple"}`, 400},
+		"taken email":              {`{"email":"taken@example.com","current_password":"correct horse battery staple"}`, 409},
+	} {
+		if rec := updateLogin(token, tc.body); rec.Code != tc.want {
+			t.Errorf("%s: expected status %d, got %d", name, tc.want, rec.Code)
+		}
+	}
+
+	// A new password keeps the email and its verification.
+	rec := updateLogin(token, `{"password":"purple monkey dishwasher","current_password":"correct horse battery staple"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var updated User
+	json.NewDecoder(rec.Body).Decode(&updated)
+	stored := db.users[user.ID]
+	if stored.Email != "user@example.com" || !stored.EmailVerifiedAt.Valid {
+		t.Errorf("Expected the email to be unchanged, got %+v", stored)
+	}
+	if len(sentMail()) != 0 {
+		t.Errorf("Expected no mail for a password change, got %d", len(sentMail()))
+	}
+
+	// A new email keeps the password but needs verifying again.
+	hash := stored.HashedPassword
+	if rec := updateLogin(updated.Token, `{"email":"renamed@example.com","current_password":"purple monkey dishwasher"}`); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	stored = db.users[user.ID]
+	if stored.Email != "renamed@example.com" || stored.EmailVerifiedAt.Valid || stored.HashedPassword != hash {
+		t.Errorf("Expected only the email to change, got %+v", stored)
+	}
+	messages := sentMail()
+	if len(messages) != 2 || messages[0].To != "renamed@example.com" || !verificationLink.MatchString(messages[0].Body) || messages[1].To != "user@example.com" {
+		t.Errorf("Expected a verification link to the new address and a notice to the old one, got %+v", messages)
+	}
+	if rec := login("renamed@example.com", "purple monkey dishwasher"); rec.Code != 200 {
+		t.Errorf("Expected login with the new email, got %d", rec.Code)
+	}
+}
+
+func TestEmailsAreNormalized(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "taken@example.com", "correct horse battery staple")
+
+	if rec := signup("  New.User@Example.COM ", "correct horse battery staple"); rec.Code != 202 {
+		t.Fatalf("Expected status 202, got %d", rec.Code)
+	}
+	user, err := db.GetUserByEmail(context.Background(), "new.user@example.com")
+	if err != nil || user.Email != "new.user@example.com" {
+		t.Fatalf("Expected the email to be stored lowercase, got %q (%v)", user.Email, err)
+	}
+	if messages := sentMail(); len(messages) != 1 || messages[0].To != "new.user@example.com" {
+		t.Errorf("Expected verification mail to the normalized address, got %+v", messages)
+	}
+
+	// A different case is the same account.
+	signup("NEW.USER@example.com", "correct horse battery staple")
+	if len(db.users) != 2 {
+		t.Errorf("Expected no second account, have %d users", len(db.users))
+	}
+	rec := login("New.User@example.com ", "correct horse battery staple")
+	if rec.Code != 200 {
+		t.Fatalf("Expected login to ignore case, got %d", rec.Code)
+	}
+	var session User
+	json.NewDecoder(rec.Body).Decode(&session)
+
+	if rec := updateLogin(session.Token, `{"email":"TAKEN@example.com","current_password":"correct horse battery staple"}`); rec.Code != 409 {
+		t.Errorf("Expected a taken email in another case to conflict, got %d", rec.Code)
+	}
+	if rec := updateLogin(session.Token, `{"email":" Renamed@Example.com","current_password":"correct horse battery staple"}`); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if db.users[user.ID].Email != "renamed@example.com" {
+		t.Errorf("Expected the new email to be stored lowercase, got %q", db.users[user.ID].Email)
+	}
+}
+
+func TestUpdateLoginWithoutPasswordKeepsSessions(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	var current, other User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&current)
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&other)
+	before := db.users[user.ID]
+
+	// Saving the same email changes nothing.
+	if rec := updateLogin(current.Token, `{"email":" User@Example.com","current_password":"correct horse battery staple"}`); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if after := db.users[user.ID]; after.TokenVersion != before.TokenVersion || !after.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Errorf("Expected an unchanged save to leave the user alone, got %+v", after)
+	}
+	if len(sentMail()) != 0 {
+		t.Errorf("Expected no mail for an unchanged save, got %d", len(sentMail()))
+	}
+
+	// Only a new password signs other devices out.
+	if rec := updateLogin(current.Token, `{"email":"renamed@example.com","current_password":"correct horse battery staple"}`); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := refresh(other.RefreshToken); rec.Code != 200 {
+		t.Errorf("Expected other session to survive an email change, got %d", rec.Code)
+	}
+	if rec := updateLogin(other.Token, `{"email":"renamed@example.com","current_password":"correct horse battery staple"}`); rec.Code != 200 {
+		t.Errorf("Expected other access token to survive an email change, got %d", rec.Code)
+	}
+}
+
+func TestUpdateLoginInvalidatesOtherSessions(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	var current, other User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&current)
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&other)
+
+	rec := updateLogin(current.Token, `{"password":"purple monkey dishwasher","current_password":"correct horse battery staple"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var updated User
+	json.NewDecoder(rec.Body).Decode(&updated)
+	if updated.Token == "" {
+		t.Fatal("Expected a replacement access token")
+	}
+
+	// Access tokens issued before the change stop working everywhere.
+	for name, token := range map[string]string{"current": current.Token, "other": other.Token} {
+		if rec := updateLogin(token, `{"password":"purple monkey dishwasher","current_password":"purple monkey dishwasher"}`); rec.Code != 401 {
+			t.Errorf("Expected old %s access token to be rejected, got %d", name, rec.Code)
+		}
+	}
+
+	if rec := refresh(other.RefreshToken); rec.Code != 401 {
+		t.Errorf("Expected other session's refresh token to be revoked, got %d", rec.Code)
+	}
+	rec = refresh(current.RefreshToken)
+	if rec.Code != 200 {
+		t.Fatalf("Expected current session to survive, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var rotated struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(rec.Body).Decode(&rotated)
+	if rec := updateLogin(rotated.Token, `{"password":"purple monkey dishwasher","current_password":"purple monkey dishwasher"}`); rec.Code != 200 {
+		t.Errorf("Expected refreshed access token to carry the new version, got %d", rec.Code)
+	}
+	if rec := updateLogin(updated.Token, `{"password":"purple monkey dishwasher","current_password":"purple monkey dishwasher"}`); rec.Code != 401 {
+		t.Errorf("Expected replacement token to be invalidated by the next change, got %d", rec.Code)
+	}
+}
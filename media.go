@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/database"
+	"github.com/thmastin/Chirpy/internal/media"
+	"github.com/thmastin/Chirpy/internal/storage"
+)
+
+const (
+	// maxMediaBytes is the largest file POST /api/media accepts.
+	maxMediaBytes = 10 << 20
+	// maxAttachments is how many images one chirp can carry.
+	maxAttachments = 4
+	// unattachedMediaTTL is how long an upload waits to be attached to a
+	// chirp before it is deleted.
+	unattachedMediaTTL = 24 * time.Hour
+)
+
+// mediaStoreFromEnv stores uploads in the S3-compatible bucket S3_BUCKET
+// when MEDIA_STORE is "s3", and otherwise in MEDIA_DIR (default "media").
+func mediaStoreFromEnv() storage.Store {
+	if os.Getenv("MEDIA_STORE") == "s3" {
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return storage.S3Store{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			Region:          region,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		}
+	}
+	dir := os.Getenv("MEDIA_DIR")
+	if dir == "" {
+		dir = "media"
+	}
+	return storage.LocalStore{Dir: dir}
+}
+
+type Attachment struct {
+	ID           uuid.UUID `json:"id"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	ContentType  string    `json:"content_type"`
+	Width        int32     `json:"width"`
+	Height       int32     `json:"height"`
+}
+
+func convertAttachment(a database.Attachment) Attachment {
+	url := apiCfg.publicURL + "/api/media/" + a.ID.String()
+	return Attachment{
+		ID:           a.ID,
+		URL:          url,
+		ThumbnailURL: url + "/thumbnail",
+		ContentType:  a.ContentType,
+		Width:        a.Width,
+		Height:       a.Height,
+	}
+}
+
+func mediaKey(id uuid.UUID, variant string) string {
+	return "media/" + id.String() + "/" + variant
+}
+
+// handlerUploadMedia takes an image as the "file" field of a multipart
+// form. The stored copy is re-encoded without metadata, so what is served
+// is never the uploaded bytes.
+func handlerUploadMedia(w http.ResponseWriter, r *http.Request) {
+	// Leave room for the multipart framing around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxMediaBytes+64<<10)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, 400, "Expected a multipart/form-data body")
+		return
+	}
+
+	var data []byte
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, 413, "File is too large")
+			return
+		}
+		if err != nil {
+			respondWithError(w, 400, "Invalid multipart body")
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		data, err = io.ReadAll(io.LimitReader(part, maxMediaBytes+1))
+		if errors.As(err, &maxBytesErr) || len(data) > maxMediaBytes {
+			respondWithError(w, 413, "File is too large")
+			return
+		}
+		if err != nil {
+			respondWithError(w, 400, "Invalid multipart body")
+			return
+		}
+		break
+	}
+	if len(data) == 0 {
+		respondWithError(w, 400, "Missing file")
+		return
+	}
+
+	img, err := media.Process(data)
+	switch {
+	case errors.Is(err, media.ErrUnsupportedType):
+		respondWithError(w, 415, "Only JPEG, PNG and GIF images are supported")
+		return
+	case errors.Is(err, media.ErrTooLarge):
+		respondWithError(w, 413, "Image dimensions are too large")
+		return
+	case errors.Is(err, media.ErrInvalidImage):
+		respondWithError(w, 400, "Image could not be read")
+		return
+	case err != nil:
+		log.Printf("Unable to process upload: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	// Blobs go first so a stored attachment always has its files. If the
+	// insert fails they are left behind under an ID nothing refers to.
+	id := uuid.New()
+	if err := apiCfg.mediaStore.Put(r.Context(), mediaKey(id, "original"), img.Data, img.ContentType); err != nil {
+		log.Printf("Unable to store upload: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if err := apiCfg.mediaStore.Put(r.Context(), mediaKey(id, "thumbnail"), img.Thumbnail, img.ThumbnailContentType); err != nil {
+		log.Printf("Unable to store thumbnail: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	attachment, err := apiCfg.dbQueries.CreateAttachment(r.Context(), database.CreateAttachmentParams{
+		ID:                   id,
+		UserID:               uuid.NullUUID{UUID: currentPrincipal(r).UserID, Valid: true},
+		ContentType:          img.ContentType,
+		ThumbnailContentType: img.ThumbnailContentType,
+		Width:                int32(img.Width),
+		Height:               int32(img.Height),
+		SizeBytes:            int64(len(img.Data)),
+	})
+	if err != nil {
+		log.Printf("Unable to create attachment: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 201, convertAttachment(attachment))
+}
+
+// handlerGetMedia serves an attachment, or its thumbnail when variant is
+// "thumbnail". Files never change once stored, so they can be cached
+// forever.
+func handlerGetMedia(variant string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(r.PathValue("mediaID"))
+		if err != nil {
+			respondWithError(w, 400, "Invalid mediaID")
+			return
+		}
+		attachment, err := apiCfg.dbQueries.GetAttachment(r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, "Media not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to get attachment: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
+		file, err := apiCfg.mediaStore.Get(r.Context(), mediaKey(id, variant))
+		if errors.Is(err, storage.ErrNotFound) {
+			respondWithError(w, 404, "Media not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to read media: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
+		defer file.Close()
+
+		contentType := attachment.ContentType
+		if variant == "thumbnail" {
+			contentType = attachment.ThumbnailContentType
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.WriteHeader(200)
+		io.Copy(w, file)
+	}
+}
+
+// checkAttachments reports whether ids are distinct uploads of userID's
+// that are not yet on a chirp, so a chirp is not created with media its
+// author cannot use.
+func checkAttachments(ctx context.Context, userID uuid.UUID, ids []uuid.UUID) (bool, error) {
+	seen := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			return false, nil
+		}
+		seen[id] = true
+		attachment, err := apiCfg.dbQueries.GetAttachment(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !attachment.UserID.Valid || attachment.UserID.UUID != userID || attachment.ChirpID.Valid {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// errMediaTaken means an upload was attached to another chirp between
+// checkAttachments and attachMedia.
+var errMediaTaken = errors.New("media already attached")
+
+// attachMedia attaches ids to chirp in order.
+func attachMedia(ctx context.Context, chirp database.Chirp, ids []uuid.UUID) ([]Attachment, error) {
+	attached := []Attachment{}
+	for i, id := range ids {
+		n, err := apiCfg.dbQueries.AttachToChirp(ctx, database.AttachToChirpParams{
+			ChirpID:  uuid.NullUUID{UUID: chirp.ID, Valid: true},
+			Position: sql.NullInt32{Int32: int32(i), Valid: true},
+			ID:       id,
+			UserID:   uuid.NullUUID{UUID: chirp.UserID, Valid: true},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, errMediaTaken
+		}
+		attachment, err := apiCfg.dbQueries.GetAttachment(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		attached = append(attached, convertAttachment(attachment))
+	}
+	return attached, nil
+}
+
+// loadAttachments fills in the media of each chirp with one query.
+func loadAttachments(ctx context.Context, chirps []Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(chirps))
+	byChirp := map[uuid.UUID]*Chirp{}
+	for i := range chirps {
+		ids[i] = chirps[i].ID
+		byChirp[chirps[i].ID] = &chirps[i]
+	}
+	attachments, err := apiCfg.dbQueries.GetAttachmentsForChirps(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if chirp, ok := byChirp[a.ChirpID.UUID]; ok {
+			chirp.Media = append(chirp.Media, convertAttachment(a))
+		}
+	}
+	return nil
+}
+
+// purgeUnattachedMedia deletes uploads never attached to a chirp, and
+// those whose chirp or owner has been deleted, every interval until ctx is
+// done.
+func purgeUnattachedMedia(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ids, err := apiCfg.dbQueries.DeleteUnattachedAttachments(ctx, unattachedMediaTTL.Seconds())
+		if err != nil {
+			log.Printf("Unable to purge unattached media: %v", err)
+		}
+		for _, id := range ids {
+			for _, variant := range []string{"original", "thumbnail"} {
+				if err := apiCfg.mediaStore.Delete(ctx, mediaKey(id, variant)); err != nil {
+					log.Printf("Unable to delete media %s: %v", mediaKey(id, variant), err)
+				}
+			}
+		}
+		if len(ids) > 0 {
+			log.Printf("Purged %d unattached media", len(ids))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/storage"
+)
+
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func uploadMedia(t *testing.T, userID uuid.UUID, field string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile(field, "upload.png")
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/api/media", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", bearer(t, userID))
+	rec := httptest.NewRecorder()
+	requireScope(scopeWriteChirps, handlerUploadMedia)(rec, req)
+	return rec
+}
+
+func newAttachment(t *testing.T, userID uuid.UUID) Attachment {
+	t.Helper()
+	rec := uploadMedia(t, userID, "file", testPNG(t, 400, 200))
+	if rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var attachment Attachment
+	json.NewDecoder(rec.Body).Decode(&attachment)
+	return attachment
+}
+
+func getMedia(t *testing.T, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	variant := "original"
+	path := strings.TrimPrefix(target, apiCfg.publicURL+"/api/media/")
+	if id, ok := strings.CutSuffix(path, "/thumbnail"); ok {
+		path, variant = id, "thumbnail"
+	}
+	req := httptest.NewRequest("GET", target, nil)
+	req.SetPathValue("mediaID", path)
+	rec := httptest.NewRecorder()
+	handlerGetMedia(variant)(rec, req)
+	return rec
+}
+
+func postChirp(t *testing.T, userID uuid.UUID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return callAs(requireScope(scopeWriteChirps, handlerChirps), "POST", "/api/chirps", bearer(t, userID)[len("Bearer "):], body)
+}
+
+func TestUploadMedia(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	attachment := newAttachment(t, user.ID)
+	if attachment.ContentType != "image/png" || attachment.Width != 400 || attachment.Height != 200 {
+		t.Errorf("Unexpected attachment %+v", attachment)
+	}
+	if attachment.URL != "http://chirpy.test/api/media/"+attachment.ID.String() || attachment.ThumbnailURL != attachment.URL+"/thumbnail" {
+		t.Errorf("Unexpected URLs %q, %q", attachment.URL, attachment.ThumbnailURL)
+	}
+
+	rec := getMedia(t, attachment.URL)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("Unexpected response %d %v", rec.Code, rec.Header())
+	}
+	if img, err := png.Decode(rec.Body); err != nil || img.Bounds().Dx() != 400 {
+		t.Errorf("Expected the stored image, got %v", err)
+	}
+	rec = getMedia(t, attachment.ThumbnailURL)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if img, err := png.Decode(rec.Body); err != nil || img.Bounds().Dx() != 320 || img.Bounds().Dy() != 160 {
+		t.Errorf("Expected a 320x160 thumbnail, got %v", err)
+	}
+	if rec := getMedia(t, apiCfg.publicURL+"/api/media/"+uuid.NewString()); rec.Code != 404 {
+		t.Errorf("Expected unknown media to be 404, got %d", rec.Code)
+	}
+
+	for name, tc := range map[string]struct {
+		field string
+		data  []byte
+		want  int
+	}{
+		"html":        {"file", []byte("<html><script>alert(1)</script></html>"), 415},
+		"svg":         {"file", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), 415},
+		"corrupt":     {"file", testPNG(t, 10, 10)[:40], 400},
+		"wrong field": {"image", testPNG(t, 10, 10), 400},
+		"too big":     {"file", make([]byte, maxMediaBytes+1), 413},
+	} {
+		if rec := uploadMedia(t, user.ID, tc.field, tc.data); rec.Code != tc.want {
+			t.Errorf("%s: expected status %d, got %d", name, tc.want, rec.Code)
+		}
+	}
+	if len(db.attachments) != 1 {
+		t.Errorf("Expected only the valid upload to be stored, got %d", len(db.attachments))
+	}
+}
+
+func TestChirpAttachments(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	other := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+
+	first, second := newAttachment(t, user.ID), newAttachment(t, user.ID)
+	rec := postChirp(t, user.ID, `{"body":"look","media_ids":["`+second.ID.String()+`","`+first.ID.String()+`"]}`)
+	if rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var chirp Chirp
+	json.NewDecoder(rec.Body).Decode(&chirp)
+	if len(chirp.Media) != 2 || chirp.Media[0].ID != second.ID || chirp.Media[1].ID != first.ID {
+		t.Fatalf("Expected the media in request order, got %+v", chirp.Media)
+	}
+
+	req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String(), nil)
+	req.SetPathValue("chirpID", chirp.ID.String())
+	rec = httptest.NewRecorder()
+	handlerGetChirp(rec, req)
+	var got Chirp
+	json.NewDecoder(rec.Body).Decode(&got)
+	if len(got.Media) != 2 || got.Media[0].ID != second.ID {
+		t.Errorf("Expected GET to include the media, got %+v", got.Media)
+	}
+
+	// Chirps without media have an empty list rather than null.
+	rec = postChirp(t, user.ID, `{"body":"plain"}`)
+	if rec.Code != 201 || !strings.Contains(rec.Body.String(), `"media":[]`) {
+		t.Errorf("Expected an empty media list, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	othersUpload := newAttachment(t, other.ID)
+	var five []string
+	for i := 0; i < 5; i++ {
+		five = append(five, `"`+newAttachment(t, user.ID).ID.String()+`"`)
+	}
+	fresh := newAttachment(t, user.ID).ID.String()
+	chirps := len(db.chirps)
+	for name, ids := range map[string]string{
+		"already attached": `"` + first.ID.String() + `"`,
+		"another user's":   `"` + othersUpload.ID.String() + `"`,
+		"unknown":          `"` + uuid.NewString() + `"`,
+		"duplicate":        `"` + fresh + `","` + fresh + `"`,
+		"too many":         strings.Join(five, ","),
+	} {
+		if rec := postChirp(t, user.ID, `{"body":"nope","media_ids":[`+ids+`]}`); rec.Code != 400 {
+			t.Errorf("%s: expected status 400, got %d", name, rec.Code)
+		}
+	}
+	if len(db.chirps) != chirps {
+		t.Errorf("Expected no chirps to be created by rejected requests")
+	}
+}
+
+func TestPurgeUnattachedMedia(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	attached, stale, recent := newAttachment(t, user.ID), newAttachment(t, user.ID), newAttachment(t, user.ID)
+	if rec := postChirp(t, user.ID, `{"body":"kept","media_ids":["`+attached.ID.String()+`"]}`); rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d", rec.Code)
+	}
+	a := db.attachments[stale.ID]
+	a.CreatedAt = time.Now().Add(-unattachedMediaTTL - time.Minute)
+	db.attachments[stale.ID] = a
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	purgeUnattachedMedia(ctx, time.Hour)
+
+	if _, ok := db.attachments[stale.ID]; ok {
+		t.Error("Expected the stale upload to be purged")
+	}
+	if _, err := apiCfg.mediaStore.Get(ctx, mediaKey(stale.ID, "original")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Expected the stale upload's file to be deleted, got %v", err)
+	}
+	for _, kept := range []Attachment{attached, recent} {
+		if rec := getMedia(t, kept.URL); rec.Code != 200 {
+			t.Errorf("Expected %s to be kept, got %d", kept.ID, rec.Code)
+		}
+	}
+
+	// Deleting the chirp's author leaves its media orphaned for the next run.
+	db.deleteUser(user.ID)
+	purgeUnattachedMedia(ctx, time.Hour)
+	if len(db.attachments) != 0 {
+		t.Errorf("Expected orphaned media to be purged, got %d", len(db.attachments))
+	}
+}
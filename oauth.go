@@ -0,0 +1,594 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+const (
+	scopeReadChirps  = "read:chirps"
+	scopeWriteChirps = "write:chirps"
+
+	// oauthCodeTTL is how long a client has to exchange an authorization
+	// code.
+	oauthCodeTTL = time.Minute
+	// oauthAccessTokenTTL is the lifetime of tokens issued to clients. No
+	// refresh tokens are issued; clients send the user through
+	// authorization again, which skips consent for granted scopes.
+	oauthAccessTokenTTL = time.Hour
+
+	maxRedirectURIs = 10
+)
+
+// oauthScopes are the scopes clients may request, with the description
+// shown to the user on the consent screen.
+var oauthScopes = map[string]string{
+	scopeReadChirps:  "Read chirps",
+	scopeWriteChirps: "Post and delete chirps as you",
+}
+
+// OAuthClient is a third-party application registered by a user.
+type OAuthClient struct {
+	ID           uuid.UUID `json:"id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+	// ClientSecret is only returned when a confidential client is created.
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+func convertOAuthClient(c database.OauthClient) OAuthClient {
+	return OAuthClient{
+		ID:           c.ID,
+		Name:         c.Name,
+		RedirectURIs: c.RedirectUris,
+		Confidential: c.SecretHash.Valid,
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+// OAuthGrant is the access a user has given a client.
+type OAuthGrant struct {
+	ClientID   uuid.UUID `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// validRedirectURI accepts absolute https URIs without a fragment. Plain
+// http is allowed only for loopback addresses, where native apps listen.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.User != nil || strings.Contains(raw, "#") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// parseScopes splits a space-separated scope parameter, rejecting unknown
+// scopes. The result is sorted and free of duplicates.
+func parseScopes(scope string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return nil, errors.New("scope is required")
+	}
+	for _, s := range scopes {
+		if _, ok := oauthScopes[s]; !ok {
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	slices.Sort(scopes)
+	return slices.Compact(scopes), nil
+}
+
+func handlerCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	userID := currentPrincipal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > 100 {
+		respondWithError(w, 400, "name must be between 1 and 100 characters")
+		return
+	}
+	if len(params.RedirectURIs) == 0 || len(params.RedirectURIs) > maxRedirectURIs {
+		respondWithError(w, 400, fmt.Sprintf("Between 1 and %d redirect_uris are required", maxRedirectURIs))
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if !validRedirectURI(uri) {
+			respondWithError(w, 400, fmt.Sprintf("Invalid redirect_uri %q", uri))
+			return
+		}
+	}
+
+	var secret string
+	var secretHash sql.NullString
+	if params.Confidential {
+		var err error
+		secret, err = auth.MakeRefreshToken()
+		if err != nil {
+			log.Printf("Unable to generate client secret: %v", err)
+			respondWithError(w, 500, "Server Error")
+			return
+		}
+		secretHash = sql.NullString{String: auth.HashRefreshToken(secret), Valid: true}
+	}
+
+	dbClient, err := apiCfg.dbQueries.CreateOAuthClient(r.Context(), database.CreateOAuthClientParams{
+		UserID:       userID,
+		Name:         params.Name,
+		RedirectUris: params.RedirectURIs,
+		SecretHash:   secretHash,
+	})
+	if err != nil {
+		log.Printf("Unable to create OAuth client: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	client := convertOAuthClient(dbClient)
+	client.ClientSecret = secret
+	respondWithJSON(w, 201, client)
+}
+
+func handlerGetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	dbClients, err := apiCfg.dbQueries.GetOAuthClientsForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get OAuth clients: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	clients := []OAuthClient{}
+	for _, c := range dbClients {
+		clients = append(clients, convertOAuthClient(c))
+	}
+	respondWithJSON(w, 200, clients)
+}
+
+func handlerDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	clientID, err := uuid.Parse(r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid clientID")
+		return
+	}
+	deleted, err := apiCfg.dbQueries.DeleteOAuthClientForUser(r.Context(), database.DeleteOAuthClientForUserParams{
+		ID:     clientID,
+		UserID: userID,
+	})
+	if err != nil {
+		log.Printf("Unable to delete OAuth client: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, 404, "Client not found")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
+
+// authorizationRequest holds the parameters of an RFC 6749 authorization
+// request. Chirpy's frontend passes them through from the client's
+// redirect.
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// checkedAuthorization is an authorization request that passed
+// checkAuthorizationRequest.
+type checkedAuthorization struct {
+	client database.OauthClient
+	scopes []string
+	// redirectURI is where to send the user, which is the only registered
+	// URI when the request did not name one.
+	redirectURI string
+}
+
+// checkAuthorizationRequest validates an authorization request. Errors are
+// shown to the user rather than redirected to the client, so an
+// unregistered redirect_uri never receives anything.
+func checkAuthorizationRequest(w http.ResponseWriter, r *http.Request, req authorizationRequest) (checkedAuthorization, bool) {
+	clientID, err := uuid.Parse(req.ClientID)
+	if err != nil {
+		respondWithError(w, 400, "Invalid client_id")
+		return checkedAuthorization{}, false
+	}
+	client, err := apiCfg.dbQueries.GetOAuthClient(r.Context(), clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 400, "Unknown client_id")
+		return checkedAuthorization{}, false
+	}
+	if err != nil {
+		log.Printf("Unable to get OAuth client: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return checkedAuthorization{}, false
+	}
+
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectUris) == 1 {
+		redirectURI = client.RedirectUris[0]
+	}
+	if !slices.Contains(client.RedirectUris, redirectURI) {
+		respondWithError(w, 400, "redirect_uri is not registered for this client")
+		return checkedAuthorization{}, false
+	}
+	if req.ResponseType != "code" {
+		respondWithError(w, 400, "response_type must be code")
+		return checkedAuthorization{}, false
+	}
+	if req.CodeChallengeMethod != auth.PKCEMethodS256 || len(req.CodeChallenge) != 43 {
+		respondWithError(w, 400, "An S256 code_challenge is required")
+		return checkedAuthorization{}, false
+	}
+	scopes, err := parseScopes(req.Scope)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return checkedAuthorization{}, false
+	}
+	return checkedAuthorization{client: client, scopes: scopes, redirectURI: redirectURI}, true
+}
+
+// handlerGetAuthorization tells the frontend what a client is asking for,
+// so it can show a consent screen. Consent is not required when the user
+// already granted every requested scope.
+func handlerGetAuthorization(w http.ResponseWriter, r *http.Request) {
+	type scopeDescription struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	type response struct {
+		ClientID        uuid.UUID          `json:"client_id"`
+		ClientName      string             `json:"client_name"`
+		Scopes          []scopeDescription `json:"scopes"`
+		ConsentRequired bool               `json:"consent_required"`
+	}
+
+	userID := currentPrincipal(r).UserID
+	query := r.URL.Query()
+	checked, ok := checkAuthorizationRequest(w, r, authorizationRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	})
+	if !ok {
+		return
+	}
+
+	grant, err := apiCfg.dbQueries.GetOAuthGrant(r.Context(), database.GetOAuthGrantParams{
+		UserID:   userID,
+		ClientID: checked.client.ID,
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Unable to get OAuth grant: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	resp := response{
+		ClientID:   checked.client.ID,
+		ClientName: checked.client.Name,
+		Scopes:     []scopeDescription{},
+	}
+	for _, scope := range checked.scopes {
+		resp.Scopes = append(resp.Scopes, scopeDescription{Name: scope, Description: oauthScopes[scope]})
+		if !slices.Contains(grant.Scopes, scope) {
+			resp.ConsentRequired = true
+		}
+	}
+	respondWithJSON(w, 200, resp)
+}
+
+// handlerAuthorize records the user's decision and returns the client
+// redirect URI for the frontend to send the user to: with an authorization
+// code if they approved, or an access_denied error if not.
+func handlerAuthorize(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+	type response struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+
+	userID := currentPrincipal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	checked, ok := checkAuthorizationRequest(w, r, params.authorizationRequest)
+	if !ok {
+		return
+	}
+
+	redirect, err := url.Parse(checked.redirectURI)
+	if err != nil {
+		log.Printf("Unable to parse registered redirect URI: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	query := redirect.Query()
+	if params.State != "" {
+		query.Set("state", params.State)
+	}
+	if !params.Approve {
+		query.Set("error", "access_denied")
+		redirect.RawQuery = query.Encode()
+		respondWithJSON(w, 200, response{RedirectTo: redirect.String()})
+		return
+	}
+
+	code, err := createAuthorizationCode(r, userID, checked, params.RedirectURI, params.CodeChallenge)
+	if err != nil {
+		log.Printf("Unable to create authorization code: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	query.Set("code", code)
+	redirect.RawQuery = query.Encode()
+	respondWithJSON(w, 200, response{RedirectTo: redirect.String()})
+}
+
+// createAuthorizationCode widens the user's grant to the approved scopes
+// and stores a single-use code for them. requestedRedirectURI is kept as
+// sent, since the token request must repeat it exactly.
+func createAuthorizationCode(r *http.Request, userID uuid.UUID, checked checkedAuthorization, requestedRedirectURI, codeChallenge string) (string, error) {
+	grant, err := apiCfg.dbQueries.GetOAuthGrant(r.Context(), database.GetOAuthGrantParams{
+		UserID:   userID,
+		ClientID: checked.client.ID,
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	scopes := append(slices.Clone(grant.Scopes), checked.scopes...)
+	slices.Sort(scopes)
+	err = apiCfg.dbQueries.UpsertOAuthGrant(r.Context(), database.UpsertOAuthGrantParams{
+		UserID:   userID,
+		ClientID: checked.client.ID,
+		Scopes:   slices.Compact(scopes),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Expired codes are never consumed, so sweep them here.
+	if err := apiCfg.dbQueries.DeleteExpiredOAuthAuthorizationCodes(r.Context()); err != nil {
+		return "", err
+	}
+	code, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	err = apiCfg.dbQueries.CreateOAuthAuthorizationCode(r.Context(), database.CreateOAuthAuthorizationCodeParams{
+		CodeHash:      auth.HashRefreshToken(code),
+		ClientID:      checked.client.ID,
+		UserID:        userID,
+		RedirectUri:   requestedRedirectURI,
+		Scopes:        checked.scopes,
+		CodeChallenge: codeChallenge,
+		TtlSeconds:    oauthCodeTTL.Seconds(),
+	})
+	return code, err
+}
+
+// respondOAuthError sends an RFC 6749 section 5.2 error response.
+func respondOAuthError(w http.ResponseWriter, code int, errorCode, description string) {
+	type response struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+	respondWithJSON(w, code, response{Error: errorCode, ErrorDescription: description})
+}
+
+// handlerOAuthToken exchanges an authorization code for an access token.
+// Confidential clients authenticate with HTTP Basic or client_secret;
+// public clients rely on the PKCE code_verifier alone.
+func handlerOAuthToken(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		Scope       string `json:"scope"`
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := r.ParseForm(); err != nil {
+		respondOAuthError(w, 400, "invalid_request", "The request body must be form encoded")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		respondOAuthError(w, 400, "unsupported_grant_type", "Only authorization_code is supported")
+		return
+	}
+
+	client, ok := authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	code, err := apiCfg.dbQueries.ConsumeOAuthAuthorizationCode(r.Context(), auth.HashRefreshToken(r.PostForm.Get("code")))
+	if errors.Is(err, sql.ErrNoRows) {
+		respondOAuthError(w, 400, "invalid_grant", "The authorization code is invalid or expired")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to consume authorization code: %v", err)
+		respondOAuthError(w, 500, "server_error", "")
+		return
+	}
+	// The code is spent either way, so a failed guess at the verifier
+	// cannot be retried.
+	if code.ClientID != client.ID || code.RedirectUri != r.PostForm.Get("redirect_uri") {
+		respondOAuthError(w, 400, "invalid_grant", "The authorization code was issued to another client or redirect_uri")
+		return
+	}
+	if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		respondOAuthError(w, 400, "invalid_grant", "The code_verifier does not match the code_challenge")
+		return
+	}
+
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), code.UserID)
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondOAuthError(w, 500, "server_error", "")
+		return
+	}
+	token, err := auth.MakeJWT(auth.Claims{
+		Type:         auth.TokenTypeAccess,
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+		ClientID:     client.ID,
+		Scopes:       code.Scopes,
+	}, apiCfg.jwtConfig, oauthAccessTokenTTL)
+	if err != nil {
+		log.Printf("Error creating token: %v", err)
+		respondOAuthError(w, 500, "server_error", "")
+		return
+	}
+	respondWithJSON(w, 200, response{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthAccessTokenTTL.Seconds()),
+		Scope:       strings.Join(code.Scopes, " "),
+	})
+}
+
+// authenticateOAuthClient identifies the client making a token request.
+// On failure it writes an invalid_client error and returns false.
+func authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (database.OauthClient, bool) {
+	clientID, secret, usedBasic := r.BasicAuth()
+	if usedBasic {
+		// RFC 6749 section 2.3.1 form encodes both before Basic encoding.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	reject := func() (database.OauthClient, bool) {
+		if usedBasic {
+			w.Header().Set("WWW-Authenticate", auth.Challenge("Basic", "realm", authRealm))
+		}
+		respondOAuthError(w, 401, "invalid_client", "Client authentication failed")
+		return database.OauthClient{}, false
+	}
+
+	id, err := uuid.Parse(clientID)
+	if err != nil {
+		return reject()
+	}
+	client, err := apiCfg.dbQueries.GetOAuthClient(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return reject()
+	}
+	if err != nil {
+		log.Printf("Unable to get OAuth client: %v", err)
+		respondOAuthError(w, 500, "server_error", "")
+		return database.OauthClient{}, false
+	}
+	if client.SecretHash.Valid && subtle.ConstantTimeCompare([]byte(auth.HashRefreshToken(secret)), []byte(client.SecretHash.String)) != 1 {
+		return reject()
+	}
+	return client, true
+}
+
+func handlerGetOAuthGrants(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	dbGrants, err := apiCfg.dbQueries.GetOAuthGrantsForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get OAuth grants: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	grants := []OAuthGrant{}
+	for _, g := range dbGrants {
+		grants = append(grants, OAuthGrant{
+			ClientID:   g.ClientID,
+			ClientName: g.ClientName,
+			Scopes:     g.Scopes,
+			CreatedAt:  g.CreatedAt,
+			UpdatedAt:  g.UpdatedAt,
+		})
+	}
+	respondWithJSON(w, 200, grants)
+}
+
+// handlerRevokeOAuthGrant withdraws a client's access. Access tokens it
+// already holds stop working immediately.
+func handlerRevokeOAuthGrant(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	clientID, err := uuid.Parse(r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid clientID")
+		return
+	}
+	revoked, err := apiCfg.dbQueries.DeleteOAuthGrant(r.Context(), database.DeleteOAuthGrantParams{
+		UserID:   userID,
+		ClientID: clientID,
+	})
+	if err != nil {
+		log.Printf("Unable to revoke OAuth grant: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, 404, "Grant not found")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+const (
+	testRedirectURI  = "https://app.example/callback"
+	testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+func registerOAuthClient(t *testing.T, userID uuid.UUID, confidential bool) OAuthClient {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{
+		"name":          "Chirp Reader",
+		"redirect_uris": []string{testRedirectURI, "http://127.0.0.1:8123/cb"},
+		"confidential":  confidential,
+	})
+	rec := callWithToken(handlerCreateOAuthClient, "POST", "/api/oauth/clients", bearer(t, userID)[len("Bearer "):], string(body))
+	if rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var client OAuthClient
+	json.NewDecoder(rec.Body).Decode(&client)
+	return client
+}
+
+// authorizationParams is a valid authorization request for client.
+func authorizationParams(client OAuthClient, scope string) map[string]any {
+	return map[string]any{
+		"response_type":         "code",
+		"client_id":             client.ID.String(),
+		"redirect_uri":          testRedirectURI,
+		"scope":                 scope,
+		"state":                 "xyz",
+		"code_challenge":        auth.PKCEChallenge(testCodeVerifier),
+		"code_challenge_method": "S256",
+	}
+}
+
+func postAuthorization(t *testing.T, userID uuid.UUID, params map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(params)
+	return callWithToken(handlerAuthorize, "POST", "/api/oauth/authorize", bearer(t, userID)[len("Bearer "):], string(body))
+}
+
+// authorizeCode approves client for scope and returns the issued code.
+func authorizeCode(t *testing.T, userID uuid.UUID, client OAuthClient, scope string) string {
+	t.Helper()
+	params := authorizationParams(client, scope)
+	params["approve"] = true
+	rec := postAuthorization(t, userID, params)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	redirect, _ := url.Parse(resp.RedirectTo)
+	if !strings.HasPrefix(resp.RedirectTo, testRedirectURI+"?") || redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("Unexpected redirect %q", resp.RedirectTo)
+	}
+	return redirect.Query().Get("code")
+}
+
+func exchangeCode(form url.Values, setup func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if setup != nil {
+		setup(req)
+	}
+	rec := httptest.NewRecorder()
+	handlerOAuthToken(rec, req)
+	return rec
+}
+
+func codeForm(client OAuthClient, code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {client.ID.String()},
+		"code_verifier": {testCodeVerifier},
+	}
+}
+
+// oauthAccessToken runs the whole flow and returns the client's token.
+func oauthAccessToken(t *testing.T, userID uuid.UUID, client OAuthClient, scope string) string {
+	t.Helper()
+	rec := exchangeCode(codeForm(client, authorizeCode(t, userID, client, scope)), nil)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return resp.AccessToken
+}
+
+// callAs sends token to handler, which brings its own middleware.
+func callAs(handler http.HandlerFunc, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	db := setupTestAPI(t)
+	developer := addTestUser(t, db, "dev@example.com", "correct horse battery staple")
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	client := registerOAuthClient(t, developer.ID, false)
+	if client.Confidential || client.ClientSecret != "" {
+		t.Errorf("Expected a public client, got %+v", client)
+	}
+
+	query := url.Values{}
+	for k, v := range authorizationParams(client, "write:chirps read:chirps") {
+		query.Set(k, v.(string))
+	}
+	consent := func() (bool, []string) {
+		rec := callWithToken(handlerGetAuthorization, "GET", "/api/oauth/authorize?"+query.Encode(), bearer(t, user.ID)[len("Bearer "):], "")
+		if rec.Code != 200 {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			ClientName      string `json:"client_name"`
+			ConsentRequired bool   `json:"consent_required"`
+			Scopes          []struct {
+				Name string `json:"name"`
+			} `json:"scopes"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.ClientName != "Chirp Reader" {
+			t.Errorf("Expected client name, got %q", resp.ClientName)
+		}
+		var scopes []string
+		for _, s := range resp.Scopes {
+			scopes = append(scopes, s.Name)
+		}
+		return resp.ConsentRequired, scopes
+	}
+	required, scopes := consent()
+	if !required || strings.Join(scopes, " ") != "read:chirps write:chirps" {
+		t.Errorf("Expected consent for both scopes, got %v %v", required, scopes)
+	}
+
+	rec := exchangeCode(codeForm(client, authorizeCode(t, user.ID, client, "write:chirps read:chirps")), nil)
+	if rec.Code != 200 || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected an uncached token response, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		Scope       string `json:"scope"`
+	}
+	json.NewDecoder(rec.Body).Decode(&token)
+	if token.TokenType != "Bearer" || token.ExpiresIn != 3600 || token.Scope != "read:chirps write:chirps" {
+		t.Errorf("Unexpected token response %+v", token)
+	}
+
+	rec = callAs(requireScope(scopeWriteChirps, handlerChirps), "POST", "/api/chirps", token.AccessToken, `{"body":"posted by an app"}`)
+	if rec.Code != 201 {
+		t.Fatalf("Expected the client to post a chirp, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var chirp Chirp
+	json.NewDecoder(rec.Body).Decode(&chirp)
+	if chirp.UserID != user.ID {
+		t.Errorf("Expected the chirp to belong to the user, got %v", chirp.UserID)
+	}
+
+	if required, _ := consent(); required {
+		t.Error("Expected no consent for already granted scopes")
+	}
+	rec = callWithToken(handlerGetOAuthGrants, "GET", "/api/users/me/oauth/grants", bearer(t, user.ID)[len("Bearer "):], "")
+	var grants []OAuthGrant
+	json.NewDecoder(rec.Body).Decode(&grants)
+	if len(grants) != 1 || grants[0].ClientID != client.ID || grants[0].ClientName != "Chirp Reader" || len(grants[0].Scopes) != 2 {
+		t.Errorf("Unexpected grants %+v", grants)
+	}
+}
+
+func TestOAuthAuthorizeRejections(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	client := registerOAuthClient(t, user.ID, false)
+
+	cases := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{"unknown client", "client_id", uuid.NewString()},
+		{"unregistered redirect", "redirect_uri", "https://evil.example/callback"},
+		{"redirect prefix", "redirect_uri", testRedirectURI + "/../steal"},
+		{"implicit flow", "response_type", "token"},
+		{"no scope", "scope", ""},
+		{"unknown scope", "scope", "read:chirps admin"},
+		{"no challenge", "code_challenge", ""},
+		{"plain challenge", "code_challenge_method", "plain"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := authorizationParams(client, "read:chirps")
+			params[tc.key] = tc.value
+			params["approve"] = true
+			if rec := postAuthorization(t, user.ID, params); rec.Code != 400 {
+				t.Errorf("Expected status 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+	if len(db.oauthCodes) != 0 || len(db.oauthGrants) != 0 {
+		t.Error("Expected rejected requests to issue nothing")
+	}
+
+	rec := postAuthorization(t, user.ID, authorizationParams(client, "read:chirps"))
+	var resp struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.RedirectTo != testRedirectURI+"?error=access_denied&state=xyz" {
+		t.Errorf("Expected access_denied redirect, got %d %q", rec.Code, resp.RedirectTo)
+	}
+	if len(db.oauthCodes) != 0 || len(db.oauthGrants) != 0 {
+		t.Error("Expected a denied request to issue nothing")
+	}
+}
+
+func TestOAuthTokenRejections(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	client := registerOAuthClient(t, user.ID, false)
+	other := registerOAuthClient(t, user.ID, false)
+
+	cases := []struct {
+		name       string
+		change     func(url.Values)
+		wantStatus int
+		wantError  string
+	}{
+		{"wrong verifier", func(f url.Values) { f.Set("code_verifier", strings.Repeat("a", 43)) }, 400, "invalid_grant"},
+		{"missing verifier", func(f url.Values) { f.Del("code_verifier") }, 400, "invalid_grant"},
+		{"wrong redirect", func(f url.Values) { f.Set("redirect_uri", "http://127.0.0.1:8123/cb") }, 400, "invalid_grant"},
+		{"other client", func(f url.Values) { f.Set("client_id", other.ID.String()) }, 400, "invalid_grant"},
+		{"unknown client", func(f url.Values) { f.Set("client_id", uuid.NewString()) }, 401, "invalid_client"},
+		{"unknown code", func(f url.Values) { f.Set("code", "nope") }, 400, "invalid_grant"},
+		{"password grant", func(f url.Values) { f.Set("grant_type", "password") }, 400, "unsupported_grant_type"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			code := authorizeCode(t, user.ID, client, "read:chirps")
+			form := codeForm(client, code)
+			tc.change(form)
+			rec := exchangeCode(form, nil)
+			var resp struct {
+				Error string `json:"error"`
+			}
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if rec.Code != tc.wantStatus || resp.Error != tc.wantError {
+				t.Errorf("Expected %d %s, got %d %s", tc.wantStatus, tc.wantError, rec.Code, resp.Error)
+			}
+		})
+	}
+
+	// A code is spent by a failed exchange as well as a successful one.
+	code := authorizeCode(t, user.ID, client, "read:chirps")
+	form := codeForm(client, code)
+	form.Set("code_verifier", strings.Repeat("a", 43))
+	exchangeCode(form, nil)
+	if rec := exchangeCode(codeForm(client, code), nil); rec.Code != 400 {
+		t.Errorf("Expected a code spent by a failed exchange to be rejected, got %d", rec.Code)
+	}
+	code = authorizeCode(t, user.ID, client, "read:chirps")
+	if rec := exchangeCode(codeForm(client, code), nil); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := exchangeCode(codeForm(client, code), nil); rec.Code != 400 {
+		t.Errorf("Expected a reused code to be rejected, got %d", rec.Code)
+	}
+
+	code = authorizeCode(t, user.ID, client, "read:chirps")
+	for k, c := range db.oauthCodes {
+		c.ExpiresAt = time.Now().Add(-time.Second)
+		db.oauthCodes[k] = c
+	}
+	if rec := exchangeCode(codeForm(client, code), nil); rec.Code != 400 {
+		t.Errorf("Expected an expired code to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestOAuthConfidentialClient(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	client := registerOAuthClient(t, user.ID, true)
+	if !client.Confidential || client.ClientSecret == "" {
+		t.Fatalf("Expected a client secret, got %+v", client)
+	}
+	rec := callWithToken(handlerGetOAuthClients, "GET", "/api/oauth/clients", bearer(t, user.ID)[len("Bearer "):], "")
+	if strings.Contains(rec.Body.String(), client.ClientSecret) {
+		t.Error("Expected the secret to be shown only once")
+	}
+
+	rec = exchangeCode(codeForm(client, authorizeCode(t, user.ID, client, "read:chirps")), nil)
+	if rec.Code != 401 {
+		t.Errorf("Expected a missing secret to be rejected, got %d", rec.Code)
+	}
+	rec = exchangeCode(codeForm(client, authorizeCode(t, user.ID, client, "read:chirps")), func(r *http.Request) {
+		r.SetBasicAuth(client.ID.String(), "wrong")
+	})
+	if rec.Code != 401 || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Errorf("Expected a Basic challenge for a wrong secret, got %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	rec = exchangeCode(codeForm(client, authorizeCode(t, user.ID, client, "read:chirps")), func(r *http.Request) {
+		r.SetBasicAuth(client.ID.String(), client.ClientSecret)
+	})
+	if rec.Code != 200 {
+		t.Errorf("Expected Basic client authentication to work, got %d: %s", rec.Code, rec.Body.String())
+	}
+	form := codeForm(client, authorizeCode(t, user.ID, client, "read:chirps"))
+	form.Set("client_secret", client.ClientSecret)
+	if rec := exchangeCode(form, nil); rec.Code != 200 {
+		t.Errorf("Expected client_secret to work, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestOAuthScopeEnforcement(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	client := registerOAuthClient(t, user.ID, false)
+	token := oauthAccessToken(t, user.ID, client, "read:chirps")
+
+	rec := callAs(requireScope(scopeWriteChirps, handlerChirps), "POST", "/api/chirps", token, `{"body":"hello"}`)
+	if rec.Code != 403 || rec.Header().Get("WWW-Authenticate") != `Bearer realm="chirpy", error="insufficient_scope", scope="write:chirps"` {
+		t.Errorf("Expected insufficient_scope, got %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", token, ""); rec.Code != 200 {
+		t.Errorf("Expected the client to read chirps, got %d", rec.Code)
+	}
+	if rec := callAs(optionalScope(scopeWriteChirps, handlerGetChirps), "GET", "/api/chirps", token, ""); rec.Code != 403 {
+		t.Errorf("Expected optionalScope to enforce scope, got %d", rec.Code)
+	}
+
+	// Account management stays first-party only, whatever was granted.
+	for _, handler := range []http.HandlerFunc{handlerGetSessions, handlerGetOAuthGrants, handlerEnrollTOTP} {
+		if rec := callWithToken(handler, "GET", "/", token, ""); rec.Code != 403 {
+			t.Errorf("Expected first-party route to refuse client token, got %d", rec.Code)
+		}
+	}
+	if rec := callAs(requireScope(scopeWriteChirps, handlerChirps), "POST", "/api/chirps", bearer(t, user.ID)[len("Bearer "):], `{"body":"hello"}`); rec.Code != 201 {
+		t.Errorf("Expected first-party token to have every scope, got %d", rec.Code)
+	}
+
+	// Narrowing the grant narrows tokens already issued.
+	db.UpsertOAuthGrant(t.Context(), database.UpsertOAuthGrantParams{UserID: user.ID, ClientID: client.ID, Scopes: []string{scopeWriteChirps}})
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", token, ""); rec.Code != 403 {
+		t.Errorf("Expected a narrowed grant to apply to issued tokens, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("DELETE", "/api/users/me/oauth/grants/"+client.ID.String(), nil)
+	req.SetPathValue("clientID", client.ID.String())
+	req.Header.Set("Authorization", bearer(t, user.ID))
+	rec = httptest.NewRecorder()
+	requireAuth(handlerRevokeOAuthGrant)(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d", rec.Code)
+	}
+	if rec := callAs(optionalScope(scopeWriteChirps, handlerGetChirps), "GET", "/api/chirps", token, ""); rec.Code != 401 {
+		t.Errorf("Expected a revoked grant to revoke its tokens, got %d", rec.Code)
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	for uri, want := range map[string]bool{
+		"https://app.example/callback":   true,
+		"https://app.example/cb?x=1":     true,
+		"http://127.0.0.1:8123/cb":       true,
+		"http://[::1]/cb":                true,
+		"http://localhost:3000/cb":       true,
+		"http://app.example/callback":    false,
+		"https://app.example/cb#frag":    false,
+		"https://user:pw@app.example/cb": false,
+		"/callback":                      false,
+		"javascript:alert(1)":            false,
+		"https://":                       false,
+	} {
+		if got := validRedirectURI(uri); got != want {
+			t.Errorf("validRedirectURI(%q) = %v, want %v", uri, got, want)
+		}
+	}
+}
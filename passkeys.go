@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+const (
+	// webauthnCeremonyTTL is how long a passkey challenge can be answered.
+	webauthnCeremonyTTL = 5 * time.Minute
+
+	ceremonyRegistration   = "registration"
+	ceremonyAuthentication = "authentication"
+)
+
+// relyingPartyFromEnv identifies this server to authenticators. The RP ID
+// defaults to the host of PUBLIC_URL and the only allowed origin to
+// PUBLIC_URL itself; WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS (comma separated)
+// override them.
+func relyingPartyFromEnv(publicURL string) (auth.RelyingParty, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil || u.Host == "" {
+		return auth.RelyingParty{}, fmt.Errorf("invalid PUBLIC_URL %q", publicURL)
+	}
+	rp := auth.RelyingParty{
+		ID:      u.Hostname(),
+		Name:    "Chirpy",
+		Origins: []string{u.Scheme + "://" + u.Host},
+	}
+	if v := os.Getenv("WEBAUTHN_RP_ID"); v != "" {
+		rp.ID = v
+	}
+	if v := os.Getenv("WEBAUTHN_ORIGINS"); v != "" {
+		rp.Origins = strings.Split(v, ",")
+	}
+	return rp, nil
+}
+
+// Passkey is a registered WebAuthn credential.
+type Passkey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func convertPasskey(c database.WebauthnCredential) Passkey {
+	p := Passkey{
+		ID:        base64.RawURLEncoding.EncodeToString(c.ID),
+		Name:      c.Name,
+		CreatedAt: c.CreatedAt,
+	}
+	if c.LastUsedAt.Valid {
+		p.LastUsedAt = &c.LastUsedAt.Time
+	}
+	return p
+}
+
+// publicKeyCredential is a PublicKeyCredential as serialized by the
+// browser's toJSON(), with binary fields base64url encoded.
+type publicKeyCredential struct {
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// decodeBase64URL accepts base64url with or without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// creationOptions is PublicKeyCredentialCreationOptionsJSON.
+type creationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// requestOptions is PublicKeyCredentialRequestOptionsJSON. No credentials
+// are listed, so the authenticator offers any passkey it has for Chirpy.
+type requestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// newWebAuthnChallenge stores a single-use challenge for a ceremony.
+func newWebAuthnChallenge(ctx context.Context, ceremony string, userID uuid.NullUUID) (string, error) {
+	// Expired challenges are never consumed, so sweep them here.
+	if err := apiCfg.dbQueries.DeleteExpiredWebAuthnChallenges(ctx); err != nil {
+		return "", err
+	}
+	challenge, err := auth.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	err = apiCfg.dbQueries.CreateWebAuthnChallenge(ctx, database.CreateWebAuthnChallengeParams{
+		Challenge:  challenge,
+		Ceremony:   ceremony,
+		UserID:     userID,
+		TtlSeconds: webauthnCeremonyTTL.Seconds(),
+	})
+	return challenge, err
+}
+
+// consumeWebAuthnChallenge finds the challenge clientDataJSON answers and
+// spends it, so each ceremony can complete at most once. It returns
+// sql.ErrNoRows if there is no such unexpired challenge.
+func consumeWebAuthnChallenge(ctx context.Context, ceremony string, clientDataJSON []byte) (database.WebauthnChallenge, error) {
+	clientData, err := auth.ParseClientData(clientDataJSON)
+	if err != nil {
+		return database.WebauthnChallenge{}, sql.ErrNoRows
+	}
+	return apiCfg.dbQueries.ConsumeWebAuthnChallenge(ctx, database.ConsumeWebAuthnChallengeParams{
+		Challenge: clientData.Challenge,
+		Ceremony:  ceremony,
+	})
+}
+
+// handlerBeginPasskeyRegistration asks for the current password, since a
+// passkey signs the user in without it or a second factor. The challenge it
+// issues is what lets handlerFinishPasskeyRegistration store the passkey.
+func handlerBeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	var params struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxCredentialsBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if !confirmPassword(w, r, user, params.CurrentPassword) {
+		return
+	}
+	existing, err := apiCfg.dbQueries.GetWebAuthnCredentialsForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get passkeys: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	challenge, err := newWebAuthnChallenge(r.Context(), ceremonyRegistration, uuid.NullUUID{UUID: userID, Valid: true})
+	if err != nil {
+		log.Printf("Unable to create WebAuthn challenge: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	options := creationOptions{
+		Challenge: challenge,
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: auth.COSEAlgEdDSA},
+			{Type: "public-key", Alg: auth.COSEAlgES256},
+		},
+		Timeout:            webauthnCeremonyTTL.Milliseconds(),
+		ExcludeCredentials: []credentialDescriptor{},
+		Attestation:        "none",
+	}
+	options.RP.ID = apiCfg.relyingParty.ID
+	options.RP.Name = apiCfg.relyingParty.Name
+	options.User.ID = base64.RawURLEncoding.EncodeToString(user.ID[:])
+	options.User.Name = user.Email
+	options.User.DisplayName = user.Email
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	for _, c := range existing {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, credentialDescriptor{
+			Type: "public-key",
+			ID:   base64.RawURLEncoding.EncodeToString(c.ID),
+		})
+	}
+	respondWithJSON(w, 200, options)
+}
+
+func handlerFinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	var params struct {
+		Name       string              `json:"name"`
+		Credential publicKeyCredential `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	clientDataJSON, err1 := decodeBase64URL(params.Credential.Response.ClientDataJSON)
+	attestationObject, err2 := decodeBase64URL(params.Credential.Response.AttestationObject)
+	if err1 != nil || err2 != nil || params.Credential.Type != "public-key" {
+		respondWithError(w, 400, "Invalid credential")
+		return
+	}
+
+	challenge, err := consumeWebAuthnChallenge(r.Context(), ceremonyRegistration, clientDataJSON)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && challenge.UserID.UUID != userID) {
+		respondWithError(w, 400, "Invalid or expired passkey challenge")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to get WebAuthn challenge: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	credential, err := apiCfg.relyingParty.VerifyRegistration(challenge.Challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Invalid credential: %v", err))
+		return
+	}
+
+	passkey, err := apiCfg.dbQueries.CreateWebAuthnCredential(r.Context(), database.CreateWebAuthnCredentialParams{
+		ID:        credential.ID,
+		UserID:    userID,
+		PublicKey: credential.PublicKey,
+		SignCount: int64(credential.SignCount),
+		Name:      params.Name,
+	})
+	if isUniqueViolation(err) {
+		respondWithError(w, 409, "Passkey is already registered")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to create passkey: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 201, convertPasskey(passkey))
+}
+
+func handlerGetPasskeys(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	credentials, err := apiCfg.dbQueries.GetWebAuthnCredentialsForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get passkeys: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	passkeys := []Passkey{}
+	for _, c := range credentials {
+		passkeys = append(passkeys, convertPasskey(c))
+	}
+	respondWithJSON(w, 200, passkeys)
+}
+
+func handlerDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	id, err := decodeBase64URL(r.PathValue("passkeyID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid passkeyID")
+		return
+	}
+	deleted, err := apiCfg.dbQueries.DeleteWebAuthnCredentialForUser(r.Context(), database.DeleteWebAuthnCredentialForUserParams{
+		ID:     id,
+		UserID: userID,
+	})
+	if err != nil {
+		log.Printf("Unable to delete passkey: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, 404, "Passkey not found")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
+
+func handlerBeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	challenge, err := newWebAuthnChallenge(r.Context(), ceremonyAuthentication, uuid.NullUUID{})
+	if err != nil {
+		log.Printf("Unable to create WebAuthn challenge: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 200, requestOptions{
+		Challenge:        challenge,
+		RPID:             apiCfg.relyingParty.ID,
+		Timeout:          webauthnCeremonyTTL.Milliseconds(),
+		AllowCredentials: []credentialDescriptor{},
+		UserVerification: "preferred",
+	})
+}
+
+// handlerFinishPasskeyLogin checks a passkey assertion and starts a session
+// the same way a password login does.
+func handlerFinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Credential publicKeyCredential `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	if retryAfter := apiCfg.loginIPThrottle.Check(clientIP(r)); retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter)
+		return
+	}
+	user, err := verifyPasskeyAssertion(r.Context(), params.Credential)
+	if errors.Is(err, errPasskeyRejected) {
+		apiCfg.loginIPThrottle.Fail(clientIP(r))
+		respondWithError(w, 401, "Passkey sign-in failed")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to verify passkey: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	issueSession(w, r, user)
+}
+
+var errPasskeyRejected = errors.New("passkey rejected")
+
+// verifyPasskeyAssertion returns the user a passkey assertion proves to be
+// present. Any problem with the assertion itself is errPasskeyRejected.
+func verifyPasskeyAssertion(ctx context.Context, cred publicKeyCredential) (database.User, error) {
+	rawID, err1 := decodeBase64URL(cred.RawID)
+	clientDataJSON, err2 := decodeBase64URL(cred.Response.ClientDataJSON)
+	authenticatorData, err3 := decodeBase64URL(cred.Response.AuthenticatorData)
+	signature, err4 := decodeBase64URL(cred.Response.Signature)
+	userHandle, err5 := decodeBase64URL(cred.Response.UserHandle)
+	if err := errors.Join(err1, err2, err3, err4, err5); err != nil || cred.Type != "public-key" {
+		return database.User{}, errPasskeyRejected
+	}
+
+	challenge, err := consumeWebAuthnChallenge(ctx, ceremonyAuthentication, clientDataJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, errPasskeyRejected
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+
+	stored, err := apiCfg.dbQueries.GetWebAuthnCredential(ctx, rawID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, errPasskeyRejected
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+	if len(userHandle) != 0 && !bytes.Equal(userHandle, stored.UserID[:]) {
+		return database.User{}, errPasskeyRejected
+	}
+
+	signCount, err := apiCfg.relyingParty.VerifyAssertion(challenge.Challenge, stored.PublicKey, uint32(stored.SignCount),
+		clientDataJSON, authenticatorData, signature)
+	if err != nil {
+		if errors.Is(err, auth.ErrSignCountRegressed) {
+			log.Printf("Passkey %x reported a stale sign count, it may be cloned", stored.ID)
+		}
+		return database.User{}, errPasskeyRejected
+	}
+	// Compare-and-swap on the old count so two uses racing with the same
+	// counter value cannot both succeed.
+	updated, err := apiCfg.dbQueries.UpdateWebAuthnSignCount(ctx, database.UpdateWebAuthnSignCountParams{
+		SignCount:         int64(signCount),
+		ID:                stored.ID,
+		PreviousSignCount: stored.SignCount,
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+	if updated == 0 {
+		return database.User{}, errPasskeyRejected
+	}
+
+	return apiCfg.dbQueries.GetUserByID(ctx, stored.UserID)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/softauthn"
+)
+
+const testOrigin = "http://chirpy.test"
+
+func beginPasskeyRegistration(t *testing.T, userID uuid.UUID) creationOptions {
+	t.Helper()
+	rec := callWithToken(handlerBeginPasskeyRegistration, "POST", "/api/users/me/passkeys/register/begin", bearer(t, userID)[len("Bearer "):], `{"current_password":"correct horse battery staple"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var options creationOptions
+	json.NewDecoder(rec.Body).Decode(&options)
+	return options
+}
+
+func finishPasskeyRegistration(t *testing.T, userID uuid.UUID, name string, att softauthn.Attestation) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"name": name, "credential": att})
+	return callWithToken(handlerFinishPasskeyRegistration, "POST", "/api/users/me/passkeys/register/finish", bearer(t, userID)[len("Bearer "):], string(body))
+}
+
+// registerPasskey runs a full registration ceremony for the user.
+func registerPasskey(t *testing.T, authenticator *softauthn.Authenticator, userID uuid.UUID) Passkey {
+	t.Helper()
+	options := beginPasskeyRegistration(t, userID)
+	userHandle, _ := base64.RawURLEncoding.DecodeString(options.User.ID)
+	att, err := authenticator.Register(testOrigin, options.RP.ID, options.Challenge, userHandle, softauthn.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := finishPasskeyRegistration(t, userID, "laptop", att)
+	if rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var passkey Passkey
+	json.NewDecoder(rec.Body).Decode(&passkey)
+	return passkey
+}
+
+func beginPasskeyLogin(t *testing.T) requestOptions {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handlerBeginPasskeyLogin(rec, httptest.NewRequest("POST", "/api/login/passkey/begin", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var options requestOptions
+	json.NewDecoder(rec.Body).Decode(&options)
+	return options
+}
+
+func finishPasskeyLogin(assertion softauthn.Assertion) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]any{"credential": assertion})
+	req := httptest.NewRequest("POST", "/api/login/passkey/finish", strings.NewReader(string(body)))
+	rec := httptest.NewRecorder()
+	handlerFinishPasskeyLogin(rec, req)
+	return rec
+}
+
+func passkeyAssertion(t *testing.T, authenticator *softauthn.Authenticator) softauthn.Assertion {
+	t.Helper()
+	options := beginPasskeyLogin(t)
+	assertion, err := authenticator.Login(testOrigin, options.RPID, options.Challenge, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	authenticator := softauthn.New()
+	passkey := registerPasskey(t, authenticator, user.ID)
+	if passkey.Name != "laptop" || passkey.LastUsedAt != nil {
+		t.Errorf("Unexpected passkey %+v", passkey)
+	}
+
+	rec := finishPasskeyLogin(passkeyAssertion(t, authenticator))
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var session User
+	json.NewDecoder(rec.Body).Decode(&session)
+	if session.ID != user.ID || session.Token == "" || session.RefreshToken == "" {
+		t.Fatalf("Expected a session for the user, got %+v", session)
+	}
+	if rec := refresh(session.RefreshToken); rec.Code != 200 {
+		t.Errorf("Expected refresh token to work, got %d", rec.Code)
+	}
+
+	rec = callWithToken(handlerGetPasskeys, "GET", "/api/users/me/passkeys", session.Token, "")
+	var passkeys []Passkey
+	json.NewDecoder(rec.Body).Decode(&passkeys)
+	if len(passkeys) != 1 || passkeys[0].ID != passkey.ID || passkeys[0].LastUsedAt == nil {
+		t.Errorf("Expected the used passkey to be listed, got %+v", passkeys)
+	}
+}
+
+func TestPasskeyLoginRejections(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	authenticator := softauthn.New()
+	passkey := registerPasskey(t, authenticator, user.ID)
+	credentialID, _ := base64.RawURLEncoding.DecodeString(passkey.ID)
+
+	assertion := passkeyAssertion(t, authenticator)
+	if rec := finishPasskeyLogin(assertion); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := finishPasskeyLogin(assertion); rec.Code != 401 {
+		t.Errorf("Expected a replayed assertion to be rejected, got %d", rec.Code)
+	}
+
+	options := beginPasskeyLogin(t)
+	wrongOrigin, _ := authenticator.Login("http://evil.test", options.RPID, options.Challenge, nil)
+	if rec := finishPasskeyLogin(wrongOrigin); rec.Code != 401 {
+		t.Errorf("Expected wrong origin to be rejected, got %d", rec.Code)
+	}
+
+	// A registration challenge cannot be answered as a login.
+	registration := beginPasskeyRegistration(t, user.ID)
+	crossCeremony, _ := authenticator.Login(testOrigin, "chirpy.test", registration.Challenge, nil)
+	if rec := finishPasskeyLogin(crossCeremony); rec.Code != 401 {
+		t.Errorf("Expected registration challenge to be rejected, got %d", rec.Code)
+	}
+
+	// A counter going backwards suggests a cloned authenticator.
+	authenticator.SetSignCount(credentialID, 0)
+	if rec := finishPasskeyLogin(passkeyAssertion(t, authenticator)); rec.Code != 401 {
+		t.Errorf("Expected a regressed sign count to be rejected, got %d", rec.Code)
+	}
+
+	expired := passkeyAssertion(t, authenticator)
+	for k, c := range db.challenges {
+		c.ExpiresAt = time.Now().Add(-time.Second)
+		db.challenges[k] = c
+	}
+	if rec := finishPasskeyLogin(expired); rec.Code != 401 {
+		t.Errorf("Expected an expired challenge to be rejected, got %d", rec.Code)
+	}
+
+	unregistered := softauthn.New()
+	unregistered.Register(testOrigin, "chirpy.test", "unused", user.ID[:], softauthn.EdDSA)
+	if rec := finishPasskeyLogin(passkeyAssertion(t, unregistered)); rec.Code != 401 {
+		t.Errorf("Expected an unknown credential to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	other := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+	authenticator := softauthn.New()
+	passkey := registerPasskey(t, authenticator, user.ID)
+
+	options := beginPasskeyRegistration(t, user.ID)
+	if len(options.ExcludeCredentials) != 1 || options.ExcludeCredentials[0].ID != passkey.ID {
+		t.Errorf("Expected the existing passkey to be excluded, got %+v", options.ExcludeCredentials)
+	}
+	if options.RP.ID != "chirpy.test" || options.User.Name != "user@example.com" {
+		t.Errorf("Unexpected options %+v", options)
+	}
+
+	// The challenge belongs to the user who asked for it.
+	att, _ := authenticator.Register(testOrigin, "chirpy.test", options.Challenge, other.ID[:], softauthn.ES256)
+	if rec := finishPasskeyRegistration(t, other.ID, "stolen", att); rec.Code != 400 {
+		t.Errorf("Expected another user's challenge to be rejected, got %d", rec.Code)
+	}
+
+	options = beginPasskeyRegistration(t, user.ID)
+	att, _ = authenticator.Register("http://evil.test", "chirpy.test", options.Challenge, user.ID[:], softauthn.ES256)
+	if rec := finishPasskeyRegistration(t, user.ID, "phished", att); rec.Code != 400 {
+		t.Errorf("Expected wrong origin to be rejected, got %d", rec.Code)
+	}
+	if rec := finishPasskeyRegistration(t, user.ID, "again", att); rec.Code != 400 {
+		t.Errorf("Expected a spent challenge to be rejected, got %d", rec.Code)
+	}
+
+	// A stolen access token alone cannot add a passkey.
+	for name, body := range map[string]string{
+		"no password":    `{}`,
+		"wrong password": `{"current_password":"wrong"}`,
+	} {
+		rec := callWithToken(handlerBeginPasskeyRegistration, "POST", "/api/users/me/passkeys/register/begin", bearer(t, user.ID)[len("Bearer "):], body)
+		if rec.Code != 403 {
+			t.Errorf("%s: expected status 403, got %d", name, rec.Code)
+		}
+	}
+}
+
+func TestDeletePasskey(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	other := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+	authenticator := softauthn.New()
+	passkey := registerPasskey(t, authenticator, user.ID)
+
+	deletePasskey := func(userID uuid.UUID, id string) int {
+		req := httptest.NewRequest("DELETE", "/api/users/me/passkeys/"+id, nil)
+		req.SetPathValue("passkeyID", id)
+		req.Header.Set("Authorization", bearer(t, userID))
+		rec := httptest.NewRecorder()
+		requireAuth(handlerDeletePasskey)(rec, req)
+		return rec.Code
+	}
+	if code := deletePasskey(other.ID, passkey.ID); code != 404 {
+		t.Errorf("Expected another user's passkey to be not found, got %d", code)
+	}
+	if code := deletePasskey(user.ID, "!!"); code != 400 {
+		t.Errorf("Expected invalid ID to be rejected, got %d", code)
+	}
+	if code := deletePasskey(user.ID, passkey.ID); code != 204 {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+	if rec := finishPasskeyLogin(passkeyAssertion(t, authenticator)); rec.Code != 401 {
+		t.Errorf("Expected deleted passkey to stop working, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+	"github.com/thmastin/Chirpy/internal/mail"
+	"github.com/thmastin/Chirpy/internal/throttle"
+)
+
+// passwordResetTTL is how long an emailed reset token can be used.
+const passwordResetTTL = 30 * time.Minute
+
+// passwordResetPolicy limits how often reset emails can be requested for one
+// address or from one client.
+var passwordResetPolicy = throttle.Policy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Minute,
+	MaxDelay:         time.Hour,
+	LockoutThreshold: 10,
+	LockoutDuration:  24 * time.Hour,
+	Window:           24 * time.Hour,
+}
+
+const passwordResetRequestedMessage = "If this email is registered, a password reset token is on its way."
+
+// sendPasswordResetEmail stores the hash of a new single-use reset token for
+// user and mails them the token.
+func sendPasswordResetEmail(ctx context.Context, user database.User) error {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return err
+	}
+	err = apiCfg.dbQueries.CreatePasswordResetToken(ctx, database.CreatePasswordResetTokenParams{
+		TokenHash:  auth.HashRefreshToken(token),
+		UserID:     user.ID,
+		TtlSeconds: passwordResetTTL.Seconds(),
+	})
+	if err != nil {
+		return err
+	}
+	return apiCfg.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\nUse this token to choose a new password within %d minutes:\n\n%s\n\nIf it was not you, you can ignore this email and your password will stay the same.\n",
+			int(passwordResetTTL.Minutes()), token),
+	})
+}
+
+// sendNoAccountEmail answers a reset request for an address with no account,
+// so both cases do a similar amount of work.
+func sendNoAccountEmail(ctx context.Context, email string) error {
+	return apiCfg.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Reset your Chirpy password",
+		Body:    "Someone asked to reset the password for a Chirpy account with this email address, but there is no such account. If it was not you, you can ignore this email.\n",
+	})
+}
+
+func handlerRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	params.Email = normalizeEmail(params.Email)
+	emailKey := loginAccountKey(params.Email)
+	ipKey := "ip:" + clientIP(r)
+	retryAfter := max(apiCfg.passwordResetThrottle.Check(emailKey), apiCfg.passwordResetThrottle.Check(ipKey))
+	if retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter)
+		return
+	}
+	apiCfg.passwordResetThrottle.Fail(emailKey)
+	apiCfg.passwordResetThrottle.Fail(ipKey)
+
+	// Respond the same way whether or not the address is registered.
+	user, err := apiCfg.dbQueries.GetUserByEmail(r.Context(), params.Email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = sendNoAccountEmail(r.Context(), params.Email)
+	case err != nil:
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	default:
+		err = sendPasswordResetEmail(r.Context(), user)
+	}
+	if err != nil {
+		log.Printf("Unable to send password reset email: %v", err)
+	}
+	respondWithJSON(w, 202, signupResponse{Message: passwordResetRequestedMessage})
+}
+
+// handlerConfirmPasswordReset spends a reset token to set a new password. The
+// reset logs the user out everywhere: refresh tokens are revoked and the
+// token version bump invalidates outstanding access tokens.
+func handlerConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxCredentialsBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	tokenHash := auth.HashRefreshToken(params.Token)
+
+	resetToken, err := apiCfg.dbQueries.GetPasswordResetToken(r.Context(), tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 400, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to get password reset token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), resetToken.UserID)
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	// Check the new password before spending the token so a rejected
+	// password can be retried with the same token.
+	if !validatePassword(w, params.Password, user.Email) {
+		return
+	}
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	consumed, err := apiCfg.dbQueries.ConsumePasswordResetToken(r.Context(), tokenHash)
+	if err != nil {
+		log.Printf("Unable to consume password reset token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if consumed == 0 {
+		respondWithError(w, 400, "Invalid or expired reset token")
+		return
+	}
+
+	err = apiCfg.dbQueries.ResetUserPassword(r.Context(), database.ResetUserPasswordParams{
+		HashedPassword: hashedPassword,
+		ID:             user.ID,
+	})
+	if err != nil {
+		log.Printf("Unable to reset password: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	err = apiCfg.dbQueries.InvalidatePasswordResetTokensForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Unable to invalidate password reset tokens: %v", err)
+	}
+	err = apiCfg.dbQueries.RevokeAllRefreshTokensForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Unable to revoke sessions: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	err = apiCfg.dbQueries.DeletePersonalAccessTokensForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Unable to revoke personal access tokens: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	// A passkey would sign in without the new password, so whoever lost
+	// control of the account has to enrol them again.
+	err = apiCfg.dbQueries.DeleteWebAuthnCredentialsForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Unable to revoke passkeys: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	apiCfg.loginAccountThrottle.Reset(loginAccountKey(user.Email))
+
+	respondWithJSON(w, 200, signupResponse{Message: "Your password has been reset. Log in with your new password."})
+}
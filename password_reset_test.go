@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/softauthn"
+)
+
+var resetTokenPattern = regexp.MustCompile(`(?m)^[0-9a-f]{64}$`)
+
+// resetToken pulls the token out of the most recent email to address.
+func resetToken(t *testing.T, address string) string {
+	t.Helper()
+	messages := sentMail()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != address {
+			continue
+		}
+		if token := resetTokenPattern.FindString(messages[i].Body); token != "" {
+			return token
+		}
+		break
+	}
+	t.Fatalf("No password reset email sent to %s", address)
+	return ""
+}
+
+func requestPasswordReset(email string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/password-reset/request", strings.NewReader(`{"email":"`+email+`"}`))
+	rec := httptest.NewRecorder()
+	handlerRequestPasswordReset(rec, req)
+	return rec
+}
+
+func confirmPasswordReset(token, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/password-reset/confirm", strings.NewReader(`{"token":"`+token+`","password":"`+password+`"}`))
+	rec := httptest.NewRecorder()
+	handlerConfirmPasswordReset(rec, req)
+	return rec
+}
+
+func TestPasswordReset(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+	pat := newPersonalAccessToken(t, user.ID, `{"name":"bot","scopes":["read:chirps"],"current_password":"correct horse battery staple"}`)
+	authenticator := softauthn.New()
+	registerPasskey(t, authenticator, user.ID)
+
+	if rec := requestPasswordReset("user@example.com"); rec.Code != 202 {
+		t.Fatalf("Expected status 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	token := resetToken(t, "user@example.com")
+	if _, ok := db.resetTokens[token]; ok {
+		t.Error("Expected the reset token to be stored hashed")
+	}
+
+	// A rejected password leaves the token usable.
+	if rec := confirmPasswordReset(token, "password"); rec.Code != 400 {
+		t.Errorf("Expected weak password to be rejected, got %d", rec.Code)
+	}
+	if rec := confirmPasswordReset(token, "purple monkey dishwasher"); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := confirmPasswordReset(token, "another fine password"); rec.Code != 400 {
+		t.Errorf("Expected a used token to be rejected, got %d", rec.Code)
+	}
+
+	if rec := login("user@example.com", "correct horse battery staple"); rec.Code != 401 {
+		t.Errorf("Expected old password to stop working, got %d", rec.Code)
+	}
+	if rec := login("user@example.com", "purple monkey dishwasher"); rec.Code != 200 {
+		t.Errorf("Expected new password to work, got %d", rec.Code)
+	}
+
+	// Every existing session is logged out.
+	if rec := refresh(session.RefreshToken); rec.Code != 401 {
+		t.Errorf("Expected refresh token to be revoked, got %d", rec.Code)
+	}
+	if rec := updateLogin(session.Token, `{"email":"user@example.com","password":"purple monkey dishwasher"}`); rec.Code != 401 {
+		t.Errorf("Expected access token to be revoked, got %d", rec.Code)
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", pat.Token, ""); rec.Code != 401 {
+		t.Errorf("Expected personal access token to be revoked, got %d", rec.Code)
+	}
+	if rec := finishPasskeyLogin(passkeyAssertion(t, authenticator)); rec.Code != 401 {
+		t.Errorf("Expected passkey to be revoked, got %d", rec.Code)
+	}
+
+	// Receiving the token proves ownership of the address.
+	reset, _ := db.GetUserByID(t.Context(), user.ID)
+	if !reset.EmailVerifiedAt.Valid {
+		t.Error("Expected reset to mark the email verified")
+	}
+}
+
+func TestPasswordResetInvalidatesOtherTokens(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	requestPasswordReset("user@example.com")
+	first := resetToken(t, "user@example.com")
+	requestPasswordReset("user@example.com")
+	second := resetToken(t, "user@example.com")
+
+	if rec := confirmPasswordReset(second, "purple monkey dishwasher"); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := confirmPasswordReset(first, "another fine password"); rec.Code != 400 {
+		t.Errorf("Expected earlier token to be spent by the reset, got %d", rec.Code)
+	}
+}
+
+func TestPasswordResetRejectsBadTokens(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	requestPasswordReset("user@example.com")
+	token := resetToken(t, "user@example.com")
+	hash := auth.HashRefreshToken(token)
+	expired := db.resetTokens[hash]
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	db.resetTokens[hash] = expired
+
+	for name, token := range map[string]string{
+		"expired":      token,
+		"unknown":      strings.Repeat("0", 64),
+		"access token": bearer(t, user.ID)[len("Bearer "):],
+		"empty":        "",
+	} {
+		if rec := confirmPasswordReset(token, "purple monkey dishwasher"); rec.Code != 400 {
+			t.Errorf("Expected %s token to be rejected, got %d", name, rec.Code)
+		}
+	}
+	if rec := login("user@example.com", "correct horse battery staple"); rec.Code != 200 {
+		t.Errorf("Expected password to be unchanged, got %d", rec.Code)
+	}
+}
+
+func TestPasswordResetRequestDoesNotRevealAccounts(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	known := requestPasswordReset("user@example.com")
+	unknown := requestPasswordReset("nobody@example.com")
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Errorf("Expected identical responses, got %d %q and %d %q",
+			known.Code, known.Body.String(), unknown.Code, unknown.Body.String())
+	}
+
+	messages := sentMail()
+	if len(messages) != 2 || messages[1].To != "nobody@example.com" || resetTokenPattern.MatchString(messages[1].Body) {
+		t.Errorf("Expected a no-account notice without a token, got %+v", messages)
+	}
+	if len(db.resetTokens) != 1 {
+		t.Errorf("Expected one stored reset token, got %d", len(db.resetTokens))
+	}
+}
+
+func TestPasswordResetRequestThrottle(t *testing.T) {
+	setupTestAPI(t)
+
+	for i := 0; i <= passwordResetPolicy.FreeAttempts; i++ {
+		if rec := requestPasswordReset("user@example.com"); rec.Code != 202 {
+			t.Fatalf("Expected attempt %d to be accepted, got %d", i+1, rec.Code)
+		}
+	}
+	rec := requestPasswordReset("USER@example.com")
+	if rec.Code != 429 {
+		t.Fatalf("Expected status 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
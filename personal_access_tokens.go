@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+// PersonalAccessToken is a long-lived API token created by a user for
+// scripts. It accepts the same scopes as OAuth clients.
+type PersonalAccessToken struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Token is only returned when the token is created.
+	Token string `json:"token,omitempty"`
+}
+
+func convertPersonalAccessToken(t database.PersonalAccessToken) PersonalAccessToken {
+	pat := PersonalAccessToken{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt,
+	}
+	if t.ExpiresAt.Valid {
+		pat.ExpiresAt = &t.ExpiresAt.Time
+	}
+	if t.LastUsedAt.Valid {
+		pat.LastUsedAt = &t.LastUsedAt.Time
+	}
+	return pat
+}
+
+// handlerCreatePersonalAccessToken asks for the current password, since the
+// token it mints outlives the login that created it.
+func handlerCreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name            string     `json:"name"`
+		Scopes          []string   `json:"scopes"`
+		ExpiresAt       *time.Time `json:"expires_at"`
+		CurrentPassword string     `json:"current_password"`
+	}
+
+	userID := currentPrincipal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > 100 {
+		respondWithError(w, 400, "name must be between 1 and 100 characters")
+		return
+	}
+	scopes, err := parseScopes(strings.Join(params.Scopes, " "))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	var ttl sql.NullFloat64
+	if params.ExpiresAt != nil {
+		remaining := time.Until(*params.ExpiresAt)
+		if remaining <= 0 {
+			respondWithError(w, 400, "expires_at must be in the future")
+			return
+		}
+		ttl = sql.NullFloat64{Float64: remaining.Seconds(), Valid: true}
+	}
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if !confirmPassword(w, r, user, params.CurrentPassword) {
+		return
+	}
+
+	token, err := auth.MakePersonalAccessToken()
+	if err != nil {
+		log.Printf("Unable to generate personal access token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	dbToken, err := apiCfg.dbQueries.CreatePersonalAccessToken(r.Context(), database.CreatePersonalAccessTokenParams{
+		UserID:     userID,
+		Name:       params.Name,
+		TokenHash:  auth.HashRefreshToken(token),
+		Scopes:     scopes,
+		TtlSeconds: ttl,
+	})
+	if err != nil {
+		log.Printf("Unable to create personal access token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	pat := convertPersonalAccessToken(dbToken)
+	pat.Token = token
+	respondWithJSON(w, 201, pat)
+}
+
+func handlerGetPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	dbTokens, err := apiCfg.dbQueries.GetPersonalAccessTokensForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get personal access tokens: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	tokens := []PersonalAccessToken{}
+	for _, t := range dbTokens {
+		tokens = append(tokens, convertPersonalAccessToken(t))
+	}
+	respondWithJSON(w, 200, tokens)
+}
+
+func handlerRevokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	tokenID, err := uuid.Parse(r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid tokenID")
+		return
+	}
+	deleted, err := apiCfg.dbQueries.DeletePersonalAccessTokenForUser(r.Context(), database.DeletePersonalAccessTokenForUserParams{
+		ID:     tokenID,
+		UserID: userID,
+	})
+	if err != nil {
+		log.Printf("Unable to revoke personal access token: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, 404, "Token not found")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
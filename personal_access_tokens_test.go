@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+)
+
+func createPersonalAccessToken(t *testing.T, userID uuid.UUID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return callWithToken(handlerCreatePersonalAccessToken, "POST", "/api/users/me/tokens", bearer(t, userID)[len("Bearer "):], body)
+}
+
+func newPersonalAccessToken(t *testing.T, userID uuid.UUID, body string) PersonalAccessToken {
+	t.Helper()
+	rec := createPersonalAccessToken(t, userID, body)
+	if rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var pat PersonalAccessToken
+	json.NewDecoder(rec.Body).Decode(&pat)
+	return pat
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	pat := newPersonalAccessToken(t, user.ID, `{"name":"deploy bot","scopes":["write:chirps","read:chirps","write:chirps"],"current_password":"correct horse battery staple"}`)
+	if !auth.IsPersonalAccessToken(pat.Token) || pat.ExpiresAt != nil || strings.Join(pat.Scopes, " ") != "read:chirps write:chirps" {
+		t.Fatalf("Unexpected token %+v", pat)
+	}
+	if db.patTokens[pat.ID].TokenHash != auth.HashRefreshToken(pat.Token) {
+		t.Error("Expected the token to be stored hashed")
+	}
+
+	rec := callAs(requireScope(scopeWriteChirps, handlerChirps), "POST", "/api/chirps", pat.Token, `{"body":"from a script"}`)
+	if rec.Code != 201 {
+		t.Fatalf("Expected the token to post a chirp, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Listing never shows the token again but does show when it was used.
+	rec = callWithToken(handlerGetPersonalAccessTokens, "GET", "/api/users/me/tokens", bearer(t, user.ID)[len("Bearer "):], "")
+	var pats []PersonalAccessToken
+	json.NewDecoder(rec.Body).Decode(&pats)
+	if len(pats) != 1 || pats[0].ID != pat.ID || pats[0].Token != "" || pats[0].LastUsedAt == nil {
+		t.Errorf("Unexpected token list %+v", pats)
+	}
+
+	// A token cannot manage tokens, so a leaked one cannot mint more.
+	if rec := callWithToken(handlerCreatePersonalAccessToken, "POST", "/api/users/me/tokens", pat.Token, `{"name":"x","scopes":["read:chirps"]}`); rec.Code != 403 {
+		t.Errorf("Expected token management to need a first-party token, got %d", rec.Code)
+	}
+
+	// Minting a token needs the password, not just a stolen access token.
+	for name, body := range map[string]string{
+		"no password":    `{"name":"x","scopes":["read:chirps"]}`,
+		"wrong password": `{"name":"x","scopes":["read:chirps"],"current_password":"wrong"}`,
+	} {
+		if rec := createPersonalAccessToken(t, user.ID, body); rec.Code != 403 {
+			t.Errorf("%s: expected status 403, got %d", name, rec.Code)
+		}
+	}
+
+	// Password changes end tokens for scripts along with sessions.
+	if rec := updateLogin(bearer(t, user.ID)[len("Bearer "):], `{"password":"a brand new password for chirpy","current_password":"correct horse battery staple"}`); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", pat.Token, ""); rec.Code != 401 {
+		t.Errorf("Expected a password change to revoke the token, got %d", rec.Code)
+	}
+}
+
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	pat := newPersonalAccessToken(t, user.ID, `{"name":"reader","scopes":["read:chirps"],"current_password":"correct horse battery staple"}`)
+
+	rec := callAs(requireScope(scopeWriteChirps, handlerChirps), "POST", "/api/chirps", pat.Token, `{"body":"hello"}`)
+	if rec.Code != 403 || !strings.Contains(rec.Header().Get("WWW-Authenticate"), `scope="write:chirps"`) {
+		t.Errorf("Expected insufficient_scope, got %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", pat.Token, ""); rec.Code != 200 {
+		t.Errorf("Expected the token to read chirps, got %d", rec.Code)
+	}
+}
+
+func TestPersonalAccessTokenValidation(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	for name, body := range map[string]string{
+		"no name":       `{"scopes":["read:chirps"]}`,
+		"no scopes":     `{"name":"x"}`,
+		"unknown scope": `{"name":"x","scopes":["admin"]}`,
+		"past expiry":   `{"name":"x","scopes":["read:chirps"],"expires_at":"2001-01-01T00:00:00Z"}`,
+	} {
+		if rec := createPersonalAccessToken(t, user.ID, body); rec.Code != 400 {
+			t.Errorf("%s: expected status 400, got %d", name, rec.Code)
+		}
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	body, _ := json.Marshal(map[string]any{"name": "temporary", "scopes": []string{"read:chirps"}, "expires_at": expiresAt, "current_password": "correct horse battery staple"})
+	pat := newPersonalAccessToken(t, user.ID, string(body))
+	// The database computes the expiry from its own clock, so allow for the
+	// time the request took.
+	if pat.ExpiresAt == nil || pat.ExpiresAt.Sub(expiresAt).Abs() > time.Second {
+		t.Errorf("Expected expiry %v, got %v", expiresAt, pat.ExpiresAt)
+	}
+	stored := db.patTokens[pat.ID]
+	stored.ExpiresAt.Time = time.Now().Add(-time.Second)
+	db.patTokens[pat.ID] = stored
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", pat.Token, ""); rec.Code != 401 {
+		t.Errorf("Expected an expired token to be rejected, got %d", rec.Code)
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", auth.PersonalAccessTokenPrefix+"nope", ""); rec.Code != 401 {
+		t.Errorf("Expected an unknown token to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestRevokePersonalAccessToken(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	other := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+	pat := newPersonalAccessToken(t, user.ID, `{"name":"bot","scopes":["read:chirps"],"current_password":"correct horse battery staple"}`)
+
+	revoke := func(userID uuid.UUID, id string) int {
+		req := httptest.NewRequest("DELETE", "/api/users/me/tokens/"+id, nil)
+		req.SetPathValue("tokenID", id)
+		req.Header.Set("Authorization", bearer(t, userID))
+		rec := httptest.NewRecorder()
+		requireAuth(handlerRevokePersonalAccessToken)(rec, req)
+		return rec.Code
+	}
+	if code := revoke(other.ID, pat.ID.String()); code != 404 {
+		t.Errorf("Expected another user's token to be not found, got %d", code)
+	}
+	if code := revoke(user.ID, "nope"); code != 400 {
+		t.Errorf("Expected invalid ID to be rejected, got %d", code)
+	}
+	if code := revoke(user.ID, pat.ID.String()); code != 204 {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+	if rec := callAs(optionalScope(scopeReadChirps, handlerGetChirps), "GET", "/api/chirps", pat.Token, ""); rec.Code != 401 {
+		t.Errorf("Expected a revoked token to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+// handlePattern matches the CHECK constraint on users.handle. Handles are
+// stored lowercase so the UNIQUE constraint is case-insensitive.
+var handlePattern = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+
+// reservedHandles are path segments under /api/users/ that would otherwise
+// be shadowed by, or shadow, a profile.
+var reservedHandles = map[string]bool{
+	"me":     true,
+	"verify": true,
+	"admin":  true,
+	"api":    true,
+	"chirpy": true,
+}
+
+// Profile is the public view of a user. It never includes the email.
+type Profile struct {
+	ID             uuid.UUID `json:"id"`
+	Handle         string    `json:"handle"`
+	DisplayName    string    `json:"display_name"`
+	Bio            string    `json:"bio"`
+	AvatarURL      string    `json:"avatar_url"`
+	CreatedAt      time.Time `json:"created_at"`
+	ChirpCount     int64     `json:"chirp_count"`
+	FollowerCount  int64     `json:"follower_count"`
+	FollowingCount int64     `json:"following_count"`
+}
+
+// normalizeHandle accepts handles with a leading @ and in any case.
+func normalizeHandle(s string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "@"))
+}
+
+func validateHandle(handle string) error {
+	if !handlePattern.MatchString(handle) {
+		return errors.New("handle must be 3 to 30 letters, digits or underscores")
+	}
+	if reservedHandles[handle] {
+		return fmt.Errorf("handle %q is reserved", handle)
+	}
+	return nil
+}
+
+// validAvatarURL accepts an https URL, or an empty string to remove the
+// avatar.
+func validAvatarURL(s string) bool {
+	if s == "" {
+		return true
+	}
+	if len(s) > maxAvatarURLLength {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// lookupProfile writes a 404 for handles that cannot belong to anyone
+// without querying the database.
+func lookupProfile(w http.ResponseWriter, r *http.Request) (database.GetUserProfileByHandleRow, bool) {
+	handle := normalizeHandle(r.PathValue("handle"))
+	if validateHandle(handle) != nil {
+		respondWithError(w, 404, "User not found")
+		return database.GetUserProfileByHandleRow{}, false
+	}
+	profile, err := apiCfg.dbQueries.GetUserProfileByHandle(r.Context(), sql.NullString{String: handle, Valid: true})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found")
+		return database.GetUserProfileByHandleRow{}, false
+	}
+	if err != nil {
+		log.Printf("Unable to get profile: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return database.GetUserProfileByHandleRow{}, false
+	}
+	return profile, true
+}
+
+func handlerGetProfile(w http.ResponseWriter, r *http.Request) {
+	profile, ok := lookupProfile(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, 200, Profile{
+		ID:             profile.ID,
+		Handle:         profile.Handle.String,
+		DisplayName:    profile.DisplayName,
+		Bio:            profile.Bio,
+		AvatarURL:      profile.AvatarUrl,
+		CreatedAt:      profile.CreatedAt,
+		ChirpCount:     profile.ChirpCount,
+		FollowerCount:  profile.FollowerCount,
+		FollowingCount: profile.FollowingCount,
+	})
+}
+
+// handlerUpdateProfile changes only the profile fields present in the
+// request. Email and password are changed through PATCH /api/users.
+func handlerUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Handle      *string `json:"handle"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		AvatarURL   *string `json:"avatar_url"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	args := database.UpdateUserProfileParams{ID: currentPrincipal(r).UserID}
+	if params.Handle != nil {
+		handle := normalizeHandle(*params.Handle)
+		if err := validateHandle(handle); err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		args.Handle = sql.NullString{String: handle, Valid: true}
+	}
+	if params.DisplayName != nil {
+		displayName := strings.TrimSpace(*params.DisplayName)
+		if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+			respondWithError(w, 400, fmt.Sprintf("display_name must be at most %d characters", maxDisplayNameLength))
+			return
+		}
+		args.DisplayName = sql.NullString{String: displayName, Valid: true}
+	}
+	if params.Bio != nil {
+		bio := strings.TrimSpace(*params.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			respondWithError(w, 400, fmt.Sprintf("bio must be at most %d characters", maxBioLength))
+			return
+		}
+		args.Bio = sql.NullString{String: bio, Valid: true}
+	}
+	if params.AvatarURL != nil {
+		if !validAvatarURL(*params.AvatarURL) {
+			respondWithError(w, 400, "avatar_url must be an https URL")
+			return
+		}
+		args.AvatarUrl = sql.NullString{String: *params.AvatarURL, Valid: true}
+	}
+
+	updated, err := apiCfg.dbQueries.UpdateUserProfile(r.Context(), args)
+	if isUniqueViolation(err) {
+		respondWithError(w, 409, "handle already taken")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to update profile: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 200, convertUser(updated))
+}
+
+// handlerFollowUser is idempotent: following someone twice is not an error.
+func handlerFollowUser(w http.ResponseWriter, r *http.Request) {
+	profile, ok := lookupProfile(w, r)
+	if !ok {
+		return
+	}
+	userID := currentPrincipal(r).UserID
+	if profile.ID == userID {
+		respondWithError(w, 400, "You cannot follow yourself")
+		return
+	}
+	err := apiCfg.dbQueries.FollowUser(r.Context(), database.FollowUserParams{
+		FollowerID: userID,
+		FolloweeID: profile.ID,
+	})
+	if err != nil {
+		log.Printf("Unable to follow user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
+
+func handlerUnfollowUser(w http.ResponseWriter, r *http.Request) {
+	profile, ok := lookupProfile(w, r)
+	if !ok {
+		return
+	}
+	err := apiCfg.dbQueries.UnfollowUser(r.Context(), database.UnfollowUserParams{
+		FollowerID: currentPrincipal(r).UserID,
+		FolloweeID: profile.ID,
+	})
+	if err != nil {
+		log.Printf("Unable to unfollow user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
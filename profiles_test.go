@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+func updateProfile(t *testing.T, userID uuid.UUID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return callWithToken(handlerUpdateProfile, "PATCH", "/api/users/me", bearer(t, userID)[len("Bearer "):], body)
+}
+
+func getProfile(handle string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/users/"+handle, nil)
+	req.SetPathValue("handle", handle)
+	rec := httptest.NewRecorder()
+	handlerGetProfile(rec, req)
+	return rec
+}
+
+func follow(t *testing.T, handler http.HandlerFunc, userID uuid.UUID, handle string) int {
+	t.Helper()
+	req := httptest.NewRequest("PUT", "/api/users/"+handle+"/follow", nil)
+	req.SetPathValue("handle", handle)
+	req.Header.Set("Authorization", bearer(t, userID))
+	rec := httptest.NewRecorder()
+	requireAuth(handler)(rec, req)
+	return rec.Code
+}
+
+func TestUpdateProfile(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	other := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+
+	rec := updateProfile(t, user.ID, `{"handle":"@Alice_1","display_name":"  Alice  ","bio":"Hello","avatar_url":"https://example.com/a.png"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var updated User
+	json.NewDecoder(rec.Body).Decode(&updated)
+	if updated.Handle == nil || *updated.Handle != "alice_1" || updated.DisplayName != "Alice" || updated.Bio != "Hello" || updated.AvatarURL != "https://example.com/a.png" {
+		t.Fatalf("Unexpected user %+v", updated)
+	}
+
+	// Fields left out of the request are unchanged.
+	if rec := updateProfile(t, user.ID, `{"bio":""}`); rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	stored := db.users[user.ID]
+	if stored.Handle.String != "alice_1" || stored.DisplayName != "Alice" || stored.Bio != "" || stored.Email != "user@example.com" {
+		t.Errorf("Expected only the bio to change, got %+v", stored)
+	}
+
+	if rec := updateProfile(t, other.ID, `{"handle":"ALICE_1"}`); rec.Code != 409 {
+		t.Errorf("Expected a taken handle to conflict, got %d", rec.Code)
+	}
+	for name, body := range map[string]string{
+		"reserved handle":   `{"handle":"verify"}`,
+		"short handle":      `{"handle":"ab"}`,
+		"invalid handle":    `{"handle":"al ice"}`,
+		"long display name": `{"display_name":"` + strings.Repeat("a", maxDisplayNameLength+1) + `"}`,
+		"long bio":          `{"bio":"` + strings.Repeat("é", maxBioLength+1) + `"}`,
+		"http avatar":       `{"avatar_url":"http://example.com/a.png"}`,
+		"javascript avatar": `{"avatar_url":"javascript:alert(1)"}`,
+	} {
+		if rec := updateProfile(t, other.ID, body); rec.Code != 400 {
+			t.Errorf("%s: expected status 400, got %d", name, rec.Code)
+		}
+	}
+	if rec := updateProfile(t, other.ID, `{"bio":"`+strings.Repeat("é", maxBioLength)+`"}`); rec.Code != 200 {
+		t.Errorf("Expected a bio at the limit to be accepted, got %d", rec.Code)
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	fan := addTestUser(t, db, "fan@example.com", "correct horse battery staple")
+	updateProfile(t, user.ID, `{"handle":"alice","display_name":"Alice"}`)
+	updateProfile(t, fan.ID, `{"handle":"fan"}`)
+	db.CreateChirp(context.Background(), database.CreateChirpParams{Body: "one", UserID: user.ID})
+	db.CreateChirp(context.Background(), database.CreateChirpParams{Body: "two", UserID: user.ID})
+
+	if code := follow(t, handlerFollowUser, fan.ID, "alice"); code != 204 {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+	if code := follow(t, handlerFollowUser, fan.ID, "alice"); code != 204 {
+		t.Errorf("Expected following twice to succeed, got %d", code)
+	}
+	if code := follow(t, handlerFollowUser, user.ID, "alice"); code != 400 {
+		t.Errorf("Expected following yourself to be refused, got %d", code)
+	}
+	if code := follow(t, handlerFollowUser, user.ID, "nobody"); code != 404 {
+		t.Errorf("Expected an unknown handle to be not found, got %d", code)
+	}
+
+	rec := getProfile("Alice")
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "user@example.com") {
+		t.Error("Expected the profile to leave out the email")
+	}
+	var profile Profile
+	json.NewDecoder(rec.Body).Decode(&profile)
+	if profile.ID != user.ID || profile.Handle != "alice" || profile.DisplayName != "Alice" || profile.ChirpCount != 2 || profile.FollowerCount != 1 || profile.FollowingCount != 0 {
+		t.Errorf("Unexpected profile %+v", profile)
+	}
+
+	if code := follow(t, handlerUnfollowUser, fan.ID, "alice"); code != 204 {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+	json.NewDecoder(getProfile("alice").Body).Decode(&profile)
+	if profile.FollowerCount != 0 {
+		t.Errorf("Expected no followers, got %d", profile.FollowerCount)
+	}
+
+	for _, handle := range []string{"me", "verify", "nobody", "no/such"} {
+		if rec := getProfile(handle); rec.Code != 404 {
+			t.Errorf("%s: expected status 404, got %d", handle, rec.Code)
+		}
+	}
+}
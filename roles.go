@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// roleRanks orders the roles; each role can do everything the ones below
+// it can.
+var roleRanks = map[string]int{
+	roleUser:      0,
+	roleModerator: 1,
+	roleAdmin:     2,
+}
+
+// requireRole is requireAuth for routes that need at least role. Delegated
+// tokens are refused even when their user holds the role.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if roleRanks[currentPrincipal(r).Role] < roleRanks[role] {
+			respondWithError(w, 403, "Forbidden")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handlerSetUserRole changes another user's role. Admins cannot change
+// their own, so there is always at least one admin left.
+func handlerSetUserRole(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid userID")
+		return
+	}
+	if userID == currentPrincipal(r).UserID {
+		respondWithError(w, 409, "You cannot change your own role")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	if _, ok := roleRanks[params.Role]; !ok {
+		respondWithError(w, 400, "role must be user, moderator or admin")
+		return
+	}
+
+	updated, err := apiCfg.dbQueries.SetUserRole(r.Context(), database.SetUserRoleParams{
+		Role: params.Role,
+		ID:   userID,
+	})
+	if err != nil {
+		log.Printf("Unable to set role: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if updated == 0 {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
+
+// runCommand runs a command line subcommand against the database instead
+// of starting the server:
+//
+//	chirpy grant-role admin@example.com admin
+//	chirpy email-conflicts
+//
+// grant-role is how the first admin is created.
+func runCommand(ctx context.Context, db database.Querier, args []string, out io.Writer) error {
+	switch args[0] {
+	case "grant-role":
+		if len(args) != 3 {
+			return errors.New("usage: grant-role <email> <user|moderator|admin>")
+		}
+		email, role := normalizeEmail(args[1]), args[2]
+		if _, ok := roleRanks[role]; !ok {
+			return fmt.Errorf("unknown role %q", role)
+		}
+		user, err := db.GetUserByEmail(ctx, email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no user with email %s", email)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := db.SetUserRole(ctx, database.SetUserRoleParams{Role: role, ID: user.ID}); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s is now %s\n", email, role)
+		return nil
+	case "email-conflicts":
+		// Lists accounts whose emails differ only by case or whitespace,
+		// which block the migration to case-insensitive emails.
+		conflicts, err := db.GetEmailConflicts(ctx)
+		if err != nil {
+			return err
+		}
+		if len(conflicts) == 0 {
+			fmt.Fprintln(out, "No conflicting emails")
+			return nil
+		}
+		for i, c := range conflicts {
+			if i == 0 || conflicts[i-1].NormalizedEmail != c.NormalizedEmail {
+				fmt.Fprintf(out, "%s:\n", c.NormalizedEmail)
+			}
+			fmt.Fprintf(out, "\t%s <%s> created %s\n", c.ID, c.Email, c.CreatedAt.Format(time.RFC3339))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+// addTestUserWithRole stores a user and gives them role.
+func addTestUserWithRole(t *testing.T, db *fakeQueries, email, role string) database.User {
+	t.Helper()
+	user := addTestUser(t, db, email, "correct horse battery staple")
+	db.SetUserRole(context.Background(), database.SetUserRoleParams{Role: role, ID: user.ID})
+	return db.users[user.ID]
+}
+
+func TestAdminRoutesRequireRole(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUserWithRole(t, db, "user@example.com", roleUser)
+	moderator := addTestUserWithRole(t, db, "moderator@example.com", roleModerator)
+	admin := addTestUserWithRole(t, db, "admin@example.com", roleAdmin)
+	adminPAT := newPersonalAccessToken(t, admin.ID, `{"name":"bot","scopes":["read:chirps","write:chirps"],"current_password":"correct horse battery staple"}`)
+
+	metrics := requireRole(roleModerator, apiCfg.handlerMetrics)
+	reset := requireRole(roleAdmin, apiCfg.handlerReset)
+	runStatusCases(t, []statusCase{
+		{name: "metrics anonymous", method: "GET", target: "/admin/metrics", handler: metrics, wantStatus: 401},
+		{name: "metrics as user", method: "GET", target: "/admin/metrics", authHeader: bearer(t, user.ID), handler: metrics, wantStatus: 403},
+		{name: "metrics as moderator", method: "GET", target: "/admin/metrics", authHeader: bearer(t, moderator.ID), handler: metrics, wantStatus: 200},
+		{name: "metrics as admin", method: "GET", target: "/admin/metrics", authHeader: bearer(t, admin.ID), handler: metrics, wantStatus: 200},
+		{name: "metrics with admin's token", method: "GET", target: "/admin/metrics", authHeader: "Bearer " + adminPAT.Token, handler: metrics, wantStatus: 403},
+		{name: "reset as moderator", method: "POST", target: "/admin/reset", authHeader: bearer(t, moderator.ID), handler: reset, wantStatus: 403},
+	})
+	if len(db.users) != 3 {
+		t.Fatalf("Expected no reset yet, have %d users", len(db.users))
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	db := setupTestAPI(t)
+	admin := addTestUserWithRole(t, db, "admin@example.com", roleAdmin)
+	user := addTestUserWithRole(t, db, "user@example.com", roleUser)
+
+	setRole := func(actor uuid.UUID, userID, body string) int {
+		req := httptest.NewRequest("PUT", "/admin/users/"+userID+"/role", strings.NewReader(body))
+		req.SetPathValue("userID", userID)
+		req.Header.Set("Authorization", bearer(t, actor))
+		rec := httptest.NewRecorder()
+		requireRole(roleAdmin, handlerSetUserRole)(rec, req)
+		return rec.Code
+	}
+	if code := setRole(user.ID, user.ID.String(), `{"role":"admin"}`); code != 403 {
+		t.Errorf("Expected a user to be unable to promote themselves, got %d", code)
+	}
+	if code := setRole(admin.ID, user.ID.String(), `{"role":"owner"}`); code != 400 {
+		t.Errorf("Expected an unknown role to be rejected, got %d", code)
+	}
+	if code := setRole(admin.ID, uuid.NewString(), `{"role":"moderator"}`); code != 404 {
+		t.Errorf("Expected an unknown user to be not found, got %d", code)
+	}
+	if code := setRole(admin.ID, admin.ID.String(), `{"role":"user"}`); code != 409 {
+		t.Errorf("Expected an admin to be unable to demote themselves, got %d", code)
+	}
+	if code := setRole(admin.ID, user.ID.String(), `{"role":"moderator"}`); code != 204 {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+	if db.users[user.ID].Role != roleModerator {
+		t.Errorf("Expected the user to be a moderator, got %q", db.users[user.ID].Role)
+	}
+}
+
+func TestGrantRoleCommand(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "first@example.com", "correct horse battery staple")
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), db, []string{"grant-role", "first@example.com", "admin"}, &out); err != nil {
+		t.Fatalf("grant-role: %v", err)
+	}
+	if db.users[user.ID].Role != roleAdmin || out.String() != "first@example.com is now admin\n" {
+		t.Errorf("Expected the user to be an admin, got %q (%q)", db.users[user.ID].Role, out.String())
+	}
+
+	for name, args := range map[string][]string{
+		"unknown user":    {"grant-role", "nobody@example.com", "admin"},
+		"unknown role":    {"grant-role", "first@example.com", "root"},
+		"missing role":    {"grant-role", "first@example.com"},
+		"unknown command": {"drop-database"},
+	} {
+		if err := runCommand(context.Background(), db, args, &out); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEmailConflictsCommand(t *testing.T) {
+	db := setupTestAPI(t)
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), db, []string{"email-conflicts"}, &out); err != nil || out.String() != "No conflicting emails\n" {
+		t.Fatalf("Expected no conflicts, got %q (%v)", out.String(), err)
+	}
+
+	// Rows from before emails were normalized.
+	first := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	second := addTestUser(t, db, "other@example.com", "correct horse battery staple")
+	second.Email = " User@Example.com"
+	second.CreatedAt = first.CreatedAt.Add(time.Minute)
+	db.users[second.ID] = second
+	addTestUser(t, db, "unique@example.com", "correct horse battery staple")
+
+	out.Reset()
+	if err := runCommand(context.Background(), db, []string{"email-conflicts"}, &out); err != nil {
+		t.Fatalf("email-conflicts: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3 || lines[0] != "user@example.com:" || !strings.Contains(lines[1], first.ID.String()) || !strings.Contains(lines[2], second.ID.String()) {
+		t.Errorf("Unexpected report %q", out.String())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+// maxUserAgentLength caps how much of a client's User-Agent is stored.
+const maxUserAgentLength = 512
+
+// Session is one login and every refresh token rotated from it. Its ID is the
+// refresh token family ID, which stays the same across rotations.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	SignedInAt time.Time `json:"signed_in_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func handlerGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	dbSessions, err := apiCfg.dbQueries.GetSessionsForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get sessions: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	sessions := []Session{}
+	for _, s := range dbSessions {
+		sessions = append(sessions, Session{
+			ID:         s.FamilyID,
+			UserAgent:  s.UserAgent,
+			IPAddress:  s.IpAddress,
+			SignedInAt: s.SignedInAt,
+			LastUsedAt: s.LastUsedAt,
+			ExpiresAt:  s.ExpiresAt,
+		})
+	}
+	respondWithJSON(w, 200, sessions)
+}
+
+func handlerRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid sessionID")
+		return
+	}
+
+	revoked, err := apiCfg.dbQueries.RevokeSessionForUser(r.Context(), database.RevokeSessionForUserParams{
+		FamilyID: sessionID,
+		UserID:   userID,
+	})
+	if err != nil {
+		log.Printf("Unable to revoke session: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, 404, "Session not found")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
+
+// handlerRevokeAllSessions logs the user out everywhere by revoking every
+// refresh token they hold and bumping their token version, which
+// invalidates every access token already issued, including the caller's.
+func handlerRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	err := apiCfg.dbQueries.RevokeAllRefreshTokensForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to revoke sessions: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if err := apiCfg.dbQueries.IncrementTokenVersion(r.Context(), userID); err != nil {
+		log.Printf("Unable to revoke access tokens: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
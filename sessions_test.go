@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func loginFrom(t *testing.T, userAgent, remoteAddr, email, password string) User {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+	req.Header.Set("User-Agent", userAgent)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	handlerLogin(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected login to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var user User
+	json.NewDecoder(rec.Body).Decode(&user)
+	return user
+}
+
+func listSessions(t *testing.T, token string) []Session {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/users/me/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	requireAuth(handlerGetSessions)(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var sessions []Session
+	json.NewDecoder(rec.Body).Decode(&sessions)
+	return sessions
+}
+
+// sessionsStatus is the status of listing sessions with an access token,
+// which shows whether the token is still accepted.
+func sessionsStatus(token string) int {
+	req := httptest.NewRequest("GET", "/api/users/me/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	requireAuth(handlerGetSessions)(rec, req)
+	return rec.Code
+}
+
+func TestListSessions(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+
+	laptop := loginFrom(t, "Firefox", "192.0.2.1:5000", "user@example.com", "correct horse battery staple")
+	loginFrom(t, "ChirpyPhone/1.0", "198.51.100.7:6000", "user@example.com", "correct horse battery staple")
+
+	// Rotating a token keeps it in the same session.
+	req := httptest.NewRequest("POST", "/api/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+laptop.RefreshToken)
+	req.Header.Set("User-Agent", "Firefox")
+	req.RemoteAddr = "192.0.2.1:5001"
+	handlerRefresh(httptest.NewRecorder(), req)
+
+	sessions := listSessions(t, laptop.Token)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d: %+v", len(sessions), sessions)
+	}
+	seen := map[string]string{}
+	for _, s := range sessions {
+		seen[s.UserAgent] = s.IPAddress
+		if s.SignedInAt.IsZero() || s.LastUsedAt.IsZero() {
+			t.Errorf("Expected session timestamps to be set: %+v", s)
+		}
+	}
+	if seen["Firefox"] != "192.0.2.1" || seen["ChirpyPhone/1.0"] != "198.51.100.7" {
+		t.Errorf("Unexpected session client details: %v", seen)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	db := setupTestAPI(t)
+	addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	attacker := addTestUser(t, db, "attacker@example.com", "correct horse battery staple")
+
+	laptop := loginFrom(t, "Firefox", "192.0.2.1:5000", "user@example.com", "correct horse battery staple")
+	phone := loginFrom(t, "ChirpyPhone/1.0", "198.51.100.7:6000", "user@example.com", "correct horse battery staple")
+
+	var phoneSession uuid.UUID
+	for _, s := range listSessions(t, laptop.Token) {
+		if s.UserAgent == "ChirpyPhone/1.0" {
+			phoneSession = s.ID
+		}
+	}
+
+	revoke := func(authHeader, sessionID string) int {
+		req := httptest.NewRequest("DELETE", "/api/users/me/sessions/"+sessionID, nil)
+		req.SetPathValue("sessionID", sessionID)
+		req.Header.Set("Authorization", authHeader)
+		rec := httptest.NewRecorder()
+		requireAuth(handlerRevokeSession)(rec, req)
+		return rec.Code
+	}
+
+	if code := revoke(bearer(t, attacker.ID), phoneSession.String()); code != 404 {
+		t.Errorf("Expected revoking another user's session to return 404, got %d", code)
+	}
+	if code := revoke("Bearer "+laptop.Token, "nope"); code != 400 {
+		t.Errorf("Expected invalid session ID to return 400, got %d", code)
+	}
+	if code := revoke("Bearer "+laptop.Token, phoneSession.String()); code != 204 {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+	if code := revoke("Bearer "+laptop.Token, phoneSession.String()); code != 404 {
+		t.Errorf("Expected revoking twice to return 404, got %d", code)
+	}
+
+	if rec := refresh(phone.RefreshToken); rec.Code != 401 {
+		t.Errorf("Expected revoked session to stop refreshing, got %d", rec.Code)
+	}
+	if code := sessionsStatus(phone.Token); code != 401 {
+		t.Errorf("Expected revoked session's access token to be rejected, got %d", code)
+	}
+	if rec := refresh(laptop.RefreshToken); rec.Code != 200 {
+		t.Errorf("Expected other session to keep working, got %d", rec.Code)
+	}
+	if code := sessionsStatus(laptop.Token); code != 200 {
+		t.Errorf("Expected other session's access token to keep working across a refresh, got %d", code)
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	// An access token not tied to any session, as issued to OAuth clients.
+	sessionless := bearer(t, user.ID)[len("Bearer "):]
+
+	laptop := loginFrom(t, "Firefox", "192.0.2.1:5000", "user@example.com", "correct horse battery staple")
+	phone := loginFrom(t, "ChirpyPhone/1.0", "198.51.100.7:6000", "user@example.com", "correct horse battery staple")
+
+	req := httptest.NewRequest("DELETE", "/api/users/me/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+laptop.Token)
+	rec := httptest.NewRecorder()
+	requireAuth(handlerRevokeAllSessions)(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d", rec.Code)
+	}
+
+	for _, token := range []string{laptop.RefreshToken, phone.RefreshToken} {
+		if rec := refresh(token); rec.Code != 401 {
+			t.Errorf("Expected every session to be revoked, got %d", rec.Code)
+		}
+	}
+	for _, token := range []string{laptop.Token, phone.Token, sessionless} {
+		if code := sessionsStatus(token); code != 401 {
+			t.Errorf("Expected every access token to be rejected, got %d", code)
+		}
+	}
+	for _, token := range db.refreshTokens {
+		if !token.RevokedAt.Valid {
+			t.Errorf("Expected no sessions, got %+v", token)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+-- name: CreateAttachment :one
+INSERT INTO attachments (id, user_id, content_type, thumbnail_content_type, width, height, size_bytes, created_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    NOW()
+)
+RETURNING *;
+
+-- name: GetAttachment :one
+SELECT * FROM attachments
+WHERE id = $1;
+
+-- name: AttachToChirp :execrows
+UPDATE attachments
+SET chirp_id = $1, position = $2
+WHERE id = $3 AND user_id = $4 AND chirp_id IS NULL;
+
+-- name: GetAttachmentsForChirps :many
+SELECT * FROM attachments
+WHERE chirp_id = ANY(sqlc.arg('chirp_ids')::uuid[])
+ORDER BY chirp_id, position;
+
+-- name: DeleteUnattachedAttachments :many
+DELETE FROM attachments
+WHERE chirp_id IS NULL AND (user_id IS NULL OR created_at < NOW() - sqlc.arg(max_age_seconds)::float8 * INTERVAL '1 second')
+RETURNING id;
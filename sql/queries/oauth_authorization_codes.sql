@@ -0,0 +1,22 @@
+-- name: CreateOAuthAuthorizationCode :exec
+INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, created_at, expires_at)
+VALUES (
+    sqlc.arg(code_hash),
+    sqlc.arg(client_id),
+    sqlc.arg(user_id),
+    sqlc.arg(redirect_uri),
+    sqlc.arg(scopes),
+    sqlc.arg(code_challenge),
+    NOW(),
+    NOW() + sqlc.arg(ttl_seconds)::float8 * INTERVAL '1 second'
+);
+
+-- name: ConsumeOAuthAuthorizationCode :one
+DELETE FROM oauth_authorization_codes
+WHERE code_hash = $1
+AND expires_at > NOW()
+RETURNING *;
+
+-- name: DeleteExpiredOAuthAuthorizationCodes :exec
+DELETE FROM oauth_authorization_codes
+WHERE expires_at <= NOW();
@@ -0,0 +1,26 @@
+-- name: CreateOAuthClient :one
+INSERT INTO oauth_clients (id, user_id, name, redirect_uris, secret_hash, created_at, updated_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    NOW(),
+    NOW()
+)
+RETURNING *;
+
+-- name: GetOAuthClient :one
+SELECT * FROM oauth_clients
+WHERE id = $1;
+
+-- name: GetOAuthClientsForUser :many
+SELECT * FROM oauth_clients
+WHERE user_id = $1
+ORDER BY created_at;
+
+-- name: DeleteOAuthClientForUser :execrows
+DELETE FROM oauth_clients
+WHERE id = $1
+AND user_id = $2;
@@ -0,0 +1,28 @@
+-- name: UpsertOAuthGrant :exec
+INSERT INTO oauth_grants (user_id, client_id, scopes, created_at, updated_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    NOW(),
+    NOW()
+)
+ON CONFLICT (user_id, client_id) DO UPDATE
+SET scopes = EXCLUDED.scopes, updated_at = NOW();
+
+-- name: GetOAuthGrant :one
+SELECT * FROM oauth_grants
+WHERE user_id = $1
+AND client_id = $2;
+
+-- name: GetOAuthGrantsForUser :many
+SELECT oauth_grants.*, oauth_clients.name AS client_name
+FROM oauth_grants
+JOIN oauth_clients ON oauth_clients.id = oauth_grants.client_id
+WHERE oauth_grants.user_id = $1
+ORDER BY oauth_grants.created_at;
+
+-- name: DeleteOAuthGrant :execrows
+DELETE FROM oauth_grants
+WHERE user_id = $1
+AND client_id = $2;
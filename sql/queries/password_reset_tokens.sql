@@ -0,0 +1,27 @@
+-- name: CreatePasswordResetToken :exec
+INSERT INTO password_reset_tokens (token_hash, user_id, created_at, expires_at)
+VALUES (
+    sqlc.arg(token_hash),
+    sqlc.arg(user_id),
+    NOW(),
+    NOW() + sqlc.arg(ttl_seconds)::float8 * INTERVAL '1 second'
+);
+
+-- name: GetPasswordResetToken :one
+SELECT * FROM password_reset_tokens
+WHERE token_hash = $1
+AND used_at IS NULL
+AND expires_at > NOW();
+
+-- name: ConsumePasswordResetToken :execrows
+UPDATE password_reset_tokens
+SET used_at = NOW()
+WHERE token_hash = $1
+AND used_at IS NULL
+AND expires_at > NOW();
+
+-- name: InvalidatePasswordResetTokensForUser :exec
+UPDATE password_reset_tokens
+SET used_at = NOW()
+WHERE user_id = $1
+AND used_at IS NULL;
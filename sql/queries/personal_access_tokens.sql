@@ -0,0 +1,37 @@
+-- name: CreatePersonalAccessToken :one
+INSERT INTO personal_access_tokens (id, user_id, name, token_hash, scopes, created_at, expires_at)
+VALUES (
+    gen_random_uuid(),
+    sqlc.arg(user_id),
+    sqlc.arg(name),
+    sqlc.arg(token_hash),
+    sqlc.arg(scopes),
+    NOW(),
+    NOW() + sqlc.narg(ttl_seconds)::float8 * INTERVAL '1 second'
+)
+RETURNING *;
+
+-- name: GetPersonalAccessToken :one
+SELECT * FROM personal_access_tokens
+WHERE token_hash = $1
+AND (expires_at IS NULL OR expires_at > NOW());
+
+-- name: GetPersonalAccessTokensForUser :many
+SELECT * FROM personal_access_tokens
+WHERE user_id = $1
+ORDER BY created_at;
+
+-- name: TouchPersonalAccessToken :exec
+UPDATE personal_access_tokens
+SET last_used_at = NOW()
+WHERE id = $1
+AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute');
+
+-- name: DeletePersonalAccessTokenForUser :execrows
+DELETE FROM personal_access_tokens
+WHERE id = $1
+AND user_id = $2;
+
+-- name: DeletePersonalAccessTokensForUser :exec
+DELETE FROM personal_access_tokens
+WHERE user_id = $1;
@@ -1,18 +1,78 @@
 -- name: CreateRefreshToken :one
 INSERT INTO refresh_tokens (
-    token, created_at, updated_at, user_id, expires_at, revoked_at
+    token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id,
+    user_agent, ip_address, last_used_at
 )
 VALUES (
-    $1,
+    sqlc.arg(token_hash),
     NOW(),
     NOW(),
-    $2,
-    $3,
-    NULL
+    sqlc.arg(user_id),
+    NOW() + sqlc.arg(ttl_seconds)::float8 * INTERVAL '1 second',
+    NULL,
+    sqlc.arg(family_id),
+    sqlc.arg(user_agent),
+    sqlc.arg(ip_address),
+    NOW()
 )
 RETURNING *;
 
--- name: RevokeRefreshToken :exec
+-- name: GetRefreshToken :one
+SELECT * FROM refresh_tokens
+WHERE token_hash = $1;
+
+-- name: RevokeRefreshToken :execrows
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE token_hash = $1
+AND revoked_at IS NULL;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE family_id = $1
+AND revoked_at IS NULL;
+
+-- name: GetSessionsForUser :many
+SELECT
+    family_id,
+    user_agent,
+    ip_address,
+    last_used_at,
+    expires_at,
+    (
+        SELECT MIN(first.created_at) FROM refresh_tokens AS first
+        WHERE first.family_id = refresh_tokens.family_id
+    )::TIMESTAMP AS signed_in_at
+FROM refresh_tokens
+WHERE refresh_tokens.user_id = $1
+AND revoked_at IS NULL
+AND expires_at > NOW()
+ORDER BY last_used_at DESC;
+
+-- name: RevokeSessionForUser :execrows
 UPDATE refresh_tokens
 SET updated_at = NOW(), revoked_at = NOW()
-WHERE token = $1;
+WHERE family_id = $1
+AND user_id = $2
+AND revoked_at IS NULL;
+
+-- name: RevokeAllRefreshTokensForUser :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE user_id = $1
+AND revoked_at IS NULL;
+
+-- name: RevokeOtherRefreshTokensForUser :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE user_id = $1
+AND family_id <> $2
+AND revoked_at IS NULL;
+
+-- name: IsSessionActive :one
+SELECT EXISTS (
+    SELECT 1 FROM refresh_tokens
+    WHERE family_id = $1
+    AND revoked_at IS NULL
+);
@@ -14,23 +14,103 @@ DELETE FROM users;
 
 -- name: GetUserByEmail :one
 SELECT * FROM users
-WHERE email = $1;
+WHERE lower(email) = lower(sqlc.arg(email));
+
+-- name: GetUserByID :one
+SELECT * FROM users
+WHERE id = $1;
 
 -- name: GetUserFromRefreshToken :one
 SELECT * FROM users 
 JOIN refresh_tokens ON users.id = refresh_tokens.user_id
-WHERE refresh_tokens.token = $1
+WHERE refresh_tokens.token_hash = $1
 AND refresh_tokens.expires_at > NOW()
 AND refresh_tokens.revoked_at IS NULL;
 
 -- name: UpdateUserLogin :one
 UPDATE users
-SET updated_at = NOW(), email = $1, hashed_password = $2
-WHERE id = $3
+SET updated_at = NOW(),
+    email = COALESCE(sqlc.narg('email'), email),
+    hashed_password = COALESCE(sqlc.narg('hashed_password'), hashed_password),
+    token_version = CASE WHEN sqlc.narg('hashed_password')::TEXT IS NULL THEN token_version ELSE token_version + 1 END,
+    email_verified_at = CASE WHEN email = COALESCE(sqlc.narg('email'), email) THEN email_verified_at ELSE NULL END
+WHERE id = sqlc.arg('id')
 RETURNING *;
 
--- name: SetUserToRed :exec
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET updated_at = NOW(), hashed_password = $1
+WHERE id = $2;
+
+-- name: SetUserToRed :execrows
 UPDATE users
 SET is_chirpy_red = TRUE
-WHERE id = $1
-RETURNING *;
\ No newline at end of file
+WHERE id = $1;
+
+-- name: VerifyUserEmail :execrows
+UPDATE users
+SET updated_at = NOW(), email_verified_at = NOW()
+WHERE id = $1 AND email = $2 AND email_verified_at IS NULL;
+
+-- name: ResetUserPassword :exec
+UPDATE users
+SET updated_at = NOW(), hashed_password = $1, token_version = token_version + 1,
+    email_verified_at = COALESCE(email_verified_at, NOW())
+WHERE id = $2;
+
+-- name: SetUserRole :execrows
+UPDATE users
+SET updated_at = NOW(), role = $1
+WHERE id = $2;
+
+-- name: DeleteUser :execrows
+DELETE FROM users
+WHERE id = $1;
+
+-- name: ScheduleUserDeletion :one
+UPDATE users
+SET updated_at = NOW(), delete_after = NOW() + sqlc.arg(grace_seconds)::float8 * INTERVAL '1 second', token_version = token_version + 1
+WHERE id = sqlc.arg(id)
+RETURNING delete_after;
+
+-- name: CancelUserDeletion :exec
+UPDATE users
+SET updated_at = NOW(), delete_after = NULL
+WHERE id = $1;
+
+-- name: IncrementTokenVersion :exec
+UPDATE users
+SET updated_at = NOW(), token_version = token_version + 1
+WHERE id = $1;
+
+-- name: PurgeDeletedUsers :execrows
+DELETE FROM users
+WHERE delete_after <= NOW();
+
+-- name: GetUserProfileByHandle :one
+SELECT users.id, users.handle, users.display_name, users.bio, users.avatar_url, users.created_at,
+    (SELECT COUNT(*) FROM chirps WHERE chirps.user_id = users.id) AS chirp_count,
+    (SELECT COUNT(*) FROM follows WHERE follows.followee_id = users.id) AS follower_count,
+    (SELECT COUNT(*) FROM follows WHERE follows.follower_id = users.id) AS following_count
+FROM users
+WHERE users.handle = $1 AND users.delete_after IS NULL;
+
+-- name: UpdateUserProfile :one
+UPDATE users
+SET updated_at = NOW(),
+    handle = COALESCE(sqlc.narg('handle'), handle),
+    display_name = COALESCE(sqlc.narg('display_name'), display_name),
+    bio = COALESCE(sqlc.narg('bio'), bio),
+    avatar_url = COALESCE(sqlc.narg('avatar_url'), avatar_url)
+WHERE id = sqlc.arg('id')
+RETURNING *;
+
+-- name: GetEmailConflicts :many
+SELECT lower(btrim(email)) AS normalized_email, id, email, created_at
+FROM users
+WHERE lower(btrim(email)) IN (
+    SELECT lower(btrim(email)) FROM users
+    GROUP BY lower(btrim(email))
+    HAVING COUNT(*) > 1
+)
+ORDER BY normalized_email, created_at;
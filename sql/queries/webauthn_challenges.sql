@@ -0,0 +1,19 @@
+-- name: CreateWebAuthnChallenge :exec
+INSERT INTO webauthn_challenges (challenge, ceremony, user_id, expires_at)
+VALUES (
+    sqlc.arg(challenge),
+    sqlc.arg(ceremony),
+    sqlc.narg(user_id),
+    NOW() + sqlc.arg(ttl_seconds)::float8 * INTERVAL '1 second'
+);
+
+-- name: ConsumeWebAuthnChallenge :one
+DELETE FROM webauthn_challenges
+WHERE challenge = $1
+AND ceremony = $2
+AND expires_at > NOW()
+RETURNING *;
+
+-- name: DeleteExpiredWebAuthnChallenges :exec
+DELETE FROM webauthn_challenges
+WHERE expires_at <= NOW();
@@ -0,0 +1,35 @@
+-- name: CreateWebAuthnCredential :one
+INSERT INTO webauthn_credentials (id, user_id, public_key, sign_count, name, created_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    NOW()
+)
+RETURNING *;
+
+-- name: GetWebAuthnCredential :one
+SELECT * FROM webauthn_credentials
+WHERE id = $1;
+
+-- name: GetWebAuthnCredentialsForUser :many
+SELECT * FROM webauthn_credentials
+WHERE user_id = $1
+ORDER BY created_at;
+
+-- name: UpdateWebAuthnSignCount :execrows
+UPDATE webauthn_credentials
+SET sign_count = sqlc.arg(sign_count), last_used_at = NOW()
+WHERE id = sqlc.arg(id)
+AND sign_count = sqlc.arg(previous_sign_count);
+
+-- name: DeleteWebAuthnCredentialForUser :execrows
+DELETE FROM webauthn_credentials
+WHERE id = $1
+AND user_id = $2;
+
+-- name: DeleteWebAuthnCredentialsForUser :exec
+DELETE FROM webauthn_credentials
+WHERE user_id = $1;
@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE webauthn_credentials(
+    id BYTEA PRIMARY KEY,
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    name TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials(user_id);
+
+CREATE TABLE webauthn_challenges(
+    challenge TEXT PRIMARY KEY,
+    ceremony TEXT NOT NULL,
+    user_id uuid REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE webauthn_challenges;
+DROP TABLE webauthn_credentials;
@@ -0,0 +1,37 @@
+-- +goose Up
+CREATE TABLE oauth_clients(
+    id uuid PRIMARY KEY,
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    redirect_uris TEXT[] NOT NULL,
+    secret_hash TEXT,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX oauth_clients_user_id_idx ON oauth_clients(user_id);
+
+CREATE TABLE oauth_authorization_codes(
+    code_hash TEXT PRIMARY KEY,
+    client_id uuid NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    code_challenge TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE oauth_grants(
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id uuid NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, client_id)
+);
+
+-- +goose Down
+DROP TABLE oauth_grants;
+DROP TABLE oauth_authorization_codes;
+DROP TABLE oauth_clients;
@@ -0,0 +1,36 @@
+-- +goose Up
+-- Emails that differ only by case or surrounding whitespace cannot share the
+-- new index. List every such group and stop, so they can be merged or
+-- renamed before migrating again. `chirpy email-conflicts` prints the same
+-- report without touching the schema.
+-- +goose StatementBegin
+DO $$
+DECLARE
+    conflict RECORD;
+    conflicts INT := 0;
+BEGIN
+    FOR conflict IN
+        SELECT lower(btrim(email)) AS normalized_email,
+            string_agg(id::text || ' <' || email || '>', ', ' ORDER BY created_at) AS accounts
+        FROM users
+        GROUP BY lower(btrim(email))
+        HAVING COUNT(*) > 1
+    LOOP
+        conflicts := conflicts + 1;
+        RAISE NOTICE 'email % is shared by %', conflict.normalized_email, conflict.accounts;
+    END LOOP;
+    IF conflicts > 0 THEN
+        RAISE EXCEPTION '% emails are shared by more than one account, see the notices above', conflicts;
+    END IF;
+END
+$$;
+-- +goose StatementEnd
+
+UPDATE users
+SET email = lower(btrim(email))
+WHERE email <> lower(btrim(email));
+
+CREATE UNIQUE INDEX users_email_lower_idx ON users (lower(email));
+
+-- +goose Down
+DROP INDEX users_email_lower_idx;
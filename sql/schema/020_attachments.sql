@@ -0,0 +1,21 @@
+-- +goose Up
+-- Attachments outlive their user and chirp as unattached rows, so the
+-- cleanup job can find them and delete their blobs from storage.
+CREATE TABLE attachments(
+    id uuid PRIMARY KEY,
+    user_id uuid REFERENCES users(id) ON DELETE SET NULL,
+    chirp_id uuid REFERENCES chirps(id) ON DELETE SET NULL,
+    position INT CHECK (position BETWEEN 0 AND 3),
+    content_type TEXT NOT NULL,
+    thumbnail_content_type TEXT NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (chirp_id, position)
+);
+
+CREATE INDEX attachments_unattached_idx ON attachments(created_at) WHERE chirp_id IS NULL;
+
+-- +goose Down
+DROP TABLE attachments;
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+	"github.com/thmastin/Chirpy/internal/database"
+)
+
+const (
+	// totpIssuer names the account in authenticator apps.
+	totpIssuer = "Chirpy"
+	// mfaChallengeTTL is how long a user has to enter their code after
+	// giving a correct password.
+	mfaChallengeTTL = 5 * time.Minute
+	// recoveryCodeCount is how many recovery codes are issued at a time.
+	recoveryCodeCount = 10
+)
+
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+type totpEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// secondFactorParams is the code a user proves their second factor with:
+// either a TOTP code or one of their recovery codes.
+type secondFactorParams struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// mfaThrottleKey counts wrong codes per account, separately from wrong
+// passwords.
+func mfaThrottleKey(userID uuid.UUID) string {
+	return "mfa:" + userID.String()
+}
+
+// mfaRequired answers a correct password with an MFA challenge when the
+// user has two-factor authentication enabled. It returns true if it wrote
+// the response.
+func mfaRequired(w http.ResponseWriter, r *http.Request, user database.User) bool {
+	credential, err := apiCfg.dbQueries.GetTOTPCredential(r.Context(), user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Unable to get TOTP credential: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return true
+	}
+	if !credential.ConfirmedAt.Valid {
+		return false
+	}
+
+	token, err := auth.MakeJWT(auth.Claims{
+		Type:         auth.TokenTypeMFAChallenge,
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+	}, apiCfg.jwtConfig, mfaChallengeTTL)
+	if err != nil {
+		log.Printf("Error creating token: %v", err)
+		respondWithError(w, 500, "failed to create token")
+		return true
+	}
+	respondWithJSON(w, 200, mfaChallengeResponse{MFARequired: true, MFAToken: token})
+	return true
+}
+
+// handlerLoginMFA exchanges an MFA challenge token and a valid second factor
+// for a session.
+func handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		MFAToken string `json:"mfa_token"`
+		secondFactorParams
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	claims, err := auth.ValidateJWT(params.MFAToken, apiCfg.jwtConfig, auth.TokenTypeMFAChallenge)
+	if err != nil {
+		respondWithError(w, 401, "Invalid or expired MFA token")
+		return
+	}
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user.TokenVersion != claims.TokenVersion) {
+		respondWithError(w, 401, "Invalid or expired MFA token")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+
+	if !checkSecondFactor(w, r, user.ID, params.secondFactorParams, 401) {
+		return
+	}
+	issueSession(w, r, user)
+}
+
+// checkSecondFactor verifies a TOTP or recovery code for the user, throttling
+// wrong guesses. On failure it writes the response, using failStatus for a
+// wrong code, and returns false.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, userID uuid.UUID, params secondFactorParams, failStatus int) bool {
+	key := mfaThrottleKey(userID)
+	retryAfter := max(apiCfg.loginAccountThrottle.Check(key), apiCfg.loginIPThrottle.Check(clientIP(r)))
+	if retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter)
+		return false
+	}
+
+	verified, err := verifySecondFactor(r.Context(), userID, params)
+	if err != nil {
+		log.Printf("Unable to verify second factor: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return false
+	}
+	if !verified {
+		apiCfg.loginAccountThrottle.Fail(key)
+		apiCfg.loginIPThrottle.Fail(clientIP(r))
+		respondWithError(w, failStatus, "Invalid authentication code")
+		return false
+	}
+	apiCfg.loginAccountThrottle.Reset(key)
+	return true
+}
+
+// verifySecondFactor checks a code against the user's confirmed TOTP
+// credential, or spends a recovery code. A TOTP code is accepted at most
+// once.
+func verifySecondFactor(ctx context.Context, userID uuid.UUID, params secondFactorParams) (bool, error) {
+	credential, err := apiCfg.dbQueries.GetTOTPCredential(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !credential.ConfirmedAt.Valid {
+		return false, nil
+	}
+
+	if params.RecoveryCode != "" {
+		used, err := apiCfg.dbQueries.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+			CodeHash: auth.HashRecoveryCode(params.RecoveryCode),
+			UserID:   userID,
+		})
+		return used == 1, err
+	}
+
+	step, ok := auth.ValidateTOTP(credential.Secret, params.Code, time.Now(), credential.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+	// Recording the step only if it is newer makes two concurrent uses of
+	// the same code race for one row.
+	used, err := apiCfg.dbQueries.UseTOTPStep(ctx, database.UseTOTPStepParams{
+		UserID:       userID,
+		LastUsedStep: step,
+	})
+	return used == 1, err
+}
+
+// handlerEnrollTOTP starts enrollment with a new secret. Two-factor
+// authentication is not required at login until the secret is confirmed
+// with a code from the authenticator.
+func handlerEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	user, err := apiCfg.dbQueries.GetUserByID(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to get user: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		log.Printf("Unable to generate TOTP secret: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	created, err := apiCfg.dbQueries.CreatePendingTOTPCredential(r.Context(), database.CreatePendingTOTPCredentialParams{
+		UserID: userID,
+		Secret: secret,
+	})
+	if err != nil {
+		log.Printf("Unable to create TOTP credential: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if created == 0 {
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	}
+
+	respondWithJSON(w, 200, totpEnrollment{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPURI(totpIssuer, user.Email, secret),
+	})
+}
+
+// handlerConfirmTOTP turns on two-factor authentication once the user shows
+// their authenticator produces valid codes, and returns their recovery
+// codes. This is the only time the codes are shown.
+func handlerConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	var params struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+
+	key := mfaThrottleKey(userID)
+	if retryAfter := apiCfg.loginAccountThrottle.Check(key); retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter)
+		return
+	}
+
+	credential, err := apiCfg.dbQueries.GetTOTPCredential(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 400, "Two-factor enrollment has not been started")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to get TOTP credential: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if credential.ConfirmedAt.Valid {
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(credential.Secret, params.Code, time.Now(), credential.LastUsedStep)
+	if !ok {
+		apiCfg.loginAccountThrottle.Fail(key)
+		respondWithError(w, 400, "Invalid authentication code")
+		return
+	}
+	apiCfg.loginAccountThrottle.Reset(key)
+
+	confirmed, err := apiCfg.dbQueries.ConfirmTOTPCredential(r.Context(), database.ConfirmTOTPCredentialParams{
+		UserID:       userID,
+		LastUsedStep: step,
+	})
+	if err != nil {
+		log.Printf("Unable to confirm TOTP credential: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if confirmed == 0 {
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to create recovery codes: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 200, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// handlerRegenerateRecoveryCodes replaces every recovery code, used or not,
+// after checking a current TOTP code.
+func handlerRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	var params struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	if !checkSecondFactor(w, r, userID, secondFactorParams{Code: params.Code}, 400) {
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(r.Context(), userID)
+	if err != nil {
+		log.Printf("Unable to create recovery codes: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 200, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// handlerDisableTOTP turns two-factor authentication off. It needs a TOTP or
+// recovery code so a stolen access token alone cannot remove it.
+func handlerDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	var params secondFactorParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid request body")
+		return
+	}
+	if !checkSecondFactor(w, r, userID, params, 400) {
+		return
+	}
+
+	if err := apiCfg.dbQueries.DeleteTOTPCredential(r.Context(), userID); err != nil {
+		log.Printf("Unable to delete TOTP credential: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	if err := apiCfg.dbQueries.DeleteRecoveryCodesForUser(r.Context(), userID); err != nil {
+		log.Printf("Unable to delete recovery codes: %v", err)
+		respondWithError(w, 500, "Server Error")
+		return
+	}
+	respondWithJSON(w, 204, nil)
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and stores the
+// hashes of a fresh set, returning the plaintext codes.
+func replaceRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := apiCfg.dbQueries.DeleteRecoveryCodesForUser(ctx, userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		err := apiCfg.dbQueries.CreateRecoveryCode(ctx, database.CreateRecoveryCodeParams{
+			CodeHash: auth.HashRecoveryCode(code),
+			UserID:   userID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
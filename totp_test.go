@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thmastin/Chirpy/internal/auth"
+)
+
+func callWithToken(handler http.HandlerFunc, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	requireAuth(handler)(rec, req)
+	return rec
+}
+
+func loginMFA(mfaToken, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/login/mfa", strings.NewReader(`{"mfa_token":"`+mfaToken+`",`+body+`}`))
+	rec := httptest.NewRecorder()
+	handlerLoginMFA(rec, req)
+	return rec
+}
+
+// totpCode returns a valid code for secret, offset by steps from now.
+func totpCode(t *testing.T, secret string, steps int64) string {
+	t.Helper()
+	code, err := auth.TOTPCode(secret, auth.TOTPStep(time.Now())+steps)
+	if err != nil {
+		t.Fatalf("Failed to make TOTP code: %v", err)
+	}
+	return code
+}
+
+// enableTOTP enrolls and confirms TOTP for the user, returning the secret
+// and recovery codes.
+func enableTOTP(t *testing.T, userID uuid.UUID) (string, []string) {
+	t.Helper()
+	token := bearer(t, userID)[len("Bearer "):]
+	rec := callWithToken(handlerEnrollTOTP, "POST", "/api/users/me/totp", token, "")
+	if rec.Code != 200 {
+		t.Fatalf("Expected enrollment to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var enrollment totpEnrollment
+	json.NewDecoder(rec.Body).Decode(&enrollment)
+
+	rec = callWithToken(handlerConfirmTOTP, "POST", "/api/users/me/totp/confirm", token, `{"code":"`+totpCode(t, enrollment.Secret, 0)+`"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected confirmation to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var codes recoveryCodesResponse
+	json.NewDecoder(rec.Body).Decode(&codes)
+	return enrollment.Secret, codes.RecoveryCodes
+}
+
+func mfaToken(t *testing.T, email, password string) string {
+	t.Helper()
+	rec := login(email, password)
+	var challenge mfaChallengeResponse
+	json.NewDecoder(rec.Body).Decode(&challenge)
+	if rec.Code != 200 || !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("Expected an MFA challenge, got %d: %s", rec.Code, rec.Body.String())
+	}
+	return challenge.MFAToken
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	token := bearer(t, user.ID)[len("Bearer "):]
+
+	rec := callWithToken(handlerEnrollTOTP, "POST", "/api/users/me/totp", token, "")
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var enrollment totpEnrollment
+	json.NewDecoder(rec.Body).Decode(&enrollment)
+	if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/Chirpy:user@example.com?") ||
+		!strings.Contains(enrollment.ProvisioningURI, "secret="+enrollment.Secret) {
+		t.Errorf("Unexpected provisioning URI %q", enrollment.ProvisioningURI)
+	}
+
+	// Until confirmed, login does not ask for a code.
+	if rec := login("user@example.com", "correct horse battery staple"); strings.Contains(rec.Body.String(), "mfa_token") {
+		t.Errorf("Expected pending enrollment not to require MFA: %s", rec.Body.String())
+	}
+
+	if rec := callWithToken(handlerConfirmTOTP, "POST", "/api/users/me/totp/confirm", token, `{"code":"000000"}`); rec.Code != 400 {
+		t.Errorf("Expected wrong code to be rejected, got %d", rec.Code)
+	}
+	rec = callWithToken(handlerConfirmTOTP, "POST", "/api/users/me/totp/confirm", token, `{"code":"`+totpCode(t, enrollment.Secret, 0)+`"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var codes recoveryCodesResponse
+	json.NewDecoder(rec.Body).Decode(&codes)
+	if len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("Expected %d recovery codes, got %d", recoveryCodeCount, len(codes.RecoveryCodes))
+	}
+	for _, code := range codes.RecoveryCodes {
+		if _, ok := db.recoveryCodes[code]; ok {
+			t.Fatal("Expected recovery codes to be stored hashed")
+		}
+	}
+
+	if rec := callWithToken(handlerEnrollTOTP, "POST", "/api/users/me/totp", token, ""); rec.Code != 409 {
+		t.Errorf("Expected re-enrollment to be refused while enabled, got %d", rec.Code)
+	}
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	secret, _ := enableTOTP(t, user.ID)
+
+	challenge := mfaToken(t, "user@example.com", "correct horse battery staple")
+	if rec := callWithToken(handlerEnrollTOTP, "POST", "/api/users/me/totp", challenge, ""); rec.Code != 401 {
+		t.Errorf("Expected MFA token to be refused as an access token, got %d", rec.Code)
+	}
+
+	// The code used to confirm enrollment cannot be replayed.
+	used, _ := auth.TOTPCode(secret, db.totp[user.ID].LastUsedStep)
+	if rec := loginMFA(challenge, `"code":"`+used+`"`); rec.Code != 401 {
+		t.Errorf("Expected a used code to be rejected, got %d", rec.Code)
+	}
+	next := totpCode(t, secret, 1)
+	rec := loginMFA(challenge, `"code":"`+next+`"`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var session User
+	json.NewDecoder(rec.Body).Decode(&session)
+	if session.Token == "" || session.RefreshToken == "" {
+		t.Fatal("Expected access and refresh tokens")
+	}
+	if rec := callWithToken(handlerGetSessions, "GET", "/api/users/me/sessions", session.Token, ""); rec.Code != 200 {
+		t.Errorf("Expected the new access token to work, got %d", rec.Code)
+	}
+	if rec := loginMFA(challenge, `"code":"`+next+`"`); rec.Code != 401 {
+		t.Errorf("Expected a code to work only once, got %d", rec.Code)
+	}
+
+	access := bearer(t, user.ID)[len("Bearer "):]
+	if rec := loginMFA(access, `"code":"`+totpCode(t, secret, -1)+`"`); rec.Code != 401 {
+		t.Errorf("Expected an access token to be refused as an MFA token, got %d", rec.Code)
+	}
+}
+
+func TestLoginWithRecoveryCode(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	secret, codes := enableTOTP(t, user.ID)
+
+	challenge := mfaToken(t, "user@example.com", "correct horse battery staple")
+	if rec := loginMFA(challenge, `"recovery_code":"`+strings.ToUpper(codes[0])+`"`); rec.Code != 200 {
+		t.Fatalf("Expected recovery code to work, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := loginMFA(challenge, `"recovery_code":"`+codes[0]+`"`); rec.Code != 401 {
+		t.Errorf("Expected a recovery code to work only once, got %d", rec.Code)
+	}
+
+	// Regenerating discards the old codes.
+	rec := callWithToken(handlerRegenerateRecoveryCodes, "POST", "/api/users/me/totp/recovery-codes", bearer(t, user.ID)[len("Bearer "):], `{"code":"`+totpCode(t, secret, 1)+`"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var fresh recoveryCodesResponse
+	json.NewDecoder(rec.Body).Decode(&fresh)
+	if rec := loginMFA(challenge, `"recovery_code":"`+codes[1]+`"`); rec.Code != 401 {
+		t.Errorf("Expected old recovery code to be discarded, got %d", rec.Code)
+	}
+	if rec := loginMFA(challenge, `"recovery_code":"`+fresh.RecoveryCodes[0]+`"`); rec.Code != 200 {
+		t.Errorf("Expected new recovery code to work, got %d", rec.Code)
+	}
+}
+
+func TestMFATokenRevokedByPasswordChange(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	secret, _ := enableTOTP(t, user.ID)
+
+	challenge := mfaToken(t, "user@example.com", "correct horse battery staple")
+	updateLogin(bearer(t, user.ID)[len("Bearer "):], `{"password":"purple monkey dishwasher","current_password":"correct horse battery staple"}`)
+	if rec := loginMFA(challenge, `"code":"`+totpCode(t, secret, 1)+`"`); rec.Code != 401 {
+		t.Errorf("Expected MFA token to be revoked by a password change, got %d", rec.Code)
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	_, codes := enableTOTP(t, user.ID)
+	token := bearer(t, user.ID)[len("Bearer "):]
+
+	if rec := callWithToken(handlerDisableTOTP, "DELETE", "/api/users/me/totp", token, `{"code":"000000"}`); rec.Code != 400 {
+		t.Errorf("Expected wrong code to be rejected, got %d", rec.Code)
+	}
+	if rec := callWithToken(handlerDisableTOTP, "DELETE", "/api/users/me/totp", token, `{"recovery_code":"`+codes[0]+`"}`); rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var session User
+	json.NewDecoder(login("user@example.com", "correct horse battery staple").Body).Decode(&session)
+	if session.Token == "" {
+		t.Error("Expected login without MFA after disabling it")
+	}
+	if len(db.recoveryCodes) != 0 {
+		t.Errorf("Expected recovery codes to be deleted, got %d", len(db.recoveryCodes))
+	}
+}
+
+func TestMFACodeThrottle(t *testing.T) {
+	db := setupTestAPI(t)
+	user := addTestUser(t, db, "user@example.com", "correct horse battery staple")
+	secret, _ := enableTOTP(t, user.ID)
+	challenge := mfaToken(t, "user@example.com", "correct horse battery staple")
+
+	for i := 0; i <= loginAccountPolicy.FreeAttempts; i++ {
+		if rec := loginMFA(challenge, `"code":"000000"`); rec.Code != 401 {
+			t.Fatalf("Attempt %d: expected status 401, got %d", i+1, rec.Code)
+		}
+	}
+	rec := loginMFA(challenge, `"code":"`+totpCode(t, secret, 1)+`"`)
+	if rec.Code != 429 {
+		t.Errorf("Expected status 429, got %d", rec.Code)
+	}
+}